@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,6 +31,8 @@ const (
 // Condition Types
 const (
 	ConditionTypeReady string = "Ready"
+	// True while resources restored or cloned from the VMDiskImage exist.
+	ConditionTypeInUse string = "InUse"
 )
 
 // Condition Reasons
@@ -42,7 +45,21 @@ const (
 	ReasonMissingSourceArtifact       string = "MissingSourceArtifact"
 	ReasonSyncAttemptDurationExceeded string = "SyncAttemptDurationExceeded"
 	ReasonUnknownSyncFailure          string = "UnknownSyncFailure"
+	ReasonSnapshotFailed              string = "SnapshotFailed"
+	ReasonChecksumMismatch            string = "ChecksumMismatch"
+	ReasonChecksumVerificationFailed  string = "ChecksumVerificationFailed"
+	ReasonUnsizableDisk               string = "UnsizableDisk"
 	ReasonSynced                      string = "Synced"
+	ReasonDeleting                    string = "Deleting"
+	ReasonDeletionFailed              string = "DeletionFailed"
+	ReasonAdopting                    string = "Adopting"
+	ReasonAdoptionFailed              string = "AdoptionFailed"
+	ReasonAdopted                     string = "Adopted"
+	ReasonPreflightFailed             string = "PreflightFailed"
+	ReasonConsumersFound              string = "ConsumersFound"
+	ReasonNoConsumers                 string = "NoConsumers"
+	ReasonWaitingForConsumers         string = "WaitingForConsumers"
+	ReasonImportFailed                string = "ImportFailed"
 )
 
 // CRD phases
@@ -52,45 +69,533 @@ const (
 	PhaseReady            string = "Ready"
 	PhaseRetryableFailure string = "RetryableFailure"
 	PhaseFailed           string = "Failed"
+	PhaseDeleting         string = "Deleting"
 )
 
 // VMDiskImage Labels
 const (
-	VMDiskImageOwnerLabel string = "owner"
+	// Set on every child resource with the name and UID of its VMDiskImage
+	VMDiskImageNameLabel string = "vmdiskimage.pelotech.ot/name"
+	VMDiskImageUIDLabel  string = "vmdiskimage.pelotech.ot/uid"
+	// Set on the child resources of a named disk with the name of the disk
+	VMDiskImageDiskLabel string = "vmdiskimage.pelotech.ot/disk"
+	// Deprecated: replaced by VMDiskImageNameLabel and VMDiskImageUIDLabel.
+	// Child resources created before the switch are migrated on startup.
+	VMDiskImageLegacyOwnerLabel string = "owner"
+	// Deprecated: replaced by VMDiskImageDiskLabel and
+	// VMDiskImageSourceNamespaceLabel. Child resources created before the
+	// switch are migrated on startup.
+	VMDiskImageLegacyDiskLabel            string = "disk"
+	VMDiskImageLegacySourceNamespaceLabel string = "source-namespace"
+	// Set on the ConfigMaps holding the diagnostics of failed syncs
+	VMDiskImageDiagnosticsLabel string = "vmdiskimage.pelotech.ot/failure-diagnostics"
+
+	// Set on every child resource of a VMDiskImage with an image identity
+	VMDiskImageImageNameLabel    string = "app.kubernetes.io/name"
+	VMDiskImageImageVersionLabel string = "app.kubernetes.io/version"
+	// Set on the copies of a VMDiskImage's snapshots that live in other namespaces
+	VMDiskImageSourceNamespaceLabel string = "vmdiskimage.pelotech.ot/source-namespace"
 )
 
 const VMDiskImageFinalizer = "pelotech.ot/vm-disk-image-finalizer"
 
-// VMDiskImageSpec defines the desired state of VMDiskImage.
-type VMDiskImageSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+// Setting this annotation to "true" on a VMDiskImage that is being deleted
+// strips the finalizers of child resources that are stuck terminating. It
+// also deletes VMDiskImages that are still in use without waiting.
+const VMDiskImageForceDeleteAnnotation = "pelotech.ot/force-delete"
+
+// Set on a namespace to let the VMDiskImages of other namespaces clone its
+// PVCs and VolumeSnapshots. It holds a comma separated list of the namespaces
+// allowed to, or "*" for all. The namespace also has to bind the clone source
+// ClusterRole to the operator's ServiceAccount.
+const VMDiskImageCloneTargetsAnnotation = "vmdiskimage.pelotech.ot/clone-targets"
+
+// Set on a namespace to accept the snapshot copies of the VMDiskImages of
+// other namespaces. It holds a comma separated list of the namespaces allowed
+// to copy their snapshots in, or "*" for all.
+const VMDiskImageCopySourcesAnnotation = "vmdiskimage.pelotech.ot/copy-sources"
+
+// Set on child resources that were kept when their VMDiskImage was deleted.
+// It holds the namespace and name of the VMDiskImage.
+const VMDiskImageRetainedFromAnnotation = "vmdiskimage.pelotech.ot/retained-from"
+
+// Set on the volumes kept from a failed sync for debugging. The label holds
+// the failure count of the sync and the annotation when the volume is deleted.
+const (
+	VMDiskImageFailedAttemptLabel    = "vmdiskimage.pelotech.ot/failed-attempt"
+	VMDiskImageRetainUntilAnnotation = "vmdiskimage.pelotech.ot/retain-until"
+)
 
-	// +kubebuilder:validation:required
-	// +kubebuilder:validation:minlength=1
-	SecretRef string `json:"secretRef"`
+// Setting this annotation to "true" keeps a VMDiskImage from being pruned
+// when its image version is older than the retained ones.
+const VMDiskImagePinAnnotation = "pelotech.ot/pin"
+
+// Setting this annotation to "true" adopts the existing VolumeSnapshots or
+// PVCs named like the resources of each disk instead of importing the data.
+const VMDiskImageAdoptAnnotation = "pelotech.ot/adopt"
+
+// Adoptable resource kinds
+const (
+	AdoptKindPersistentVolumeClaim string = "PersistentVolumeClaim"
+	AdoptKindVolumeSnapshot        string = "VolumeSnapshot"
+)
+
+// Deletion policies
+const (
+	DeletionPolicyDelete string = "Delete"
+	DeletionPolicyRetain string = "Retain"
+	DeletionPolicyOrphan string = "Orphan"
+)
+
+// VMDiskSpec describes the source and storage of a single disk.
+type VMDiskSpec struct {
+	// +kubebuilder:validation:Optional
+	SecretRef string `json:"secretRef,omitempty"`
 
 	// +kubebuilder:validation:MinLength=1
 	// +kubebuilder:default="not-provided"
 	// +optional
-	URL string `json:"url"`
+	URL string `json:"url,omitempty"`
 
 	// NOTE: The "blank" type isn't used yet in production but is useful locally. This can be removed if we want
-	// +kubebuilder:validation:Enum=s3;registry;blank
-	SourceType string `json:"sourceType"`
+	// +kubebuilder:validation:Enum=s3;registry;http;pvc;snapshot;blank
+	// +optional
+	SourceType string `json:"sourceType,omitempty"`
+
+	// SourceRef is the PVC or VolumeSnapshot cloned by the pvc and snapshot
+	// source types.
+	// +kubebuilder:validation:Optional
+	SourceRef *VMDiskImageSourceRef `json:"sourceRef,omitempty"`
 
-	// DiskSize specifies the size of the disk, e.g., "10Gi", "500Mi".
+	// DiskSize specifies the size of the disk, e.g., "10Gi", "500Mi". When it
+	// is not set the disk is sized from its source plus the operator's
+	// overhead. Required by the blank source type and by sources whose size
+	// cannot be determined, such as registry images.
 	// +kubebuilder:validation:Pattern=`^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$`
-	DiskSize string `json:"diskSize"`
+	// +optional
+	DiskSize string `json:"diskSize,omitempty"`
 
 	// +kubebuilder:validation:Optional
 	StorageClass *string `json:"storageClass,omitempty"`
 
+	// VolumeMode of the disk's volume. Defaults to Filesystem, or to what
+	// the StorageProfile of the storage class sets when storageAPI is used.
+	// +kubebuilder:validation:Enum=Block;Filesystem
+	// +kubebuilder:validation:Optional
+	VolumeMode *corev1.PersistentVolumeMode `json:"volumeMode,omitempty"`
+
+	// AccessModes of the disk's volume, e.g. ReadWriteMany for VMs that live
+	// migrate. Defaults to ReadWriteOnce, or to what the StorageProfile of the
+	// storage class sets when storageAPI is used.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:items:Enum=ReadWriteOnce;ReadOnlyMany;ReadWriteMany;ReadWriteOncePod
+	// +listType=set
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// ContentType of the source. kubevirt sources hold a disk image and
+	// archive sources a tar archive extracted onto the volume.
+	// +kubebuilder:validation:Enum=kubevirt;archive
+	// +kubebuilder:validation:Optional
+	ContentType string `json:"contentType,omitempty"`
+
+	// StorageAPI creates the DataVolume with spec.storage instead of spec.pvc
+	// so CDI fills in what is not set from the StorageProfile of the storage
+	// class. Defaults to the operator's setting.
+	// +kubebuilder:validation:Optional
+	StorageAPI *bool `json:"storageAPI,omitempty"`
+
+	// CertConfigMap holds the CA bundle to trust when pulling from an S3
+	// endpoint, HTTPS server or registry with a private certificate. It sits
+	// next to secretRef rather than under registry since the s3, http and
+	// registry source types all use it, as do the probes and checksum jobs.
 	// +kubebuilder:validation:Optional
 	CertConfigMap *string `json:"certConfigMap,omitempty"`
 
+	// Registry configures how the registry source type pulls the image.
+	// +kubebuilder:validation:Optional
+	Registry *VMDiskImageRegistrySource `json:"registry,omitempty"`
+
 	// +kubebuilder:validation:Optional
 	SnapshotClass *string `json:"snapshotClass,omitempty"`
+
+	// ExtraHeaders are added to the requests of the http source type, e.g.
+	// "Accept: application/octet-stream".
+	// +kubebuilder:validation:Optional
+	ExtraHeaders []string `json:"extraHeaders,omitempty"`
+
+	// SecretExtraHeaders name Secrets holding headers with sensitive values,
+	// like tokens, that are added to the requests of the http source type.
+	// +kubebuilder:validation:Optional
+	SecretExtraHeaders []string `json:"secretExtraHeaders,omitempty"`
+
+	// Checksum of the artifact the disk is imported from, as stored in S3 or
+	// served over HTTP. When set the artifact is downloaded and hashed once the
+	// disk is imported, and the disk is only snapshotted if it matches.
+	// +kubebuilder:validation:Optional
+	Checksum *VMDiskImageChecksum `json:"checksum,omitempty"`
+
+	// Adopt takes an existing PVC or VolumeSnapshot holding the disk's data
+	// under management instead of importing it again. The disks of a
+	// VMDiskImage are either all adopted or all imported.
+	// +kubebuilder:validation:Optional
+	Adopt *VMDiskImageAdoption `json:"adopt,omitempty"`
+}
+
+// VMDiskImageAdoption finds the existing resource a disk is adopted from.
+// +kubebuilder:validation:XValidation:rule="!(has(self.name) && has(self.selector))",message="name and selector are mutually exclusive"
+type VMDiskImageAdoption struct {
+	// +kubebuilder:validation:Enum=PersistentVolumeClaim;VolumeSnapshot
+	Kind string `json:"kind"`
+
+	// Name of the resource to adopt. Defaults to the name the operator gives
+	// the resources of the disk.
+	// +kubebuilder:validation:Optional
+	Name string `json:"name,omitempty"`
+
+	// Selector finds the resource to adopt by its labels. Exactly one resource
+	// in the namespace of the VMDiskImage has to match.
+	// +kubebuilder:validation:Optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// VMDiskImageIdentity names the image and version a VMDiskImage holds.
+type VMDiskImageIdentity struct {
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`
+	Name string `json:"name"`
+
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`
+	Version string `json:"version"`
+}
+
+// VMDiskImageRegistrySource configures how a disk image is pulled from a
+// container registry.
+type VMDiskImageRegistrySource struct {
+	// PullMethod is pod to pull through the importer pod or node to pull
+	// through the container runtime of the node. Defaults to pod.
+	// +kubebuilder:validation:Enum=pod;node
+	// +kubebuilder:validation:Optional
+	PullMethod string `json:"pullMethod,omitempty"`
+
+	// ImageStream imports from an OpenShift ImageStream instead of the url.
+	// It requires the node pull method.
+	// +kubebuilder:validation:Optional
+	ImageStream *string `json:"imageStream,omitempty"`
+
+	// Digest pins the image, replacing any tag in the url. Without it tags are
+	// resolved to a digest when the sync starts.
+	// +kubebuilder:validation:Pattern=`^sha256:[a-f0-9]{64}$`
+	// +kubebuilder:validation:Optional
+	Digest string `json:"digest,omitempty"`
+}
+
+// VMDiskImageSourceRef references an in-cluster volume to clone.
+type VMDiskImageSourceRef struct {
+	// Namespace of the source. Defaults to the namespace of the VMDiskImage.
+	// Another namespace has to list the VMDiskImage's namespace in its
+	// vmdiskimage.pelotech.ot/clone-targets annotation and bind the clone
+	// source ClusterRole to the operator.
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// VMDiskImageChecksum is the expected digest of the artifact a disk is imported from.
+type VMDiskImageChecksum struct {
+	// +kubebuilder:validation:Enum=md5;sha1;sha256;sha512
+	Algorithm string `json:"algorithm"`
+
+	// The hex encoded digest of the artifact.
+	// +kubebuilder:validation:Pattern=`^[a-fA-F0-9]+$`
+	Digest string `json:"digest"`
+}
+
+// VMDiskImageDisk is one of the disks of a multi-disk VMDiskImage.
+// +kubebuilder:validation:XValidation:rule="has(self.sourceType) || has(self.adopt)",message="sourceType is required for every disk that is not adopted"
+// +kubebuilder:validation:XValidation:rule="!has(self.sourceType) || self.sourceType != 'blank' || has(self.diskSize)",message="diskSize is required by the blank source type"
+// +kubebuilder:validation:XValidation:rule="!has(self.sourceType) || !(self.sourceType in ['pvc', 'snapshot']) || has(self.sourceRef)",message="sourceRef is required by the pvc and snapshot source types"
+// +kubebuilder:validation:XValidation:rule="!has(self.checksum) || (has(self.sourceType) && self.sourceType in ['s3', 'http'])",message="checksum is only supported by the s3 and http source types"
+// +kubebuilder:validation:XValidation:rule="!has(self.certConfigMap) || (has(self.sourceType) && self.sourceType in ['s3', 'http', 'registry'])",message="certConfigMap is only supported by the s3, http and registry source types"
+type VMDiskImageDisk struct {
+	// Name identifies the disk within the VMDiskImage. It is appended to the
+	// VMDiskImage name to build the names of the disk's child resources.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+
+	VMDiskSpec `json:",inline"`
+}
+
+// VMDiskImageSpec defines the desired state of VMDiskImage.
+// +kubebuilder:validation:XValidation:rule="(has(self.disks) && size(self.disks) > 0) || has(self.sourceType) || has(self.adopt)",message="either disks, adopt or sourceType must be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.sourceType) || !(self.sourceType in ['pvc', 'snapshot']) || has(self.sourceRef)",message="sourceRef is required by the pvc and snapshot source types"
+// +kubebuilder:validation:XValidation:rule="!has(self.sourceType) || self.sourceType != 'blank' || has(self.diskSize)",message="diskSize is required by the blank source type"
+// +kubebuilder:validation:XValidation:rule="!has(self.checksum) || (has(self.sourceType) && self.sourceType in ['s3', 'http'])",message="checksum is only supported by the s3 and http source types"
+// +kubebuilder:validation:XValidation:rule="!has(self.certConfigMap) || (has(self.sourceType) && self.sourceType in ['s3', 'http', 'registry'])",message="certConfigMap is only supported by the s3, http and registry source types"
+// +kubebuilder:validation:XValidation:rule="!has(self.disks) || self.disks.all(d, has(d.adopt)) || self.disks.all(d, !has(d.adopt))",message="either every disk or none of them must set adopt"
+type VMDiskImageSpec struct {
+	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// Image identifies the image and version the VMDiskImage holds. Disks
+	// without a url get one from the operator's url template for their source
+	// type, e.g. "s3://bucket/images/{{name}}/{{version}}/vm.qcow2".
+	// +kubebuilder:validation:Optional
+	Image *VMDiskImageIdentity `json:"image,omitempty"`
+
+	// The top level disk fields describe a single disk VMDiskImage. They are
+	// ignored when Disks is set.
+	VMDiskSpec `json:",inline"`
+
+	// Disks lists the disks of a multi-disk VMDiskImage. All disks are synced
+	// and snapshotted together so they stay version-locked.
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=name
+	Disks []VMDiskImageDisk `json:"disks,omitempty"`
+
+	// VolumeGroupSnapshotClass is used when the disks of a multi-disk
+	// VMDiskImage are snapshotted together through a VolumeGroupSnapshot.
+	// +kubebuilder:validation:Optional
+	VolumeGroupSnapshotClass *string `json:"volumeGroupSnapshotClass,omitempty"`
+
+	// TargetNamespaces lists namespaces that receive their own copy of the
+	// VMDiskImage's snapshots once it is Ready. Copies reference the same
+	// underlying storage snapshot so the data is never downloaded again.
+	// A namespace only receives copies once it lists the namespace of the
+	// VMDiskImage in its vmdiskimage.pelotech.ot/copy-sources annotation.
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	TargetNamespaces []string `json:"targetNamespaces,omitempty"`
+
+	// TargetNamespaceSelector selects additional namespaces that receive a
+	// copy of the VMDiskImage's snapshots. Selected namespaces have to opt
+	// in the same way as listed ones.
+	// +kubebuilder:validation:Optional
+	TargetNamespaceSelector *metav1.LabelSelector `json:"targetNamespaceSelector,omitempty"`
+
+	// DataSource configures the CDI DataSource published for the VMDiskImage
+	// once it is Ready.
+	// +kubebuilder:validation:Optional
+	DataSource *VMDiskImageDataSource `json:"dataSource,omitempty"`
+
+	// DeletionPolicy decides what happens to the child resources when the
+	// VMDiskImage is deleted. Delete removes all of them, Retain keeps the
+	// snapshots and Orphan keeps everything. Kept resources are released from
+	// the VMDiskImage. Defaults to the operator's default deletion policy.
+	// +kubebuilder:validation:Enum=Delete;Retain;Orphan
+	// +kubebuilder:validation:Optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+
+	// BandwidthLimit caps how fast the http and s3 disks are downloaded, in
+	// bits per second, e.g. "500M". Defaults to the operator's default limit
+	// and is lowered to the share of the operator's bandwidth budget the sync
+	// gets. Limited disks are downloaded by an import job of the operator,
+	// which uploads them to their DataVolume through CDI's upload proxy,
+	// because CDI's importer pods cannot be throttled.
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)?[kMGT]?$`
+	// +kubebuilder:validation:Optional
+	BandwidthLimit string `json:"bandwidthLimit,omitempty"`
+
+	// ImporterPlacement decides which nodes the pods downloading the disks
+	// run on. Defaults to the operator's default placement. Placed http and s3
+	// disks are downloaded by an import job of the operator, like limited
+	// ones, and the checksum jobs are placed too. Registry and clone imports
+	// still run in CDI's pods, which CDI only places cluster wide through the
+	// workload placement of its CDI resource.
+	// +kubebuilder:validation:Optional
+	ImporterPlacement *VMDiskImagePlacement `json:"importerPlacement,omitempty"`
+
+	// Debug helps investigate syncs that fail.
+	// +kubebuilder:validation:Optional
+	Debug *VMDiskImageDebug `json:"debug,omitempty"`
+
+	// DataVolumeTemplate tunes the DataVolumes created for the disks.
+	// +kubebuilder:validation:Optional
+	DataVolumeTemplate *VMDiskImageDataVolumeTemplate `json:"dataVolumeTemplate,omitempty"`
+
+	// SnapshotTemplate tunes the VolumeSnapshots and VolumeGroupSnapshots
+	// taken of the disks.
+	// +kubebuilder:validation:Optional
+	SnapshotTemplate *VMDiskImageSnapshotTemplate `json:"snapshotTemplate,omitempty"`
+}
+
+// VMDiskImageDebug holds settings for investigating failed syncs.
+type VMDiskImageDebug struct {
+	// RetainFailedResources keeps the volume of each disk when a sync fails.
+	// It is moved to a new <disk>-failed-<n> PVC, n being the failure count,
+	// so the next attempt imports the disk again without waiting for it.
+	// +kubebuilder:validation:Optional
+	RetainFailedResources bool `json:"retainFailedResources,omitempty"`
+
+	// TTL is how long retained volumes are kept. Defaults to 24h.
+	// +kubebuilder:validation:Optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+}
+
+// VMDiskImagePlacement constrains the nodes pods are scheduled on.
+type VMDiskImagePlacement struct {
+	// +kubebuilder:validation:Optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+}
+
+// VMDiskImageDataVolumeTemplate holds overrides for the generated DataVolumes.
+type VMDiskImageDataVolumeTemplate struct {
+	// Labels added to the DataVolumes. They cannot replace the labels the
+	// operator manages.
+	// +kubebuilder:validation:Optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations added to the DataVolumes, which CDI passes on to their PVCs.
+	// +kubebuilder:validation:Optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ImporterPodAnnotations are added to the DataVolumes for CDI to pass on
+	// to the pods importing them. CDI only passes on the annotations it
+	// supports, e.g. k8s.v1.cni.cncf.io/networks and sidecar.istio.io/inject.
+	// +kubebuilder:validation:Optional
+	ImporterPodAnnotations map[string]string `json:"importerPodAnnotations,omitempty"`
+
+	// Preallocation allocates all of a disk's space while importing it.
+	// +kubebuilder:validation:Optional
+	Preallocation *bool `json:"preallocation,omitempty"`
+
+	// PriorityClassName of the pods importing the disks.
+	// +kubebuilder:validation:Optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// ImmediateBinding binds the volumes of the disks right away rather than
+	// waiting for a consumer, which a VMDiskImage never has. Defaults to true.
+	// +kubebuilder:validation:Optional
+	ImmediateBinding *bool `json:"immediateBinding,omitempty"`
+}
+
+// VMDiskImageSnapshotTemplate holds overrides for the generated snapshots.
+type VMDiskImageSnapshotTemplate struct {
+	// Labels added to the snapshots. They cannot replace the labels the
+	// operator manages.
+	// +kubebuilder:validation:Optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations added to the snapshots.
+	// +kubebuilder:validation:Optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// VMDiskImageDataSource configures the CDI DataSource published for a Ready
+// VMDiskImage so VirtualMachines can reference it through sourceRef.
+type VMDiskImageDataSource struct {
+	// Name of the published DataSource. VMDiskImages sharing a name publish
+	// through the same DataSource, which points at the one that became Ready
+	// most recently. Defaults to spec.image.name, lowercased with "_" and "."
+	// replaced by "-", or to the name of the VMDiskImage without an image.
+	// Multi-disk VMDiskImages publish one DataSource per disk suffixed with
+	// its name.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:Optional
+	Name string `json:"name,omitempty"`
+}
+
+// GetDisks returns the disks described by the spec. A spec without Disks
+// describes a single unnamed disk through its top level fields.
+func (s *VMDiskImageSpec) GetDisks() []VMDiskImageDisk {
+	if len(s.Disks) > 0 {
+		return s.Disks
+	}
+
+	return []VMDiskImageDisk{{VMDiskSpec: s.VMDiskSpec}}
+}
+
+// VMDiskImageDiskStatus defines the observed state of a single disk.
+type VMDiskImageDiskStatus struct {
+	// Name of the disk. Empty for a single disk VMDiskImage.
+	Name string `json:"name"`
+
+	DataVolumeName string `json:"dataVolumeName,omitempty"`
+	SnapshotName   string `json:"snapshotName,omitempty"`
+
+	// The phase of the disk's DataVolume.
+	Phase         string `json:"phase,omitempty"`
+	Progress      string `json:"progress,omitempty"`
+	SnapshotReady bool   `json:"snapshotReady,omitempty"`
+
+	// The result of verifying the checksum of the source artifact.
+	Checksum *VMDiskImageChecksumStatus `json:"checksum,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// VMDiskImageChecksumStatus defines the outcome of a checksum verification.
+type VMDiskImageChecksumStatus struct {
+	// The digest computed from the source artifact.
+	Digest string `json:"digest,omitempty"`
+
+	// Whether the computed digest matches the expected one.
+	Verified bool `json:"verified"`
+}
+
+// VMDiskImageCopyStatus defines the observed state of a snapshot copy in a
+// target namespace.
+type VMDiskImageCopyStatus struct {
+	Namespace string `json:"namespace"`
+
+	// Name of the disk the copy was made from. Empty for a single disk VMDiskImage.
+	Disk string `json:"disk,omitempty"`
+
+	SnapshotName string `json:"snapshotName,omitempty"`
+	ReadyToUse   bool   `json:"readyToUse,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// VMDiskImageSourceStatus reports what the source of a disk resolved to when
+// its sync started.
+type VMDiskImageSourceStatus struct {
+	// Name of the disk. Empty for a single disk VMDiskImage.
+	Disk string `json:"disk"`
+
+	// The url the disk is imported from.
+	URL string `json:"url,omitempty"`
+
+	// The digest of the registry image the disk is imported from.
+	Digest string `json:"digest,omitempty"`
+
+	// The size in bytes of the S3 or HTTP object the disk is imported from.
+	ContentLength int64 `json:"contentLength,omitempty"`
+
+	// The ETag of the S3 or HTTP object the disk is imported from.
+	ETag string `json:"etag,omitempty"`
+
+	// The image format the source starts with, e.g. qcow2 or raw. Empty for
+	// compressed sources.
+	Format string `json:"format,omitempty"`
+
+	// The compression of the source, e.g. gzip or xz.
+	Compression string `json:"compression,omitempty"`
+
+	// The size in bytes of the disk a qcow2 source holds.
+	VirtualSize int64 `json:"virtualSize,omitempty"`
+
+	// The size of the disk's volume, either its diskSize or the size worked
+	// out from its source.
+	DiskSize string `json:"diskSize,omitempty"`
+}
+
+// VMDiskImageConsumer is a resource restored or cloned from a VMDiskImage.
+type VMDiskImageConsumer struct {
+	// PersistentVolumeClaim, DataVolume or VirtualMachine.
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
 }
 
 // VMDiskImageStatus defines the observed state of VMDiskImage.
@@ -98,7 +603,7 @@ type VMDiskImageStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// +kubebuilder:validation:Enum=Queued;Syncing;Ready;Failed;RetryableFailure
+	// +kubebuilder:validation:Enum=Queued;Syncing;Ready;Failed;RetryableFailure;Deleting
 	Phase string `json:"phase"`
 
 	// A human-readable message providing more details about the current phase.
@@ -109,12 +614,46 @@ type VMDiskImageStatus struct {
 
 	FailureCount    int          `json:"failureCount,omitempty"`
 	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+
+	// Disks reports the state of each disk of the VMDiskImage.
+	Disks []VMDiskImageDiskStatus `json:"disks,omitempty"`
+
+	// The VolumeGroupSnapshot taking the snapshots of all disks, if one is used.
+	GroupSnapshotName string `json:"groupSnapshotName,omitempty"`
+
+	// Copies reports the state of the snapshot copies in the target namespaces.
+	Copies []VMDiskImageCopyStatus `json:"copies,omitempty"`
+
+	// DataSources lists the CDI DataSources currently pointing at the VMDiskImage.
+	DataSources []string `json:"dataSources,omitempty"`
+
+	// Sources reports what the source of each disk resolved to.
+	Sources []VMDiskImageSourceStatus `json:"sources,omitempty"`
+
+	// The bandwidth limit the http and s3 disks of the last sync were
+	// downloaded with, in bits per second. Empty when they were not limited.
+	BandwidthLimit string `json:"bandwidthLimit,omitempty"`
+
+	// The ConfigMap holding the importer logs, termination messages and
+	// Events collected when the last sync failed.
+	LastFailureDiagnostics string `json:"lastFailureDiagnostics,omitempty"`
+
+	// Consumers lists the resources restored or cloned from the snapshots,
+	// volumes and DataSources of the VMDiskImage. Only the first 50 are
+	// listed.
+	Consumers []VMDiskImageConsumer `json:"consumers,omitempty"`
+
+	// How many resources were restored or cloned from the VMDiskImage.
+	ConsumerCount int `json:"consumerCount,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:path=vmdiskimages,scope=Namespaced,shortName=vmdi,singular=vmdiskimage
+// +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".spec.image.name",priority=1
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".spec.image.version",priority=1
 // +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase",description="The current phase of the VMDiskImage."
+// +kubebuilder:printcolumn:name="Consumers",type="integer",JSONPath=".status.consumerCount",priority=1
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 type VMDiskImage struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -0,0 +1,145 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	WorkspaceImageSetControllerName = "data-sync-operator-wis-controller"
+)
+
+// WorkspaceImageSet Labels
+const (
+	// Set on the VMDiskImages a WorkspaceImageSet creates with its name and
+	// the name of the member they were created for
+	WorkspaceImageSetNameLabel   string = "workspaceimageset.pelotech.ot/name"
+	WorkspaceImageSetMemberLabel string = "workspaceimageset.pelotech.ot/member"
+)
+
+// WorkspaceImageSet condition reasons
+const (
+	ReasonAllMembersReady string = "AllMembersReady"
+	ReasonMembersNotReady string = "MembersNotReady"
+	ReasonMemberFailed    string = "MemberFailed"
+	ReasonMemberMissing   string = "MemberMissing"
+)
+
+// WorkspaceImageSetMember is one image of a workspace, either described
+// inline or referencing an existing VMDiskImage.
+// +kubebuilder:validation:XValidation:rule="has(self.template) != has(self.vmDiskImageRef)",message="exactly one of template and vmDiskImageRef must be set"
+type WorkspaceImageSetMember struct {
+	// Name identifies the member within the set. VMDiskImages created from a
+	// template are named <set name>-<member name>.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+
+	// Template is the spec of a VMDiskImage the set creates and owns.
+	// +kubebuilder:validation:Optional
+	Template *VMDiskImageSpec `json:"template,omitempty"`
+
+	// VMDiskImageRef references an existing VMDiskImage in the namespace of
+	// the set. The set only reports on it, it does not own or change it.
+	// +kubebuilder:validation:Optional
+	VMDiskImageRef *WorkspaceImageSetMemberRef `json:"vmDiskImageRef,omitempty"`
+}
+
+// WorkspaceImageSetMemberRef names an existing VMDiskImage.
+type WorkspaceImageSetMemberRef struct {
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// WorkspaceImageSetSpec defines the desired state of WorkspaceImageSet.
+//
+// The remaining fields are propagated to the VMDiskImages created from
+// templates that do not set them.
+type WorkspaceImageSetSpec struct {
+	// Members lists the images of the workspace.
+	// +kubebuilder:validation:MinItems=1
+	// +listType=map
+	// +listMapKey=name
+	Members []WorkspaceImageSetMember `json:"members"`
+
+	// PriorityClassName of the pods importing the members' disks.
+	// +kubebuilder:validation:Optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// DeletionPolicy of the members. See the VMDiskImage deletionPolicy.
+	// +kubebuilder:validation:Enum=Delete;Retain;Orphan
+	// +kubebuilder:validation:Optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+}
+
+// WorkspaceImageSetMemberStatus defines the observed state of a member.
+type WorkspaceImageSetMemberStatus struct {
+	Name string `json:"name"`
+
+	// The VMDiskImage of the member.
+	VMDiskImage string `json:"vmDiskImage"`
+
+	// The phase of the VMDiskImage. Empty when it does not exist yet.
+	Phase string `json:"phase,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// WorkspaceImageSetStatus defines the observed state of WorkspaceImageSet.
+type WorkspaceImageSetStatus struct {
+	// Ready once every member is Ready and Failed as soon as one of them is.
+	// +kubebuilder:validation:Enum=Syncing;Ready;Failed
+	Phase string `json:"phase,omitempty"`
+
+	// Conditions of the WorkspaceImageSet resource.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// How many members are Ready, e.g. "2/3".
+	ReadyMembers string `json:"readyMembers,omitempty"`
+
+	// Members reports the phase of each member.
+	Members []WorkspaceImageSetMemberStatus `json:"members,omitempty"`
+
+	// The generation of the spec the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=workspaceimagesets,scope=Namespaced,shortName=wis,singular=workspaceimageset
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.readyMembers",description="How many members are Ready."
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase",description="The current phase of the WorkspaceImageSet."
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type WorkspaceImageSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WorkspaceImageSetSpec   `json:"spec,omitempty"`
+	Status WorkspaceImageSetStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type WorkspaceImageSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WorkspaceImageSet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WorkspaceImageSet{}, &WorkspaceImageSetList{})
+}
@@ -21,7 +21,8 @@ limitations under the License.
 package v1alpha1
 
 import (
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -52,6 +53,218 @@ func (in *VMDiskImage) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageAdoption) DeepCopyInto(out *VMDiskImageAdoption) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageAdoption.
+func (in *VMDiskImageAdoption) DeepCopy() *VMDiskImageAdoption {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageAdoption)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageChecksum) DeepCopyInto(out *VMDiskImageChecksum) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageChecksum.
+func (in *VMDiskImageChecksum) DeepCopy() *VMDiskImageChecksum {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageChecksum)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageChecksumStatus) DeepCopyInto(out *VMDiskImageChecksumStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageChecksumStatus.
+func (in *VMDiskImageChecksumStatus) DeepCopy() *VMDiskImageChecksumStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageChecksumStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageConsumer) DeepCopyInto(out *VMDiskImageConsumer) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageConsumer.
+func (in *VMDiskImageConsumer) DeepCopy() *VMDiskImageConsumer {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageConsumer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageCopyStatus) DeepCopyInto(out *VMDiskImageCopyStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageCopyStatus.
+func (in *VMDiskImageCopyStatus) DeepCopy() *VMDiskImageCopyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageCopyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageDataSource) DeepCopyInto(out *VMDiskImageDataSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageDataSource.
+func (in *VMDiskImageDataSource) DeepCopy() *VMDiskImageDataSource {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageDataSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageDataVolumeTemplate) DeepCopyInto(out *VMDiskImageDataVolumeTemplate) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ImporterPodAnnotations != nil {
+		in, out := &in.ImporterPodAnnotations, &out.ImporterPodAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Preallocation != nil {
+		in, out := &in.Preallocation, &out.Preallocation
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ImmediateBinding != nil {
+		in, out := &in.ImmediateBinding, &out.ImmediateBinding
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageDataVolumeTemplate.
+func (in *VMDiskImageDataVolumeTemplate) DeepCopy() *VMDiskImageDataVolumeTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageDataVolumeTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageDebug) DeepCopyInto(out *VMDiskImageDebug) {
+	*out = *in
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageDebug.
+func (in *VMDiskImageDebug) DeepCopy() *VMDiskImageDebug {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageDebug)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageDisk) DeepCopyInto(out *VMDiskImageDisk) {
+	*out = *in
+	in.VMDiskSpec.DeepCopyInto(&out.VMDiskSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageDisk.
+func (in *VMDiskImageDisk) DeepCopy() *VMDiskImageDisk {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageDisk)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageDiskStatus) DeepCopyInto(out *VMDiskImageDiskStatus) {
+	*out = *in
+	if in.Checksum != nil {
+		in, out := &in.Checksum, &out.Checksum
+		*out = new(VMDiskImageChecksumStatus)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageDiskStatus.
+func (in *VMDiskImageDiskStatus) DeepCopy() *VMDiskImageDiskStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageDiskStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageIdentity) DeepCopyInto(out *VMDiskImageIdentity) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageIdentity.
+func (in *VMDiskImageIdentity) DeepCopy() *VMDiskImageIdentity {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageIdentity)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VMDiskImageList) DeepCopyInto(out *VMDiskImageList) {
 	*out = *in
@@ -85,23 +298,174 @@ func (in *VMDiskImageList) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *VMDiskImageSpec) DeepCopyInto(out *VMDiskImageSpec) {
+func (in *VMDiskImagePlacement) DeepCopyInto(out *VMDiskImagePlacement) {
 	*out = *in
-	if in.StorageClass != nil {
-		in, out := &in.StorageClass, &out.StorageClass
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]v1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(v1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImagePlacement.
+func (in *VMDiskImagePlacement) DeepCopy() *VMDiskImagePlacement {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImagePlacement)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageRegistrySource) DeepCopyInto(out *VMDiskImageRegistrySource) {
+	*out = *in
+	if in.ImageStream != nil {
+		in, out := &in.ImageStream, &out.ImageStream
 		*out = new(string)
 		**out = **in
 	}
-	if in.CertConfigMap != nil {
-		in, out := &in.CertConfigMap, &out.CertConfigMap
-		*out = new(string)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageRegistrySource.
+func (in *VMDiskImageRegistrySource) DeepCopy() *VMDiskImageRegistrySource {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageRegistrySource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageSnapshotTemplate) DeepCopyInto(out *VMDiskImageSnapshotTemplate) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageSnapshotTemplate.
+func (in *VMDiskImageSnapshotTemplate) DeepCopy() *VMDiskImageSnapshotTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageSnapshotTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageSourceRef) DeepCopyInto(out *VMDiskImageSourceRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageSourceRef.
+func (in *VMDiskImageSourceRef) DeepCopy() *VMDiskImageSourceRef {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageSourceRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageSourceStatus) DeepCopyInto(out *VMDiskImageSourceStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageSourceStatus.
+func (in *VMDiskImageSourceStatus) DeepCopy() *VMDiskImageSourceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskImageSourceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskImageSpec) DeepCopyInto(out *VMDiskImageSpec) {
+	*out = *in
+	if in.Image != nil {
+		in, out := &in.Image, &out.Image
+		*out = new(VMDiskImageIdentity)
 		**out = **in
 	}
-	if in.SnapshotClass != nil {
-		in, out := &in.SnapshotClass, &out.SnapshotClass
+	in.VMDiskSpec.DeepCopyInto(&out.VMDiskSpec)
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]VMDiskImageDisk, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.VolumeGroupSnapshotClass != nil {
+		in, out := &in.VolumeGroupSnapshotClass, &out.VolumeGroupSnapshotClass
 		*out = new(string)
 		**out = **in
 	}
+	if in.TargetNamespaces != nil {
+		in, out := &in.TargetNamespaces, &out.TargetNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.TargetNamespaceSelector != nil {
+		in, out := &in.TargetNamespaceSelector, &out.TargetNamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataSource != nil {
+		in, out := &in.DataSource, &out.DataSource
+		*out = new(VMDiskImageDataSource)
+		**out = **in
+	}
+	if in.ImporterPlacement != nil {
+		in, out := &in.ImporterPlacement, &out.ImporterPlacement
+		*out = new(VMDiskImagePlacement)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Debug != nil {
+		in, out := &in.Debug, &out.Debug
+		*out = new(VMDiskImageDebug)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataVolumeTemplate != nil {
+		in, out := &in.DataVolumeTemplate, &out.DataVolumeTemplate
+		*out = new(VMDiskImageDataVolumeTemplate)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SnapshotTemplate != nil {
+		in, out := &in.SnapshotTemplate, &out.SnapshotTemplate
+		*out = new(VMDiskImageSnapshotTemplate)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageSpec.
@@ -119,7 +483,7 @@ func (in *VMDiskImageStatus) DeepCopyInto(out *VMDiskImageStatus) {
 	*out = *in
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
-		*out = make([]v1.Condition, len(*in))
+		*out = make([]metav1.Condition, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -128,6 +492,33 @@ func (in *VMDiskImageStatus) DeepCopyInto(out *VMDiskImageStatus) {
 		in, out := &in.LastFailureTime, &out.LastFailureTime
 		*out = (*in).DeepCopy()
 	}
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]VMDiskImageDiskStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Copies != nil {
+		in, out := &in.Copies, &out.Copies
+		*out = make([]VMDiskImageCopyStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.DataSources != nil {
+		in, out := &in.DataSources, &out.DataSources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Sources != nil {
+		in, out := &in.Sources, &out.Sources
+		*out = make([]VMDiskImageSourceStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Consumers != nil {
+		in, out := &in.Consumers, &out.Consumers
+		*out = make([]VMDiskImageConsumer, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskImageStatus.
@@ -139,3 +530,241 @@ func (in *VMDiskImageStatus) DeepCopy() *VMDiskImageStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMDiskSpec) DeepCopyInto(out *VMDiskSpec) {
+	*out = *in
+	if in.SourceRef != nil {
+		in, out := &in.SourceRef, &out.SourceRef
+		*out = new(VMDiskImageSourceRef)
+		**out = **in
+	}
+	if in.StorageClass != nil {
+		in, out := &in.StorageClass, &out.StorageClass
+		*out = new(string)
+		**out = **in
+	}
+	if in.VolumeMode != nil {
+		in, out := &in.VolumeMode, &out.VolumeMode
+		*out = new(v1.PersistentVolumeMode)
+		**out = **in
+	}
+	if in.AccessModes != nil {
+		in, out := &in.AccessModes, &out.AccessModes
+		*out = make([]v1.PersistentVolumeAccessMode, len(*in))
+		copy(*out, *in)
+	}
+	if in.StorageAPI != nil {
+		in, out := &in.StorageAPI, &out.StorageAPI
+		*out = new(bool)
+		**out = **in
+	}
+	if in.CertConfigMap != nil {
+		in, out := &in.CertConfigMap, &out.CertConfigMap
+		*out = new(string)
+		**out = **in
+	}
+	if in.Registry != nil {
+		in, out := &in.Registry, &out.Registry
+		*out = new(VMDiskImageRegistrySource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SnapshotClass != nil {
+		in, out := &in.SnapshotClass, &out.SnapshotClass
+		*out = new(string)
+		**out = **in
+	}
+	if in.ExtraHeaders != nil {
+		in, out := &in.ExtraHeaders, &out.ExtraHeaders
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SecretExtraHeaders != nil {
+		in, out := &in.SecretExtraHeaders, &out.SecretExtraHeaders
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Checksum != nil {
+		in, out := &in.Checksum, &out.Checksum
+		*out = new(VMDiskImageChecksum)
+		**out = **in
+	}
+	if in.Adopt != nil {
+		in, out := &in.Adopt, &out.Adopt
+		*out = new(VMDiskImageAdoption)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMDiskSpec.
+func (in *VMDiskSpec) DeepCopy() *VMDiskSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VMDiskSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSet) DeepCopyInto(out *WorkspaceImageSet) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSet.
+func (in *WorkspaceImageSet) DeepCopy() *WorkspaceImageSet {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *WorkspaceImageSet) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSetList) DeepCopyInto(out *WorkspaceImageSetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]WorkspaceImageSet, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSetList.
+func (in *WorkspaceImageSetList) DeepCopy() *WorkspaceImageSetList {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *WorkspaceImageSetList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSetMember) DeepCopyInto(out *WorkspaceImageSetMember) {
+	*out = *in
+	if in.Template != nil {
+		in, out := &in.Template, &out.Template
+		*out = new(VMDiskImageSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VMDiskImageRef != nil {
+		in, out := &in.VMDiskImageRef, &out.VMDiskImageRef
+		*out = new(WorkspaceImageSetMemberRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSetMember.
+func (in *WorkspaceImageSetMember) DeepCopy() *WorkspaceImageSetMember {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSetMember)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSetMemberRef) DeepCopyInto(out *WorkspaceImageSetMemberRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSetMemberRef.
+func (in *WorkspaceImageSetMemberRef) DeepCopy() *WorkspaceImageSetMemberRef {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSetMemberRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSetMemberStatus) DeepCopyInto(out *WorkspaceImageSetMemberStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSetMemberStatus.
+func (in *WorkspaceImageSetMemberStatus) DeepCopy() *WorkspaceImageSetMemberStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSetMemberStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSetSpec) DeepCopyInto(out *WorkspaceImageSetSpec) {
+	*out = *in
+	if in.Members != nil {
+		in, out := &in.Members, &out.Members
+		*out = make([]WorkspaceImageSetMember, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSetSpec.
+func (in *WorkspaceImageSetSpec) DeepCopy() *WorkspaceImageSetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceImageSetStatus) DeepCopyInto(out *WorkspaceImageSetStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Members != nil {
+		in, out := &in.Members, &out.Members
+		*out = make([]WorkspaceImageSetMemberStatus, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceImageSetStatus.
+func (in *WorkspaceImageSetStatus) DeepCopy() *WorkspaceImageSetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceImageSetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
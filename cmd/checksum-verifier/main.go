@@ -0,0 +1,66 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The checksum verifier runs in the checksum jobs of VMDiskImages. It
+// downloads the source artifact of a disk and writes its digest to the
+// termination log, where the operator reads it from. It exits non-zero when
+// the artifact cannot be hashed so the job fails instead of reporting an
+// empty digest.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	coreconfig "pelotech/data-sync-operator/internal/core/config"
+	vmdi "pelotech/data-sync-operator/internal/vm-disk-image/service"
+)
+
+const terminationLog = "/dev/termination-log"
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	digest, err := hashSource(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		_ = os.WriteFile(terminationLog, []byte(err.Error()), 0o644)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(terminationLog, []byte(digest), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to write the digest:", err)
+		os.Exit(1)
+	}
+	fmt.Println(digest)
+}
+
+func hashSource(ctx context.Context) (string, error) {
+	request, err := vmdi.SourceRequestFromEnv()
+	if err != nil {
+		return "", err
+	}
+
+	algorithm := coreconfig.GetStringEnvOrDefault(vmdi.ChecksumAlgorithmEnv, "")
+
+	// Large artifacts take as long to download as they need. A sync attempt
+	// that lasts too long is torn down along with its job.
+	return vmdi.HTTPSourceProbe{Timeout: -1}.Hash(ctx, request, algorithm)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The disk importer runs in the import jobs of VMDiskImages with a bandwidth
+// limit or an importer placement. It downloads the source artifact of a disk
+// no faster than the limit, if there is one, and streams it to the disk's
+// DataVolume through CDI's upload proxy, which converts and resizes it like
+// CDI's own importer would. It exits non-zero when the upload fails and
+// leaves the reason in the termination log.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	coreconfig "pelotech/data-sync-operator/internal/core/config"
+	vmdi "pelotech/data-sync-operator/internal/vm-disk-image/service"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const terminationLog = "/dev/termination-log"
+
+// The endpoint of the upload proxy that returns once the upload is processed.
+const uploadPath = "/v1beta1/upload"
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := importSource(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		_ = os.WriteFile(terminationLog, []byte(err.Error()), 0o644)
+		os.Exit(1)
+	}
+	fmt.Println("uploaded the source artifact")
+}
+
+func importSource(ctx context.Context) error {
+	request, err := vmdi.SourceRequestFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// Large artifacts take as long to download as they need. A sync attempt
+	// that lasts too long is torn down along with its job.
+	body, err := vmdi.HTTPSourceProbe{Timeout: -1}.Open(ctx, request)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+
+	// Jobs that only place the download are not limited
+	var artifact io.Reader = body
+	if limit := coreconfig.GetStringEnvOrDefault(vmdi.ImportBandwidthLimitEnv, ""); limit != "" {
+		bitsPerSecond, err := resource.ParseQuantity(limit)
+		if err != nil || bitsPerSecond.Sign() <= 0 {
+			return fmt.Errorf("invalid bandwidth limit %q", limit)
+		}
+		artifact = &throttledReader{
+			ctx:            ctx,
+			reader:         body,
+			bytesPerSecond: bitsPerSecond.AsApproximateFloat64() / 8,
+			start:          time.Now(),
+		}
+	}
+
+	return upload(ctx, artifact, body.ContentLength)
+}
+
+// Stream the artifact to the upload proxy. The token is read last since it
+// is only valid for a few minutes and the operator keeps replacing it.
+func upload(ctx context.Context, artifact io.Reader, contentLength int64) error {
+	token, err := os.ReadFile(filepath.Join(vmdi.ImportUploadDir, vmdi.ImportUploadTokenKey))
+	if err != nil {
+		return fmt.Errorf("failed to read the upload token: %w", err)
+	}
+	caBundle, err := os.ReadFile(filepath.Join(vmdi.ImportUploadDir, vmdi.ImportUploadCAKey))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read the CA bundle of the upload proxy: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caBundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return errors.New("the CA bundle of the upload proxy does not hold any PEM encoded certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	proxyURL := strings.TrimSuffix(coreconfig.GetStringEnvOrDefault(vmdi.ImportUploadProxyURLEnv, ""), "/") + uploadPath
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyURL, artifact)
+	if err != nil {
+		return err
+	}
+	if contentLength >= 0 {
+		request.ContentLength = contentLength
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s: %w", proxyURL, err)
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("the upload proxy returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// Reads no faster than the given rate on average since it started.
+type throttledReader struct {
+	ctx            context.Context
+	reader         io.Reader
+	bytesPerSecond float64
+	start          time.Time
+	read           int64
+}
+
+func (r *throttledReader) Read(buffer []byte) (int, error) {
+	// Small reads keep the rate smooth at low limits
+	maxRead := max(int(r.bytesPerSecond/10), 1)
+	if len(buffer) > maxRead {
+		buffer = buffer[:maxRead]
+	}
+
+	n, err := r.reader.Read(buffer)
+	r.read += int64(n)
+
+	due := r.start.Add(time.Duration(float64(r.read) / r.bytesPerSecond * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+
+	return n, err
+}
@@ -25,11 +25,13 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -39,9 +41,12 @@ import (
 	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
 	coreconfig "pelotech/data-sync-operator/internal/core/config"
 	vmdiskimagectrl "pelotech/data-sync-operator/internal/vm-disk-image/controller"
+	workspaceimagesetctrl "pelotech/data-sync-operator/internal/workspace-image-set/controller"
 
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
 	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -57,7 +62,9 @@ func init() {
 
 	// Add the resources related to the volume and volumesnapshot we use for the vmdiskimage resource workflow
 	utilruntime.Must(cdiv1beta1.AddToScheme(scheme))
+	utilruntime.Must(uploadv1beta1.AddToScheme(scheme))
 	utilruntime.Must(snapshotv1.AddToScheme(scheme))
+	utilruntime.Must(groupsnapshotv1beta2.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -170,6 +177,14 @@ func main() {
 		HealthProbeBindAddress: coreCfg.ProbeAddr,
 		LeaderElection:         coreCfg.EnableLeaderElection,
 		LeaderElectionID:       "1f5c5280.pelotech.ot",
+		// Secrets and ConfigMaps are read straight from the API server so the
+		// contents of every one in the cluster are not cached. Their changes
+		// are watched through their metadata only.
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				DisableFor: []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}},
+			},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -193,6 +208,12 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "VMDiskImage")
 		os.Exit(1)
 	}
+	if err := (&workspaceimagesetctrl.WorkspaceImageSetReconciler{
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "WorkspaceImageSet")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
 	if metricsCertWatcher != nil {
@@ -1,8 +1,16 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
 	corecfg "pelotech/data-sync-operator/internal/core/config"
+	"slices"
+	"strings"
 	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
@@ -11,6 +19,19 @@ const (
 	defaultMaxSyncDuration        = 12 * time.Hour
 	defaultMaxSyncAttemptRetries  = 3
 	defaultMaxSyncAttemptDuration = 1 * time.Hour
+	defaultOrphanSweepInterval    = 10 * time.Minute
+	defaultOrphanGracePeriod      = 1 * time.Hour
+	defaultDeletionPolicy         = crdv1.DeletionPolicyDelete
+	defaultDiskSizeOverhead       = 10
+	defaultRetainedDiagnostics    = 3
+	defaultDiagnosticsMaxBytes    = 256 * 1024
+	defaultUsageRefreshInterval   = 5 * time.Minute
+	defaultVersionPruneInterval   = 10 * time.Minute
+	defaultUploadProxyURL         = "https://cdi-uploadproxy.cdi.svc"
+	defaultUploadProxyCABundle    = "cdi/cdi-uploadproxy-signer-bundle"
+	// GitOps tools track what they manage through these labels and would
+	// prune child resources that carry them.
+	defaultExcludedLabels = "app.kubernetes.io/instance,argocd.argoproj.io/*,kustomize.toolkit.fluxcd.io/*,helm.toolkit.fluxcd.io/*"
 )
 
 type VMDiskImageControllerConfig struct {
@@ -19,6 +40,31 @@ type VMDiskImageControllerConfig struct {
 	MaxSyncDuration        time.Duration
 	MaxSyncAttemptDuration time.Duration
 	MaxSyncAttemptRetries  int
+	ChecksumVerifierImage  string
+	PodName                string
+	PodNamespace           string
+	OrphanSweepInterval    time.Duration
+	OrphanGracePeriod      time.Duration
+	OrphanSweepDryRun      bool
+	DefaultDeletionPolicy  string
+	URLTemplates           map[string]string
+	SourceProbing          bool
+	SourceFormatSniffing   bool
+	DiskSizeOverhead       int
+	StorageAPI             bool
+	PropagatedLabels       []string
+	ExcludedLabels         []string
+	RetainedDiagnostics    int
+	DiagnosticsMaxBytes    int
+	UsageRefreshInterval   time.Duration
+	RetainedImageVersions  int
+	VersionPruneInterval   time.Duration
+	VersionPruneDryRun     bool
+	DefaultBandwidthLimit  *resource.Quantity
+	BandwidthBudget        *resource.Quantity
+	UploadProxyURL         string
+	UploadProxyCABundle    types.NamespacedName
+	ImporterPlacement      *crdv1.VMDiskImagePlacement
 }
 
 // This function will allow us to get the required config variables from the environment.
@@ -39,11 +85,172 @@ func LoadVMDIControllerConfigFromEnv() VMDiskImageControllerConfig {
 	// How many times we will retry on a given attempt.
 	maxSyncAttemptRetries := corecfg.GetIntEnvOrDefault("MAX_SYNC_ATTEMPT_RETRIES", defaultMaxSyncAttemptRetries)
 
+	// The image checksum and import jobs run /checksum-verifier and /disk-importer from. Defaults to
+	// the image of the operator's own pod.
+	checksumVerifierImage := corecfg.GetStringEnvOrDefault("CHECKSUM_VERIFIER_IMAGE", "")
+
+	// The pod the operator runs in, set through the downward API to find its image.
+	podName := corecfg.GetStringEnvOrDefault("POD_NAME", "")
+	podNamespace := corecfg.GetStringEnvOrDefault("POD_NAMESPACE", "")
+
+	// How often we look for child resources whose VMDiskImage is gone. 0 disables the sweeper.
+	orphanSweepInterval := corecfg.GetDurationEnvOrDefault("ORPHAN_SWEEP_INTERVAL", defaultOrphanSweepInterval)
+
+	// How long a child resource has to stay orphaned before we delete it.
+	orphanGracePeriod := corecfg.GetDurationEnvOrDefault("ORPHAN_GRACE_PERIOD", defaultOrphanGracePeriod)
+
+	// Only report orphaned child resources instead of deleting them.
+	orphanSweepDryRun := corecfg.GetBoolEnvOrDefault("ORPHAN_SWEEP_DRY_RUN", false)
+
+	// What happens to the child resources of VMDiskImages that do not set a deletion policy.
+	// One of Delete, Retain or Orphan.
+	deletionPolicy := corecfg.GetStringEnvOrDefault("DEFAULT_DELETION_POLICY", defaultDeletionPolicy)
+	deletionPolicies := []string{crdv1.DeletionPolicyDelete, crdv1.DeletionPolicyRetain, crdv1.DeletionPolicyOrphan}
+	if !slices.Contains(deletionPolicies, deletionPolicy) {
+		panic(fmt.Sprintf("invalid deletion policy for environment variable DEFAULT_DELETION_POLICY='%s': must be one of %s", deletionPolicy, strings.Join(deletionPolicies, ", ")))
+	}
+
+	// The urls of disks that do not set one, keyed by source type. {{name}}, {{version}}
+	// and {{disk}} are replaced with the image name, image version and disk name.
+	urlTemplates := map[string]string{}
+	for sourceType, env := range map[string]string{
+		"s3":       "S3_URL_TEMPLATE",
+		"http":     "HTTP_URL_TEMPLATE",
+		"registry": "REGISTRY_URL_TEMPLATE",
+	} {
+		if template := corecfg.GetStringEnvOrDefault(env, ""); template != "" {
+			urlTemplates[sourceType] = template
+		}
+	}
+
+	// Check that S3 and HTTP artifacts exist before importing them. Without it
+	// their disks fail unless they set a diskSize.
+	sourceProbing := corecfg.GetBoolEnvOrDefault("SOURCE_PROBING", true)
+
+	// Read the first bytes of S3 and HTTP artifacts to record their format and compression.
+	sourceFormatSniffing := corecfg.GetBoolEnvOrDefault("SOURCE_FORMAT_SNIFFING", true)
+
+	// How many percent larger than their source disks without a diskSize are made, to leave
+	// room for filesystem overhead.
+	diskSizeOverhead := corecfg.GetIntEnvOrDefault("DISK_SIZE_OVERHEAD_PERCENT", defaultDiskSizeOverhead)
+
+	// Create DataVolumes with spec.storage so CDI StorageProfiles fill in the access and
+	// volume modes disks do not set.
+	storageAPI := corecfg.GetBoolEnvOrDefault("DATAVOLUME_STORAGE_API", false)
+
+	// Comma separated patterns of the VMDiskImage labels copied to child resources. All are
+	// copied when empty.
+	propagatedLabels := splitList(corecfg.GetStringEnvOrDefault("PROPAGATED_LABELS", ""))
+
+	// Comma separated patterns of the VMDiskImage labels never copied to child resources.
+	excludedLabels := splitList(corecfg.GetStringEnvOrDefault("EXCLUDED_LABELS", defaultExcludedLabels))
+
+	// How many failure diagnostics ConfigMaps we keep per VMDiskImage. 0 disables collecting them.
+	retainedDiagnostics := corecfg.GetIntEnvOrDefault("RETAINED_FAILURE_DIAGNOSTICS", defaultRetainedDiagnostics)
+
+	// How large a failure diagnostics ConfigMap may get before its logs are truncated.
+	diagnosticsMaxBytes := corecfg.GetIntEnvOrDefault("FAILURE_DIAGNOSTICS_MAX_BYTES", defaultDiagnosticsMaxBytes)
+	// How often we look for the PVCs, DataVolumes and VirtualMachines restored or cloned from
+	// Ready VMDiskImages. 0 disables usage tracking and lets in-use VMDiskImages be deleted.
+	usageRefreshInterval := corecfg.GetDurationEnvOrDefault("USAGE_REFRESH_INTERVAL", defaultUsageRefreshInterval)
+	// How many of the latest Ready versions of each image name we keep per namespace. Older
+	// VMDiskImages are deleted unless they are pinned or in use. 0 disables pruning.
+	retainedImageVersions := corecfg.GetIntEnvOrDefault("RETAINED_IMAGE_VERSIONS", 0)
+	// How often we look for old image versions to prune.
+	versionPruneInterval := corecfg.GetDurationEnvOrDefault("VERSION_PRUNE_INTERVAL", defaultVersionPruneInterval)
+	// Only report the old image versions instead of deleting them.
+	versionPruneDryRun := corecfg.GetBoolEnvOrDefault("VERSION_PRUNE_DRY_RUN", false)
+
+	// The download bandwidth of VMDiskImages that do not set one, in bits per second. Unlimited
+	// when empty.
+	defaultBandwidthLimit := getQuantityEnv("DEFAULT_BANDWIDTH_LIMIT")
+
+	// The download bandwidth shared by all syncs, in bits per second. Unlimited when empty.
+	bandwidthBudget := getQuantityEnv("BANDWIDTH_BUDGET")
+
+	// Where the import jobs of limited disks upload them to. The in-cluster service of CDI's
+	// upload proxy by default.
+	uploadProxyURL := corecfg.GetStringEnvOrDefault("UPLOAD_PROXY_URL", defaultUploadProxyURL)
+
+	// The namespace/name of the ConfigMap whose ca-bundle.crt verifies the upload proxy.
+	uploadProxyCABundleValue := corecfg.GetStringEnvOrDefault("UPLOAD_PROXY_CA_BUNDLE", defaultUploadProxyCABundle)
+	caBundleNamespace, caBundleName, found := strings.Cut(uploadProxyCABundleValue, "/")
+	if !found || caBundleNamespace == "" || caBundleName == "" {
+		panic(fmt.Sprintf("invalid ConfigMap for environment variable UPLOAD_PROXY_CA_BUNDLE='%s': must be namespace/name", uploadProxyCABundleValue))
+	}
+	uploadProxyCABundle := types.NamespacedName{Namespace: caBundleNamespace, Name: caBundleName}
+
+	// Where the import and checksum jobs of VMDiskImages that do not set an importer placement
+	// run, as JSON with nodeSelector, tolerations and affinity. Left to the scheduler when empty.
+	var importerPlacement *crdv1.VMDiskImagePlacement
+	if value := corecfg.GetStringEnvOrDefault("DEFAULT_IMPORTER_PLACEMENT", ""); value != "" {
+		importerPlacement = &crdv1.VMDiskImagePlacement{}
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(importerPlacement); err != nil {
+			panic(fmt.Sprintf("invalid placement for environment variable DEFAULT_IMPORTER_PLACEMENT='%s': %v", value, err))
+		}
+	}
+
 	return VMDiskImageControllerConfig{
 		Concurrency:            concurrency,
 		MaxBackoffDelay:        maxBackoffDelay,
 		MaxSyncAttemptDuration: maxAttemptDuration,
 		MaxSyncAttemptRetries:  maxSyncAttemptRetries,
 		MaxSyncDuration:        maxSyncDuration,
+		ChecksumVerifierImage:  checksumVerifierImage,
+		PodName:                podName,
+		PodNamespace:           podNamespace,
+		OrphanSweepInterval:    orphanSweepInterval,
+		OrphanGracePeriod:      orphanGracePeriod,
+		OrphanSweepDryRun:      orphanSweepDryRun,
+		DefaultDeletionPolicy:  deletionPolicy,
+		URLTemplates:           urlTemplates,
+		SourceProbing:          sourceProbing,
+		SourceFormatSniffing:   sourceFormatSniffing,
+		DiskSizeOverhead:       diskSizeOverhead,
+		StorageAPI:             storageAPI,
+		PropagatedLabels:       propagatedLabels,
+		ExcludedLabels:         excludedLabels,
+		RetainedDiagnostics:    retainedDiagnostics,
+		DiagnosticsMaxBytes:    diagnosticsMaxBytes,
+		UsageRefreshInterval:   usageRefreshInterval,
+		RetainedImageVersions:  retainedImageVersions,
+		VersionPruneInterval:   versionPruneInterval,
+		VersionPruneDryRun:     versionPruneDryRun,
+		DefaultBandwidthLimit:  defaultBandwidthLimit,
+		BandwidthBudget:        bandwidthBudget,
+		UploadProxyURL:         uploadProxyURL,
+		UploadProxyCABundle:    uploadProxyCABundle,
+		ImporterPlacement:      importerPlacement,
+	}
+}
+
+// Bit rates like "500M". Empty or zero means unlimited.
+func getQuantityEnv(name string) *resource.Quantity {
+	value := corecfg.GetStringEnvOrDefault(name, "")
+	if value == "" {
+		return nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() < 0 {
+		panic(fmt.Sprintf("invalid bandwidth for environment variable %s='%s': must be a positive quantity like 500M", name, value))
 	}
+	if quantity.IsZero() {
+		return nil
+	}
+
+	return &quantity
+}
+
+func splitList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
@@ -18,16 +18,30 @@ limitations under the License.
 
 import (
 	"context"
+	"fmt"
 	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+	"slices"
+	"time"
 
 	vmdiconfig "pelotech/data-sync-operator/internal/vm-disk-image/config"
 	vmdi "pelotech/data-sync-operator/internal/vm-disk-image/service"
 
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
 	crutils "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 // VMDiskImageReconciler reconciles a VMDiskImage object
@@ -44,7 +58,40 @@ type VMDiskImageReconciler struct {
 // RBAC to preform CRUD operations on pvcs, datavolumes and volumesnapshots
 // +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete;deletecollection
 // +kubebuilder:rbac:groups=cdi.kubevirt.io,resources=datavolumes,verbs=get;list;watch;create;update;patch;delete;deletecollection
+// +kubebuilder:rbac:groups=cdi.kubevirt.io,resources=datasources,verbs=get;list;watch;create;update;patch;delete;deletecollection
 // +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;update;patch;delete;deletecollection
+// +kubebuilder:rbac:groups=groupsnapshot.storage.k8s.io,resources=volumegroupsnapshots,verbs=get;list;watch;create;update;patch;delete;deletecollection
+
+// Cloning across namespaces needs datavolumes/source in the source namespace,
+// which grants it by binding config/rbac/clone_source_role.yaml to us
+
+// RBAC to read the credentials and CA bundles of image sources
+// +kubebuilder:rbac:groups="",resources=secrets;configmaps,verbs=get;list;watch
+
+// RBAC to keep the importer logs and Events of failed syncs
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+// +kubebuilder:rbac:groups="",resources=events,verbs=list
+
+// RBAC for the import jobs to upload the disks they download through CDI's upload proxy
+// +kubebuilder:rbac:groups=upload.cdi.kubevirt.io,resources=uploadtokenrequests,verbs=create
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=create;update;patch
+
+// RBAC to move the volumes of failed syncs to new claims for debugging
+// +kubebuilder:rbac:groups="",resources=persistentvolumes,verbs=patch;update
+
+// RBAC to find the resources restored or cloned from a VMDiskImage
+// +kubebuilder:rbac:groups=kubevirt.io,resources=virtualmachines,verbs=get;list;watch
+
+// RBAC to verify the checksum of source artifacts
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete;deletecollection
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// RBAC to copy snapshots into the target namespaces of a VMDiskImage
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=persistentvolumes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshotcontents,verbs=get;list;watch;create;update;patch;delete;deletecollection
+// +kubebuilder:rbac:groups=groupsnapshot.storage.k8s.io,resources=volumegroupsnapshotcontents,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -91,7 +138,9 @@ func (r *VMDiskImageReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return r.TransitonFromSyncing(ctx, &VMDiskImage)
 	case crdv1.PhaseRetryableFailure:
 		return r.AttemptRetry(ctx, &VMDiskImage)
-	case crdv1.PhaseReady, crdv1.PhaseFailed:
+	case crdv1.PhaseReady:
+		return r.ReconcileReadyResource(ctx, &VMDiskImage)
+	case crdv1.PhaseFailed:
 		return ctrl.Result{}, nil
 	default:
 		logger.Error(nil, "Unknown phase detected", "Phase", currentPhase)
@@ -108,20 +157,82 @@ func (r *VMDiskImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
 	client := mgr.GetClient()
 
-	resourceGenerator := &vmdi.Generator{}
+	// Multi-disk VMDiskImages are snapshotted as a group when the cluster supports it
+	_, err := mgr.GetRESTMapper().RESTMapping(
+		groupsnapshotv1beta2.SchemeGroupVersion.WithKind("VolumeGroupSnapshot").GroupKind(),
+		groupsnapshotv1beta2.SchemeGroupVersion.Version,
+	)
+	volumeGroupSnapshotsAvailable := err == nil
+	logger.Info("Checked for VolumeGroupSnapshot support", "available", volumeGroupSnapshotsAvailable)
+
+	// VirtualMachines are only looked at for consumers on clusters running KubeVirt
+	_, err = mgr.GetRESTMapper().RESTMapping(vmdi.VirtualMachineGVK.GroupKind(), vmdi.VirtualMachineGVK.Version)
+	virtualMachinesAvailable := err == nil
+	logger.Info("Checked for KubeVirt VirtualMachine support", "available", virtualMachinesAvailable)
+
+	// Checksum and import jobs run the binaries shipped in the operator's image
+	checksumVerifierImage := config.ChecksumVerifierImage
+	if checksumVerifierImage == "" {
+		checksumVerifierImage, err = operatorImage(context.TODO(), mgr.GetAPIReader(), config.PodNamespace, config.PodName)
+		if err != nil {
+			logger.Error(err, "Cannot find the operator image. Checksums cannot be verified and bandwidth limited disks cannot be imported without CHECKSUM_VERIFIER_IMAGE.")
+		}
+	}
+
+	resourceGenerator := &vmdi.Generator{
+		VolumeGroupSnapshotsAvailable: volumeGroupSnapshotsAvailable,
+		ChecksumVerifierImage:         checksumVerifierImage,
+		DiskImporterImage:             checksumVerifierImage,
+		UploadProxyURL:                config.UploadProxyURL,
+		DefaultImporterPlacement:      config.ImporterPlacement,
+		URLTemplates:                  config.URLTemplates,
+		StorageAPI:                    config.StorageAPI,
+		LabelFilter: vmdi.LabelFilter{
+			Include: config.PropagatedLabels,
+			Exclude: config.ExcludedLabels,
+		},
+	}
+	legacyLabelMigrator := &vmdi.LegacyLabelMigrator{
+		Client:                        client,
+		VolumeGroupSnapshotsAvailable: volumeGroupSnapshotsAvailable,
+	}
 	vmdiProvisioner := vmdi.K8sVMDIProvisioner{
-		Client:                 client,
-		ResourceGenerator:      resourceGenerator,
-		MaxSyncAttemptDuration: config.MaxSyncAttemptDuration,
-		MaxSyncAttemptRetries:  config.MaxSyncAttemptRetries,
+		Client:                     client,
+		ResourceGenerator:          resourceGenerator,
+		RegistryClient:             vmdi.HTTPRegistryClient{},
+		SniffSourceFormat:          config.SourceFormatSniffing,
+		DiskSizeOverheadPercent:    config.DiskSizeOverhead,
+		RetainedFailureDiagnostics: config.RetainedDiagnostics,
+		FailureDiagnosticsMaxBytes: config.DiagnosticsMaxBytes,
+		MaxSyncAttemptDuration:     config.MaxSyncAttemptDuration,
+		MaxSyncAttemptRetries:      config.MaxSyncAttemptRetries,
+		VirtualMachinesAvailable:   virtualMachinesAvailable,
+		ChecksumVerification:       checksumVerifierImage != "",
+		ImportJobs:                 checksumVerifierImage != "",
+		UploadTokens:               vmdi.CDIUploadTokenIssuer{Client: client},
+		UploadProxyCABundle:        config.UploadProxyCABundle,
+		LegacyLabelMigrator:        legacyLabelMigrator,
+	}
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		logger.Error(err, "Failed to create the clientset")
+		return err
+	}
+	vmdiProvisioner.Diagnostics = vmdi.ClientsetDiagnosticsReader{Interface: clientset}
+	if config.SourceProbing {
+		vmdiProvisioner.SourceProbe = vmdi.HTTPSourceProbe{}
 	}
 	orchestrator := vmdi.Orchestrator{
-		Client:              client,
-		Recorder:            mgr.GetEventRecorderFor(crdv1.VMDiskImageControllerName),
-		Provisioner:         vmdiProvisioner,
-		MaxRetryBackoff:     config.MaxBackoffDelay,
-		MaxSyncTime:         config.MaxSyncDuration,
-		ConcurrentSyncLimit: config.Concurrency,
+		Client:                client,
+		Recorder:              mgr.GetEventRecorderFor(crdv1.VMDiskImageControllerName),
+		Provisioner:           vmdiProvisioner,
+		MaxRetryBackoff:       config.MaxBackoffDelay,
+		MaxSyncTime:           config.MaxSyncDuration,
+		ConcurrentSyncLimit:   config.Concurrency,
+		DefaultDeletionPolicy: config.DefaultDeletionPolicy,
+		UsageRefreshInterval:  config.UsageRefreshInterval,
+		DefaultBandwidthLimit: config.DefaultBandwidthLimit,
+		BandwidthBudget:       config.BandwidthBudget,
 	}
 	reconciler := &VMDiskImageReconciler{
 		Scheme:                  mgr.GetScheme(),
@@ -129,7 +240,7 @@ func (r *VMDiskImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}
 
 	// Index resources by phase since we have to query these quite a bit
-	err := mgr.GetFieldIndexer().
+	err = mgr.GetFieldIndexer().
 		IndexField(
 			context.TODO(),
 			&crdv1.VMDiskImage{},
@@ -141,10 +252,167 @@ func (r *VMDiskImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	// Namespaces can start or stop matching a VMDiskImage's target namespaces
+	// at any time so they are watched to keep the snapshot copies in sync.
+	enqueueTargetingVMDiskImages := func(ctx context.Context, namespace crclient.Object) []reconcile.Request {
+		vmdiList := &crdv1.VMDiskImageList{}
+		if err := client.List(ctx, vmdiList); err != nil {
+			logger.Error(err, "Failed to list VMDiskImages for a namespace change")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for _, vmdi := range vmdiList.Items {
+			isListed := slices.Contains(vmdi.Spec.TargetNamespaces, namespace.GetName())
+			if isListed || vmdi.Spec.TargetNamespaceSelector != nil {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+					Namespace: vmdi.Namespace,
+					Name:      vmdi.Name,
+				}})
+			}
+		}
+
+		return requests
+	}
+
+	// A deleted DataSource is published again by the Ready VMDiskImages left
+	// in its namespace.
+	enqueueReadyVMDiskImages := func(ctx context.Context, dataSource crclient.Object) []reconcile.Request {
+		readyList, err := orchestrator.ListVMDiskImagesByPhase(ctx, crdv1.PhaseReady)
+		if err != nil {
+			logger.Error(err, "Failed to list Ready VMDiskImages for a deleted datasource")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for _, vmdi := range readyList.Items {
+			if vmdi.Namespace == dataSource.GetNamespace() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+					Namespace: vmdi.Namespace,
+					Name:      vmdi.Name,
+				}})
+			}
+		}
+
+		return requests
+	}
+	// Fixing a Secret or ConfigMap a queued VMDiskImage failed its preflight
+	// checks on lets it try again right away. Only their metadata is watched
+	// so their contents are not cached cluster-wide.
+	enqueueReferencingVMDiskImages := func(kind string) handler.MapFunc {
+		return func(ctx context.Context, obj crclient.Object) []reconcile.Request {
+			queuedList, err := orchestrator.ListVMDiskImagesByPhase(ctx, crdv1.PhaseQueued)
+			if err != nil {
+				logger.Error(err, "Failed to list queued VMDiskImages for a source credential change")
+				return nil
+			}
+
+			var requests []reconcile.Request
+			for _, queued := range queuedList.Items {
+				if vmdi.ReferencesObject(&queued, kind, obj) {
+					requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+						Namespace: queued.Namespace,
+						Name:      queued.Name,
+					}})
+				}
+			}
+
+			return requests
+		}
+	}
+	onlyDeletes := predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		UpdateFunc:  func(event.UpdateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+
+	// Child resources created before the name and UID labels are moved over to them
+	err = mgr.Add(legacyLabelMigrator)
+	if err != nil {
+		logger.Error(err, "Failed to add the label migration")
+		return err
+	}
+
+	// Volumes kept from failed syncs are removed once their TTL passes
+	err = mgr.Add(&vmdi.FailedResourceReaper{
+		Client:   client,
+		Interval: time.Minute,
+	})
+	if err != nil {
+		logger.Error(err, "Failed to add the failed resource reaper")
+		return err
+	}
+
+	// Clean up after VMDiskImages that went away without tearing down their resources
+	if config.OrphanSweepInterval > 0 {
+		err = mgr.Add(&vmdi.OrphanSweeper{
+			Client:                        client,
+			Interval:                      config.OrphanSweepInterval,
+			GracePeriod:                   config.OrphanGracePeriod,
+			DryRun:                        config.OrphanSweepDryRun,
+			VolumeGroupSnapshotsAvailable: volumeGroupSnapshotsAvailable,
+		})
+		if err != nil {
+			logger.Error(err, "Failed to add the orphan sweeper")
+			return err
+		}
+	}
+
+	// Delete the VMDiskImages of image versions older than the retained ones
+	if config.RetainedImageVersions > 0 && config.VersionPruneInterval > 0 {
+		err = mgr.Add(&vmdi.VersionPruner{
+			Client:           client,
+			Recorder:         mgr.GetEventRecorderFor(crdv1.VMDiskImageControllerName),
+			Interval:         config.VersionPruneInterval,
+			RetainedVersions: config.RetainedImageVersions,
+			DryRun:           config.VersionPruneDryRun,
+		})
+		if err != nil {
+			logger.Error(err, "Failed to add the version pruner")
+			return err
+		}
+	}
+
 	controllerSetupError := ctrl.NewControllerManagedBy(mgr).
 		For(&crdv1.VMDiskImage{}).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(enqueueTargetingVMDiskImages)).
+		Watches(
+			&cdiv1beta1.DataSource{},
+			handler.EnqueueRequestsFromMapFunc(enqueueReadyVMDiskImages),
+			builder.WithPredicates(onlyDeletes),
+		).
+		Watches(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(enqueueReferencingVMDiskImages("Secret")),
+			builder.OnlyMetadata,
+		).
+		Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(enqueueReferencingVMDiskImages("ConfigMap")),
+			builder.OnlyMetadata,
+		).
 		Named("vmdiskimage").
 		Complete(reconciler)
 
 	return controllerSetupError
 }
+
+// The image of the manager container of the operator's pod.
+func operatorImage(ctx context.Context, reader crclient.Reader, namespace string, name string) (string, error) {
+	if namespace == "" || name == "" {
+		return "", fmt.Errorf("POD_NAME and POD_NAMESPACE are not set")
+	}
+
+	pod := &corev1.Pod{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, pod); err != nil {
+		return "", fmt.Errorf("failed to get the operator pod: %w", err)
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == "manager" {
+			return container.Image, nil
+		}
+	}
+
+	return "", fmt.Errorf("the operator pod %s has no manager container", name)
+}
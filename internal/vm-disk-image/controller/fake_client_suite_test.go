@@ -0,0 +1,56 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmdiskimagectrl
+
+import (
+	"testing"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
+)
+
+// The reconciler runs against the fake client of controller-runtime, so these
+// tests walk a VMDiskImage through its phases without a cluster. CDI and the
+// CSI snapshotter are played by the tests setting the status of the children.
+// The envtest scaffolding in suite_test.go stays disabled until it is made to
+// work, see its TODO.
+func TestControllers(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "VMDiskImage Controller Suite")
+}
+
+// The types the operator works with, like the scheme of cmd/main.go.
+var testScheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(testScheme))
+	utilruntime.Must(crdv1.AddToScheme(testScheme))
+	utilruntime.Must(cdiv1beta1.AddToScheme(testScheme))
+	utilruntime.Must(uploadv1beta1.AddToScheme(testScheme))
+	utilruntime.Must(snapshotv1.AddToScheme(testScheme))
+	utilruntime.Must(groupsnapshotv1beta2.AddToScheme(testScheme))
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmdiskimagectrl
+
+import (
+	"context"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+	vmdi "pelotech/data-sync-operator/internal/vm-disk-image/service"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	crutils "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("VMDiskImage Controller", func() {
+	const resourceName = "test-resource"
+
+	var (
+		ctx        context.Context
+		k8sClient  client.Client
+		reconciler *VMDiskImageReconciler
+		key        = types.NamespacedName{Name: resourceName, Namespace: "default"}
+	)
+
+	reconcileOnce := func() {
+		_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	getVMDiskImage := func() *crdv1.VMDiskImage {
+		vmdiskimage := &crdv1.VMDiskImage{}
+		Expect(k8sClient.Get(ctx, key, vmdiskimage)).To(Succeed())
+		return vmdiskimage
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		snapshotClass := "csi-snapclass"
+		vmdiskimage := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default", UID: "test-uid"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{
+					SourceType:    "blank",
+					URL:           "not-provided",
+					DiskSize:      "1Mi",
+					SnapshotClass: &snapshotClass,
+				},
+			},
+		}
+
+		orchestrator := vmdi.Orchestrator{}
+		k8sClient = fake.NewClientBuilder().
+			WithScheme(testScheme).
+			WithObjects(vmdiskimage).
+			WithStatusSubresource(&crdv1.VMDiskImage{}).
+			WithIndex(&crdv1.VMDiskImage{}, ".status.phase", orchestrator.IndexVMDiskImageByPhase).
+			Build()
+
+		orchestrator = vmdi.Orchestrator{
+			Client:   k8sClient,
+			Recorder: record.NewFakeRecorder(100),
+			Provisioner: vmdi.K8sVMDIProvisioner{
+				Client:                 k8sClient,
+				ResourceGenerator:      &vmdi.Generator{},
+				MaxSyncAttemptDuration: time.Hour,
+				MaxSyncAttemptRetries:  3,
+			},
+			MaxRetryBackoff:       time.Minute,
+			MaxSyncTime:           time.Hour,
+			ConcurrentSyncLimit:   1,
+			DefaultDeletionPolicy: crdv1.DeletionPolicyDelete,
+		}
+		reconciler = &VMDiskImageReconciler{
+			Scheme:                  testScheme,
+			VMDiskImageOrchestrator: orchestrator,
+		}
+	})
+
+	It("adds its finalizer and queues a new VMDiskImage", func() {
+		reconcileOnce()
+		Expect(crutils.ContainsFinalizer(getVMDiskImage(), crdv1.VMDiskImageFinalizer)).To(BeTrue())
+
+		reconcileOnce()
+		Expect(getVMDiskImage().Status.Phase).To(Equal(crdv1.PhaseQueued))
+	})
+
+	It("fails a VMDiskImage whose disk cannot be sized without source probing", func() {
+		vmdiskimage := getVMDiskImage()
+		vmdiskimage.Spec.SourceType = "http"
+		vmdiskimage.Spec.URL = "https://example.com/disk.qcow2"
+		vmdiskimage.Spec.DiskSize = ""
+		Expect(k8sClient.Update(ctx, vmdiskimage)).To(Succeed())
+
+		reconcileOnce()
+		reconcileOnce()
+		reconcileOnce()
+
+		vmdiskimage = getVMDiskImage()
+		Expect(vmdiskimage.Status.Phase).To(Equal(crdv1.PhaseFailed))
+		Expect(vmdiskimage.Status.Message).To(ContainSubstring("diskSize must be set since source probing is disabled"))
+	})
+
+	It("syncs a VMDiskImage until its snapshot is ready and tears it down when deleted", func() {
+		By("Creating the DataVolume once queued")
+		reconcileOnce()
+		reconcileOnce()
+		reconcileOnce()
+		Expect(getVMDiskImage().Status.Phase).To(Equal(crdv1.PhaseSyncing))
+
+		dataVolumes := &cdiv1beta1.DataVolumeList{}
+		Expect(k8sClient.List(ctx, dataVolumes, client.InNamespace("default"))).To(Succeed())
+		Expect(dataVolumes.Items).To(HaveLen(1))
+
+		By("Staying in Syncing while the import runs")
+		reconcileOnce()
+		Expect(getVMDiskImage().Status.Phase).To(Equal(crdv1.PhaseSyncing))
+
+		By("Becoming Ready once the DataVolume succeeded and its snapshot is ready")
+		dataVolume := &dataVolumes.Items[0]
+		dataVolume.Status.Phase = cdiv1beta1.Succeeded
+		dataVolume.Status.Progress = "100.0%"
+		Expect(k8sClient.Update(ctx, dataVolume)).To(Succeed())
+
+		reconcileOnce()
+		snapshots := &snapshotv1.VolumeSnapshotList{}
+		Expect(k8sClient.List(ctx, snapshots, client.InNamespace("default"))).To(Succeed())
+		Expect(snapshots.Items).To(HaveLen(1))
+
+		snapshot := &snapshots.Items[0]
+		readyToUse := true
+		snapshot.Status = &snapshotv1.VolumeSnapshotStatus{ReadyToUse: &readyToUse}
+		Expect(k8sClient.Update(ctx, snapshot)).To(Succeed())
+
+		Eventually(func() string {
+			reconcileOnce()
+			return getVMDiskImage().Status.Phase
+		}).WithTimeout(time.Second).Should(Equal(crdv1.PhaseReady))
+
+		By("Tearing down its resources once deleted")
+		Expect(k8sClient.Delete(ctx, getVMDiskImage())).To(Succeed())
+		Eventually(func() bool {
+			reconcileOnce()
+			err := k8sClient.Get(ctx, key, &crdv1.VMDiskImage{})
+			return errors.IsNotFound(err)
+		}).WithTimeout(time.Second).Should(BeTrue())
+
+		Expect(k8sClient.List(ctx, dataVolumes, client.InNamespace("default"))).To(Succeed())
+		Expect(dataVolumes.Items).To(BeEmpty())
+		Expect(k8sClient.List(ctx, snapshots, client.InNamespace("default"))).To(Succeed())
+		Expect(snapshots.Items).To(BeEmpty())
+	})
+})
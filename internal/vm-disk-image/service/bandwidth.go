@@ -0,0 +1,52 @@
+package service
+
+import (
+	"slices"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The annotation limiting how fast a pod may receive data, honoured by the
+// bandwidth CNI plugin.
+const ingressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+
+// Work out how much bandwidth a sync about to start may use and record it in
+// the status. A VMDiskImage's own limit or the default applies, lowered to an
+// equal share of the bandwidth budget among the syncs that will be active.
+// Shares are handed out when a sync starts and kept until it ends. Only http
+// and s3 disks are downloaded by the operator so nothing is recorded for
+// VMDiskImages without one.
+func (o Orchestrator) allocateBandwidth(vmdi *crdv1.VMDiskImage, activeSyncs int) {
+	vmdi.Status.BandwidthLimit = ""
+	if !slices.ContainsFunc(vmdi.Spec.GetDisks(), isDownloadSource) {
+		return
+	}
+
+	var limit *resource.Quantity
+	if vmdi.Spec.BandwidthLimit != "" {
+		if requested, err := resource.ParseQuantity(vmdi.Spec.BandwidthLimit); err == nil && !requested.IsZero() {
+			limit = &requested
+		}
+	} else if o.DefaultBandwidthLimit != nil {
+		limit = o.DefaultBandwidthLimit
+	}
+
+	if o.BandwidthBudget != nil {
+		share := resource.NewQuantity(o.BandwidthBudget.Value()/int64(activeSyncs+1), resource.DecimalSI)
+		if limit == nil || share.Cmp(*limit) < 0 {
+			limit = share
+		}
+	}
+
+	if limit != nil {
+		vmdi.Status.BandwidthLimit = limit.String()
+	}
+}
+
+// Whether a disk's artifact is downloaded over http, which the import jobs
+// can do instead of CDI.
+func isDownloadSource(disk crdv1.VMDiskImageDisk) bool {
+	return disk.SourceType == "http" || disk.SourceType == "s3"
+}
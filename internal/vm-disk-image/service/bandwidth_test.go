@@ -0,0 +1,41 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+var _ = Describe("allocateBandwidth", func() {
+	DescribeTable("records the bandwidth limit of a sync",
+		func(sourceType string, limit string, defaultLimit string, budget string, activeSyncs int, expected string) {
+			orchestrator := Orchestrator{}
+			if defaultLimit != "" {
+				orchestrator.DefaultBandwidthLimit = ptr.To(resource.MustParse(defaultLimit))
+			}
+			if budget != "" {
+				orchestrator.BandwidthBudget = ptr.To(resource.MustParse(budget))
+			}
+			vmdi := &crdv1.VMDiskImage{
+				Spec: crdv1.VMDiskImageSpec{
+					VMDiskSpec:     crdv1.VMDiskSpec{SourceType: sourceType},
+					BandwidthLimit: limit,
+				},
+				Status: crdv1.VMDiskImageStatus{BandwidthLimit: "1k"},
+			}
+
+			orchestrator.allocateBandwidth(vmdi, activeSyncs)
+			Expect(vmdi.Status.BandwidthLimit).To(Equal(expected))
+		},
+		Entry("unlimited without a limit or budget", "http", "", "", "", 0, ""),
+		Entry("from the VMDiskImage", "http", "500M", "1G", "", 0, "500M"),
+		Entry("from the default", "s3", "", "1G", "", 0, "1G"),
+		Entry("as a share of the budget", "http", "", "", "1G", 3, "250M"),
+		Entry("lowered to the share of the budget", "http", "500M", "", "1G", 3, "250M"),
+		Entry("below the share of the budget", "http", "100M", "", "1G", 1, "100M"),
+		Entry("never for disks CDI downloads", "registry", "500M", "", "1G", 0, ""),
+	)
+})
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var ErrChecksumMismatch = errors.New("the checksum of the source artifact does not match the expected checksum")
+var ErrChecksumVerificationFailed = errors.New("the checksum of the source artifact could not be computed")
+
+// How the checksum job tells cmd/checksum-verifier what to hash. The CA bundle
+// and the header secrets of the source are mounted as files.
+const (
+	ChecksumSourceTypeEnv = "SOURCE_TYPE"
+	ChecksumSourceURLEnv  = "SOURCE_URL"
+	ChecksumSourceETagEnv = "SOURCE_ETAG"
+	// Newline separated "Name: value" lines.
+	ChecksumExtraHeadersEnv = "EXTRA_HEADERS"
+	ChecksumAlgorithmEnv    = "CHECKSUM_ALGORITHM"
+	ChecksumAccessKeyEnv    = "ACCESS_KEY_ID"
+	ChecksumSecretKeyEnv    = "SECRET_KEY"
+	ChecksumCertsDir        = "/etc/checksum-verifier/certs"
+	ChecksumHeadersDir      = "/etc/checksum-verifier/headers"
+	ChecksumVerifierBinary  = "/checksum-verifier"
+)
+
+// The outcome of the checksum job of a disk.
+type checksumResult struct {
+	Found  bool
+	Done   bool
+	Failed bool
+	Digest string
+}
+
+func (r checksumResult) matches(checksum *crdv1.VMDiskImageChecksum) bool {
+	return r.Done && strings.EqualFold(r.Digest, checksum.Digest)
+}
+
+// Check that the source artifact of every disk with a checksum matches it.
+// The checksum jobs are created once the datavolumes are done syncing so the
+// artifact is hashed as close as possible to when it was imported.
+func (p K8sVMDIProvisioner) checksumsAreVerified(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (bool, error) {
+	allVerified := true
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.Checksum == nil {
+			continue
+		}
+		// checksumErrors fails the sync of disks that cannot be verified
+		if !p.ChecksumVerification {
+			return false, nil
+		}
+
+		result, err := p.getChecksumResult(ctx, vmdi, disk)
+		if err != nil {
+			return false, err
+		}
+
+		if !result.Found {
+			job := p.ResourceGenerator.CreateChecksumJobManifest(vmdi, disk)
+			err := p.Patch(ctx, job, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+			if err != nil {
+				return false, fmt.Errorf("failed to create the checksum job of the disk %s: %w", disk.Name, err)
+			}
+		}
+
+		allVerified = allVerified && result.matches(disk.Checksum)
+	}
+
+	return allVerified, nil
+}
+
+// Surface the checksum jobs that failed or found a mismatch.
+func (p K8sVMDIProvisioner) checksumErrors(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.Checksum == nil {
+			continue
+		}
+		if !p.ChecksumVerification {
+			return fmt.Errorf("%w: no checksum verifier image is configured", ErrChecksumVerificationFailed)
+		}
+
+		result, err := p.getChecksumResult(ctx, vmdi, disk)
+		if err != nil {
+			return err
+		}
+
+		if result.Failed {
+			return fmt.Errorf("%w: the checksum job of the disk %s failed", ErrChecksumVerificationFailed, disk.Name)
+		}
+		if result.Done && !result.matches(disk.Checksum) {
+			return fmt.Errorf("%w: expected %s %s but computed %s", ErrChecksumMismatch, disk.Checksum.Algorithm, disk.Checksum.Digest, result.Digest)
+		}
+	}
+
+	return nil
+}
+
+// Read the state of the checksum job of a disk. The computed digest is the
+// termination message of the job's pod.
+func (p K8sVMDIProvisioner) getChecksumResult(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) (checksumResult, error) {
+	job := &batchv1.Job{}
+	err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: checksumJobName(vmdi, disk)}, job)
+	if err != nil {
+		return checksumResult{}, client.IgnoreNotFound(err)
+	}
+
+	result := checksumResult{Found: true}
+	if job.Status.Failed > 0 {
+		result.Failed = true
+		return result, nil
+	}
+	if job.Status.Succeeded == 0 {
+		return result, nil
+	}
+
+	podList := &corev1.PodList{}
+	err = p.List(ctx, podList, client.InNamespace(vmdi.Namespace), client.MatchingLabels{batchv1.JobNameLabel: job.Name})
+	if err != nil {
+		return checksumResult{}, fmt.Errorf("failed to list the pods of the checksum job %s: %w", job.Name, err)
+	}
+
+	for _, pod := range podList.Items {
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			terminated := containerStatus.State.Terminated
+			if terminated == nil || terminated.ExitCode != 0 {
+				continue
+			}
+			// Never compare against a digest that was not written
+			result.Digest = strings.TrimSpace(terminated.Message)
+			result.Done = result.Digest != ""
+			result.Failed = result.Digest == ""
+			return result, nil
+		}
+	}
+
+	// The job succeeded but its pod is gone so the digest is unknown
+	result.Failed = true
+
+	return result, nil
+}
+
+func checksumStatus(result checksumResult, checksum *crdv1.VMDiskImageChecksum) *crdv1.VMDiskImageChecksumStatus {
+	if !result.Done {
+		return nil
+	}
+
+	return &crdv1.VMDiskImageChecksumStatus{
+		Digest:   result.Digest,
+		Verified: result.matches(checksum),
+	}
+}
+
+// The hash of a checksum algorithm of the CRD.
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
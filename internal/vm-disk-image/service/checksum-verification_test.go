@@ -0,0 +1,167 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("HTTPSourceProbe.Hash", func() {
+	artifact := []byte("the bits of a disk image")
+	sum := sha256.Sum256(artifact)
+	digest := hex.EncodeToString(sum[:])
+
+	var server *httptest.Server
+	var requests []*http.Request
+
+	BeforeEach(func() {
+		requests = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			switch r.URL.Path {
+			case "/gone":
+				w.WriteHeader(http.StatusGone)
+			case "/broken":
+				w.WriteHeader(http.StatusInternalServerError)
+			case "/short":
+				w.Header().Set("Content-Length", "100")
+				_, _ = w.Write(artifact)
+			default:
+				if match := r.Header.Get("If-Match"); match != "" && match != `"v1"` {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write(artifact)
+			}
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	hash := func(ctx SpecContext, path string, etag string) (string, error) {
+		return HTTPSourceProbe{}.Hash(ctx, SourceProbeRequest{
+			SourceType: "http",
+			URL:        server.URL + path,
+			ETag:       etag,
+			Headers:    http.Header{"Accept": {"application/octet-stream"}},
+		}, "sha256")
+	}
+
+	It("hashes the whole artifact with the source's headers", func(ctx SpecContext) {
+		Expect(hash(ctx, "/disk.img", "")).To(Equal(digest))
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Header.Get("Accept")).To(Equal("application/octet-stream"))
+		Expect(requests[0].Header.Get("Range")).To(BeEmpty())
+	})
+
+	It("only hashes the artifact that was probed", func(ctx SpecContext) {
+		Expect(hash(ctx, "/disk.img", "v1")).To(Equal(digest))
+		Expect(requests[0].Header.Get("If-Match")).To(Equal(`"v1"`))
+
+		_, err := hash(ctx, "/disk.img", "v0")
+		Expect(err).To(MatchError(ContainSubstring("changed since it was probed")))
+	})
+
+	It("reports artifacts that do not exist", func(ctx SpecContext) {
+		_, err := hash(ctx, "/gone", "")
+		Expect(err).To(MatchError(ErrMissingSourceArtifact))
+	})
+
+	It("fails instead of returning a digest it could not compute", func(ctx SpecContext) {
+		_, err := hash(ctx, "/broken", "")
+		Expect(err).To(HaveOccurred())
+
+		_, err = hash(ctx, "/short", "")
+		Expect(err).To(HaveOccurred())
+
+		_, err = HTTPSourceProbe{}.Hash(ctx, SourceProbeRequest{SourceType: "http", URL: server.URL}, "crc32")
+		Expect(err).To(MatchError(ContainSubstring("unsupported checksum algorithm")))
+	})
+})
+
+var _ = Describe("getChecksumResult", func() {
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+		Spec: crdv1.VMDiskImageSpec{
+			VMDiskSpec: crdv1.VMDiskSpec{
+				SourceType: "http",
+				Checksum:   &crdv1.VMDiskImageChecksum{Algorithm: "sha256", Digest: "abc"},
+			},
+		},
+	}
+	disk := vmdi.Spec.GetDisks()[0]
+
+	resultOf := func(ctx SpecContext, message string) checksumResult {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: checksumJobName(vmdi, disk), Namespace: vmdi.Namespace},
+			Status:     batchv1.JobStatus{Succeeded: 1},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      job.Name + "-x",
+				Namespace: vmdi.Namespace,
+				Labels:    map[string]string{batchv1.JobNameLabel: job.Name},
+			},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}},
+			}}},
+		}
+		provisioner := K8sVMDIProvisioner{
+			Client: newFakeClient(job, pod),
+		}
+
+		result, err := provisioner.getChecksumResult(ctx, vmdi, disk)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	It("reads the digest from the termination message", func(ctx SpecContext) {
+		result := resultOf(ctx, "ABC\n")
+		Expect(result.Done).To(BeTrue())
+		Expect(result.matches(disk.Checksum)).To(BeTrue())
+	})
+
+	It("fails a job that succeeded without writing a digest", func(ctx SpecContext) {
+		result := resultOf(ctx, "")
+		Expect(result.Done).To(BeFalse())
+		Expect(result.Failed).To(BeTrue())
+	})
+})
+
+var _ = Describe("checksumsAreVerified", func() {
+	vmdiWith := func(checksum *crdv1.VMDiskImageChecksum) *crdv1.VMDiskImage {
+		return &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default", UID: "uid"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://example.com/disk.img", Checksum: checksum},
+			},
+		}
+	}
+
+	It("does not hold back disks without a checksum when there is no verifier", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient()}
+
+		verified, err := provisioner.checksumsAreVerified(ctx, vmdiWith(nil))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verified).To(BeTrue())
+	})
+
+	It("never verifies a disk with a checksum when there is no verifier", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient()}
+		vmdi := vmdiWith(&crdv1.VMDiskImageChecksum{Algorithm: "sha256", Digest: "abc"})
+
+		verified, err := provisioner.checksumsAreVerified(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verified).To(BeFalse())
+		Expect(provisioner.checksumErrors(ctx, vmdi)).To(MatchError(ErrChecksumVerificationFailed))
+	})
+})
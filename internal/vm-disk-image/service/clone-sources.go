@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var ErrCloneNotPermitted = errors.New("cloning from the source namespace is not permitted")
+
+// Whether a disk is cloned from a volume already in the cluster.
+func isCloneSource(disk crdv1.VMDiskImageDisk) bool {
+	return disk.SourceType == "pvc" || disk.SourceType == "snapshot"
+}
+
+func cloneSourceNamespace(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	if disk.SourceRef == nil || disk.SourceRef.Namespace == "" {
+		return vmdi.Namespace
+	}
+
+	return disk.SourceRef.Namespace
+}
+
+// Make sure the volumes cloned by the disks of a VMDiskImage exist and that
+// their namespace lets the VMDiskImage clone them. The operator creates the
+// DataVolumes, so CDI checks its own permissions rather than those of whoever
+// wrote the VMDiskImage. A source namespace therefore has to opt in twice:
+// its clone targets annotation lists the namespace of the VMDiskImage, and it
+// binds the clone source role to the operator so CDI lets it clone.
+func (p K8sVMDIProvisioner) verifyCloneSources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if !isCloneSource(disk) || disk.SourceRef == nil {
+			continue
+		}
+
+		key := client.ObjectKey{Namespace: cloneSourceNamespace(vmdi, disk), Name: disk.SourceRef.Name}
+		// Nothing is revealed about namespaces that did not opt in
+		if key.Namespace != vmdi.Namespace {
+			if err := p.verifyCloneTarget(ctx, key.Namespace, vmdi.Namespace); err != nil {
+				return err
+			}
+		}
+
+		var source client.Object = &corev1.PersistentVolumeClaim{}
+		if disk.SourceType == "snapshot" {
+			source = &snapshotv1.VolumeSnapshot{}
+		}
+
+		err := p.Get(ctx, key, source)
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("%w: the %s %s/%s to clone does not exist", ErrMissingSourceArtifact, disk.SourceType, key.Namespace, key.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get the %s %s/%s to clone: %w", disk.SourceType, key.Namespace, key.Name, err)
+		}
+		if !source.GetDeletionTimestamp().IsZero() {
+			return fmt.Errorf("%w: the %s %s/%s to clone is being deleted", ErrMissingSourceArtifact, disk.SourceType, key.Namespace, key.Name)
+		}
+	}
+
+	return nil
+}
+
+// Check that a source namespace lets VMDiskImages of the target namespace
+// clone its volumes, and that it granted the operator what CDI asks for.
+func (p K8sVMDIProvisioner) verifyCloneTarget(ctx context.Context, sourceNamespace string, targetNamespace string) error {
+	namespace := &corev1.Namespace{}
+	if err := p.Get(ctx, client.ObjectKey{Name: sourceNamespace}, namespace); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("%w: the namespace %s does not exist", ErrCloneNotPermitted, sourceNamespace)
+		}
+		return fmt.Errorf("failed to get the namespace %s: %w", sourceNamespace, err)
+	}
+
+	if !namespaceListAllows(namespace.Annotations[crdv1.VMDiskImageCloneTargetsAnnotation], targetNamespace) {
+		return fmt.Errorf("%w: the namespace %s does not list %s in its %s annotation", ErrCloneNotPermitted, sourceNamespace, targetNamespace, crdv1.VMDiskImageCloneTargetsAnnotation)
+	}
+
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   sourceNamespace,
+				Verb:        "create",
+				Group:       "cdi.kubevirt.io",
+				Resource:    "datavolumes",
+				Subresource: cdiv1beta1.DataVolumeCloneSourceSubresource,
+			},
+		},
+	}
+	if err := p.Create(ctx, review); err != nil {
+		return fmt.Errorf("failed to check the clone permissions in the namespace %s: %w", sourceNamespace, err)
+	}
+	if !review.Status.Allowed {
+		return fmt.Errorf("%w: the namespace %s does not bind the clone source role to the operator", ErrCloneNotPermitted, sourceNamespace)
+	}
+
+	return nil
+}
+
+// Whether a comma separated list of namespaces, as held by the opt-in
+// annotations of a namespace, contains the given namespace or "*".
+func namespaceListAllows(value string, namespace string) bool {
+	for listed := range strings.SplitSeq(value, ",") {
+		listed = strings.TrimSpace(listed)
+		if listed == namespace || listed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var _ = Describe("verifyCloneSources", func() {
+	var (
+		vmdi            *crdv1.VMDiskImage
+		sourceNamespace *corev1.Namespace
+		sourceClaim     *corev1.PersistentVolumeClaim
+		// Whether the API server says the operator may create
+		// datavolumes/source in the source namespace
+		operatorAllowed bool
+		reviews         []*authorizationv1.SelfSubjectAccessReview
+	)
+
+	newProvisioner := func() K8sVMDIProvisioner {
+		k8sClient := fake.NewClientBuilder().
+			WithScheme(testScheme).
+			WithObjects(sourceNamespace, sourceClaim).
+			WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					review, isReview := obj.(*authorizationv1.SelfSubjectAccessReview)
+					if !isReview {
+						return c.Create(ctx, obj, opts...)
+					}
+					reviews = append(reviews, review)
+					review.Status.Allowed = operatorAllowed
+					return nil
+				},
+			}).
+			Build()
+
+		return K8sVMDIProvisioner{Client: k8sClient, ResourceGenerator: &Generator{}}
+	}
+
+	BeforeEach(func() {
+		vmdi = &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "team-a"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{
+					SourceType: "pvc",
+					SourceRef:  &crdv1.VMDiskImageSourceRef{Namespace: "golden-images", Name: "ubuntu"},
+				},
+			},
+		}
+		sourceNamespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "golden-images"}}
+		sourceClaim = &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "golden-images"}}
+		operatorAllowed = true
+		reviews = nil
+	})
+
+	It("refuses to clone from a namespace that did not opt in", func(ctx SpecContext) {
+		err := newProvisioner().verifyCloneSources(ctx, vmdi)
+
+		Expect(err).To(MatchError(ErrCloneNotPermitted))
+		Expect(err).To(MatchError(ContainSubstring("does not list team-a")))
+		Expect(reviews).To(BeEmpty())
+	})
+
+	It("refuses to clone into namespaces the source namespace does not list", func(ctx SpecContext) {
+		sourceNamespace.Annotations = map[string]string{crdv1.VMDiskImageCloneTargetsAnnotation: "team-b, team-c"}
+
+		Expect(newProvisioner().verifyCloneSources(ctx, vmdi)).To(MatchError(ErrCloneNotPermitted))
+	})
+
+	It("refuses to clone when the source namespace did not grant the operator the clone source role", func(ctx SpecContext) {
+		sourceNamespace.Annotations = map[string]string{crdv1.VMDiskImageCloneTargetsAnnotation: "team-a"}
+		operatorAllowed = false
+
+		err := newProvisioner().verifyCloneSources(ctx, vmdi)
+
+		Expect(err).To(MatchError(ErrCloneNotPermitted))
+		Expect(err).To(MatchError(ContainSubstring("does not bind the clone source role")))
+		Expect(reviews).To(HaveLen(1))
+		Expect(reviews[0].Spec.ResourceAttributes).To(HaveValue(And(
+			HaveField("Namespace", "golden-images"),
+			HaveField("Verb", "create"),
+			HaveField("Resource", "datavolumes"),
+			HaveField("Subresource", "source"),
+		)))
+	})
+
+	It("clones from a namespace that opted in", func(ctx SpecContext) {
+		sourceNamespace.Annotations = map[string]string{crdv1.VMDiskImageCloneTargetsAnnotation: "team-b,team-a"}
+
+		Expect(newProvisioner().verifyCloneSources(ctx, vmdi)).To(Succeed())
+	})
+
+	It("lets every namespace clone when the source namespace opts in with a wildcard", func(ctx SpecContext) {
+		sourceNamespace.Annotations = map[string]string{crdv1.VMDiskImageCloneTargetsAnnotation: "*"}
+
+		Expect(newProvisioner().verifyCloneSources(ctx, vmdi)).To(Succeed())
+	})
+
+	It("clones from its own namespace without an opt in", func(ctx SpecContext) {
+		vmdi.Namespace = "golden-images"
+		operatorAllowed = false
+
+		Expect(newProvisioner().verifyCloneSources(ctx, vmdi)).To(Succeed())
+		Expect(reviews).To(BeEmpty())
+	})
+
+	It("reports a missing source only once the namespace opted in", func(ctx SpecContext) {
+		sourceNamespace.Annotations = map[string]string{crdv1.VMDiskImageCloneTargetsAnnotation: "team-a"}
+		vmdi.Spec.SourceRef.Name = "missing"
+
+		Expect(newProvisioner().verifyCloneSources(ctx, vmdi)).To(MatchError(ErrMissingSourceArtifact))
+	})
+})
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Point the CDI DataSources of a Ready VMDiskImage at its disks. A DataSource
+// that already points at a VMDiskImage that became Ready more recently is left
+// alone. The DataSources pointing at our VMDiskImage are recorded on its
+// status. The caller is responsible for persisting the status.
+func (p K8sVMDIProvisioner) PublishDataSources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	logger := logf.FromContext(ctx)
+
+	usesGroupSnapshot := p.ResourceGenerator.UsesGroupSnapshot(vmdi)
+
+	var published []string
+	for _, disk := range vmdi.Spec.GetDisks() {
+		name := diskResourceName(vmdi, disk)
+
+		source := cdiv1beta1.DataSourceSource{
+			Snapshot: &cdiv1beta1.DataVolumeSourceSnapshot{Namespace: vmdi.Namespace, Name: diskSnapshotName(vmdi, disk)},
+		}
+		// The snapshots of a group snapshot are named by the snapshot
+		// controller so the synced PVC is published instead.
+		if usesGroupSnapshot {
+			source = cdiv1beta1.DataSourceSource{
+				PVC: &cdiv1beta1.DataVolumeSourcePVC{Namespace: vmdi.Namespace, Name: name},
+			}
+		}
+
+		dataSource := p.ResourceGenerator.CreateDataSourceManifest(vmdi, disk, source)
+
+		current := &cdiv1beta1.DataSource{}
+		err := p.Get(ctx, client.ObjectKeyFromObject(dataSource), current)
+		if client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to get the datasource %s: %w", dataSource.Name, err)
+		}
+		if err == nil {
+			publishedElsewhere, err := p.isPublishedByAnotherImage(ctx, vmdi, current)
+			if err != nil {
+				return err
+			}
+			if publishedElsewhere {
+				logger.Info("DataSource points at another VMDiskImage. Leaving it alone.", "dataSource", current.Name)
+				continue
+			}
+		}
+
+		err = p.Patch(ctx, dataSource, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+		if err != nil {
+			return fmt.Errorf("failed to publish the datasource %s: %w", dataSource.Name, err)
+		}
+
+		published = append(published, dataSource.Name)
+	}
+
+	vmdi.Status.DataSources = published
+
+	return nil
+}
+
+// Whether the DataSource should keep pointing at something other than our
+// VMDiskImage. That is the case when it was not created by a VMDiskImage or
+// when the VMDiskImage it points at became Ready after ours.
+func (p K8sVMDIProvisioner) isPublishedByAnotherImage(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	dataSource *cdiv1beta1.DataSource,
+) (bool, error) {
+	owner := metav1.GetControllerOf(dataSource)
+	if owner == nil || owner.Kind != "VMDiskImage" {
+		return true, nil
+	}
+	if owner.UID == vmdi.UID {
+		return false, nil
+	}
+
+	other := &crdv1.VMDiskImage{}
+	err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: owner.Name}, other)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get the VMDiskImage %s publishing the datasource %s: %w", owner.Name, dataSource.Name, err)
+	}
+
+	otherIsCurrent := other.UID == owner.UID && other.DeletionTimestamp.IsZero() && other.Status.Phase == crdv1.PhaseReady
+	if !otherIsCurrent {
+		return false, nil
+	}
+
+	return readySince(other).After(readySince(vmdi)), nil
+}
+
+// When the VMDiskImage last became Ready.
+func readySince(vmdi *crdv1.VMDiskImage) time.Time {
+	condition := meta.FindStatusCondition(vmdi.Status.Conditions, crdv1.ConditionTypeReady)
+	if condition == nil || condition.Status != metav1.ConditionTrue {
+		return time.Time{}
+	}
+
+	return condition.LastTransitionTime.Time
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Retrying cannot size a disk whose spec does not fit its source, so a
+// VMDiskImage with one fails permanently.
+var ErrUnsizableDisk = errors.New("the disk cannot be sized")
+
+// Sizes are rounded up to whole mebibytes.
+const sizeGranularity = 1 << 20
+
+// The virtual size a qcow2 image presents to a VM, read from its header.
+func qcow2VirtualSize(header []byte) int64 {
+	if len(header) < 32 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(header[24:32]))
+}
+
+// Work out how large the volume of each disk has to be and record it in the
+// source status. Disks without a diskSize get the size of their source plus
+// the configured overhead. Disks whose diskSize cannot hold their source, or
+// that need one, are rejected before any resources are created for them.
+func (p K8sVMDIProvisioner) sizeDisks(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.Adopt != nil {
+			continue
+		}
+
+		sourceSize, err := p.sourceSize(ctx, vmdi, disk)
+		if err != nil {
+			return err
+		}
+
+		effectiveSize := ""
+		if disk.DiskSize != "" {
+			size, err := resource.ParseQuantity(disk.DiskSize)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrUnsizableDisk, diskProblem(disk, fmt.Sprintf("invalid diskSize %q", disk.DiskSize)), err)
+			}
+			if size.Value() < sourceSize {
+				problem := fmt.Sprintf("the diskSize %s is smaller than the %s the source needs", disk.DiskSize, resource.NewQuantity(sourceSize, resource.BinarySI).String())
+				return fmt.Errorf("%w: %s", ErrUnsizableDisk, diskProblem(disk, problem))
+			}
+			effectiveSize = disk.DiskSize
+		} else {
+			if sourceSize == 0 {
+				return fmt.Errorf("%w: %s", ErrUnsizableDisk, diskProblem(disk, p.unknownSourceSizeProblem(disk)))
+			}
+			effectiveSize = p.withSizeOverhead(sourceSize).String()
+		}
+
+		setSourceStatus(vmdi, disk, func(status *crdv1.VMDiskImageSourceStatus) {
+			status.DiskSize = effectiveSize
+		})
+	}
+
+	return nil
+}
+
+// Why a disk without a diskSize cannot be sized from its source.
+func (p K8sVMDIProvisioner) unknownSourceSizeProblem(disk crdv1.VMDiskImageDisk) string {
+	probed := disk.SourceType == "s3" || disk.SourceType == "http"
+	if probed && p.SourceProbe == nil {
+		return "diskSize must be set since source probing is disabled"
+	}
+
+	return "diskSize must be set since the size of its source cannot be determined"
+}
+
+// The number of bytes the source of a disk takes up once imported, or 0 when
+// it is not known.
+func (p K8sVMDIProvisioner) sourceSize(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) (int64, error) {
+	switch disk.SourceType {
+	case "s3", "http":
+		status := sourceStatusOf(vmdi, disk)
+		switch {
+		case status == nil || status.Compression != "":
+			return 0, nil
+		case status.VirtualSize > 0:
+			return status.VirtualSize, nil
+		case status.Format == "raw":
+			return status.ContentLength, nil
+		}
+	case "pvc", "snapshot":
+		if disk.SourceRef == nil {
+			return 0, nil
+		}
+		return p.cloneSourceSize(ctx, vmdi, disk)
+	}
+
+	return 0, nil
+}
+
+func (p K8sVMDIProvisioner) cloneSourceSize(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) (int64, error) {
+	key := client.ObjectKey{Namespace: cloneSourceNamespace(vmdi, disk), Name: disk.SourceRef.Name}
+
+	if disk.SourceType == "snapshot" {
+		snapshot := &snapshotv1.VolumeSnapshot{}
+		if err := p.Get(ctx, key, snapshot); err != nil {
+			return 0, client.IgnoreNotFound(err)
+		}
+		if snapshot.Status == nil || snapshot.Status.RestoreSize == nil {
+			return 0, nil
+		}
+		return snapshot.Status.RestoreSize.Value(), nil
+	}
+
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := p.Get(ctx, key, claim); err != nil {
+		return 0, client.IgnoreNotFound(err)
+	}
+	if capacity, found := claim.Status.Capacity[corev1.ResourceStorage]; found {
+		return capacity.Value(), nil
+	}
+	request := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	return request.Value(), nil
+}
+
+// Grow a size by the configured overhead, rounded up to whole mebibytes.
+func (p K8sVMDIProvisioner) withSizeOverhead(size int64) *resource.Quantity {
+	size += size * int64(p.DiskSizeOverheadPercent) / 100
+	size = (size + sizeGranularity - 1) / sizeGranularity * sizeGranularity
+
+	return resource.NewQuantity(size, resource.BinarySI)
+}
+
+// The size of the volume of a disk, which the spec sets or sizeDisks worked out.
+func effectiveDiskSize(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	if disk.DiskSize != "" {
+		return disk.DiskSize
+	}
+	if status := sourceStatusOf(vmdi, disk); status != nil {
+		return status.DiskSize
+	}
+
+	return ""
+}
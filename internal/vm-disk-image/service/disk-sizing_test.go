@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/binary"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("qcow2VirtualSize", func() {
+	It("reads the big-endian size at offset 24 of the header", func() {
+		header := make([]byte, 512)
+		copy(header, []byte{'Q', 'F', 'I', 0xfb})
+		binary.BigEndian.PutUint64(header[24:], 20<<30)
+
+		Expect(qcow2VirtualSize(header)).To(Equal(int64(20 << 30)))
+	})
+
+	It("does not guess from a truncated header", func() {
+		Expect(qcow2VirtualSize([]byte{'Q', 'F', 'I', 0xfb})).To(BeZero())
+	})
+})
+
+var _ = Describe("withSizeOverhead", func() {
+	DescribeTable("grows sizes by the overhead and rounds them up to whole mebibytes",
+		func(overheadPercent int, size int64, expected string) {
+			provisioner := K8sVMDIProvisioner{DiskSizeOverheadPercent: overheadPercent}
+			Expect(provisioner.withSizeOverhead(size).String()).To(Equal(expected))
+		},
+		Entry("without overhead", 0, int64(1<<30), "1Gi"),
+		Entry("with overhead", 10, int64(1<<30), "1127Mi"),
+		Entry("partial mebibytes", 0, int64(1), "1Mi"),
+		Entry("sizes just past a mebibyte", 0, int64(1<<20+1), "2Mi"),
+	)
+})
+
+var _ = Describe("sizeDisks", func() {
+	newVMDiskImage := func(diskSize string, source crdv1.VMDiskImageSourceStatus) *crdv1.VMDiskImage {
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://example.com/disk.img", DiskSize: diskSize},
+			},
+		}
+		source.Disk = vmdi.Spec.GetDisks()[0].Name
+		vmdi.Status.Sources = []crdv1.VMDiskImageSourceStatus{source}
+		return vmdi
+	}
+	provisioner := K8sVMDIProvisioner{DiskSizeOverheadPercent: 10}
+
+	It("sizes disks without a diskSize from their source", func(ctx SpecContext) {
+		vmdi := newVMDiskImage("", crdv1.VMDiskImageSourceStatus{Format: "qcow2", VirtualSize: 1 << 30, ContentLength: 300 << 20})
+
+		Expect(provisioner.sizeDisks(ctx, vmdi)).To(Succeed())
+		Expect(vmdi.Status.Sources[0].DiskSize).To(Equal("1127Mi"))
+	})
+
+	It("keeps the diskSize of disks that set one", func(ctx SpecContext) {
+		vmdi := newVMDiskImage("2Gi", crdv1.VMDiskImageSourceStatus{Format: "raw", ContentLength: 1 << 30})
+
+		Expect(provisioner.sizeDisks(ctx, vmdi)).To(Succeed())
+		Expect(vmdi.Status.Sources[0].DiskSize).To(Equal("2Gi"))
+	})
+
+	It("rejects a diskSize that cannot hold the source", func(ctx SpecContext) {
+		vmdi := newVMDiskImage("1Gi", crdv1.VMDiskImageSourceStatus{Format: "qcow2", VirtualSize: 20 << 30})
+
+		Expect(provisioner.sizeDisks(ctx, vmdi)).To(MatchError(ErrUnsizableDisk))
+	})
+
+	It("needs a diskSize when the size of the source is unknown", func(ctx SpecContext) {
+		vmdi := newVMDiskImage("", crdv1.VMDiskImageSourceStatus{Compression: "gzip", ContentLength: 1 << 30})
+		probingProvisioner := provisioner
+		probingProvisioner.SourceProbe = HTTPSourceProbe{}
+
+		err := probingProvisioner.sizeDisks(ctx, vmdi)
+		Expect(err).To(MatchError(ErrUnsizableDisk))
+		Expect(err).To(MatchError("the disk cannot be sized: diskSize must be set since the size of its source cannot be determined"))
+	})
+
+	It("needs a diskSize when source probing is disabled", func(ctx SpecContext) {
+		vmdi := newVMDiskImage("", crdv1.VMDiskImageSourceStatus{})
+		vmdi.Status.Sources = nil
+
+		Expect(provisioner.sizeDisks(ctx, vmdi)).To(MatchError(ContainSubstring("diskSize must be set since source probing is disabled")))
+	})
+})
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// How long retained volumes are kept when the VMDiskImage does not say.
+const defaultRetainedFailureTTL = 24 * time.Hour
+
+func retainsFailedResources(vmdi *crdv1.VMDiskImage) bool {
+	return vmdi.Spec.Debug != nil && vmdi.Spec.Debug.RetainFailedResources
+}
+
+// Keep the volume of each disk of a failed sync for debugging. Objects cannot
+// be renamed so the persistent volume holding the data is pre-bound to a new
+// <disk>-failed-<n> claim, n being the failure count of the sync. The teardown
+// that follows then only removes the emptied DataVolume and claim, and the
+// next attempt does not collide with what was kept. The reaper deletes the
+// new claim once its TTL passes. Returns how many volumes were kept.
+func (p K8sVMDIProvisioner) RetainFailedResources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (int, error) {
+	if !retainsFailedResources(vmdi) {
+		return 0, nil
+	}
+	logger := logf.FromContext(ctx)
+
+	ttl := defaultRetainedFailureTTL
+	if vmdi.Spec.Debug.TTL != nil {
+		ttl = vmdi.Spec.Debug.TTL.Duration
+	}
+	retainUntil := time.Now().Add(ttl).UTC().Format(time.RFC3339)
+
+	retained := 0
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.Adopt != nil {
+			continue
+		}
+
+		claim, err := p.claimHoldingData(ctx, vmdi.Namespace, diskResourceName(vmdi, disk))
+		if err != nil {
+			return retained, err
+		}
+		if claim == nil {
+			continue
+		}
+
+		volume := &corev1.PersistentVolume{}
+		if err := p.Get(ctx, client.ObjectKey{Name: claim.Spec.VolumeName}, volume); err != nil {
+			return retained, fmt.Errorf("failed to get the volume of %s: %w", claim.Name, err)
+		}
+
+		retainedClaim, err := p.createRetainedClaim(ctx, vmdi, disk, volume, retainUntil)
+		if err != nil {
+			return retained, fmt.Errorf("failed to create the claim retaining %s: %w", claim.Name, err)
+		}
+
+		// Pre-binding the volume to the new claim keeps it from being
+		// reclaimed when the failed claim is deleted
+		patch := client.MergeFrom(volume.DeepCopy())
+		volume.Spec.ClaimRef = &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Namespace:  retainedClaim.Namespace,
+			Name:       retainedClaim.Name,
+		}
+		if err := p.Patch(ctx, volume, patch); err != nil {
+			return retained, fmt.Errorf("failed to move the volume of %s to %s: %w", claim.Name, retainedClaim.Name, err)
+		}
+
+		logger.Info("Retained the volume of a failed sync", "claim", retainedClaim.Name, "volume", volume.Name, "until", retainUntil)
+		retained++
+	}
+
+	return retained, nil
+}
+
+// Create the claim a volume of a failed sync is moved to. Syncs that fail
+// while creating their resources do not count as failed attempts, so the
+// name is bumped past the claims already retained for the same count.
+func (p K8sVMDIProvisioner) createRetainedClaim(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	volume *corev1.PersistentVolume,
+	retainUntil string,
+) (*corev1.PersistentVolumeClaim, error) {
+	for attempt := vmdi.Status.FailureCount; ; attempt++ {
+		retainedClaim := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-failed-%d", diskResourceName(vmdi, disk), attempt),
+				Namespace: vmdi.Namespace,
+				Labels: withDiskLabel(map[string]string{
+					crdv1.VMDiskImageFailedAttemptLabel: strconv.Itoa(vmdi.Status.FailureCount),
+				}, disk),
+				Annotations: map[string]string{
+					crdv1.VMDiskImageRetainedFromAnnotation: vmdi.Namespace + "/" + vmdi.Name,
+					crdv1.VMDiskImageRetainUntilAnnotation:  retainUntil,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      volume.Spec.AccessModes,
+				VolumeMode:       volume.Spec.VolumeMode,
+				StorageClassName: &volume.Spec.StorageClassName,
+				VolumeName:       volume.Name,
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: volume.Spec.Capacity[corev1.ResourceStorage],
+					},
+				},
+			},
+		}
+
+		err := p.Create(ctx, retainedClaim)
+		if apierrors.IsAlreadyExists(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return retainedClaim, nil
+	}
+}
+
+// The bound claim holding the data of a DataVolume. When CDI imports through
+// a volume populator the data is in a prime claim until the import finishes.
+func (p K8sVMDIProvisioner) claimHoldingData(
+	ctx context.Context,
+	namespace string,
+	name string,
+) (*corev1.PersistentVolumeClaim, error) {
+	claim := &corev1.PersistentVolumeClaim{}
+	err := p.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, claim)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the claim %s: %w", name, err)
+	}
+	if claim.Spec.VolumeName != "" {
+		return claim, nil
+	}
+
+	prime := &corev1.PersistentVolumeClaim{}
+	err = p.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "prime-" + string(claim.UID)}, prime)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the prime claim of %s: %w", name, err)
+	}
+	if prime.Spec.VolumeName == "" {
+		return nil, nil
+	}
+
+	return prime, nil
+}
+
+// FailedResourceReaper deletes the volumes kept from failed syncs once their
+// TTL has passed. It only runs on the leader.
+type FailedResourceReaper struct {
+	client.Client
+	Interval time.Duration
+}
+
+func (r *FailedResourceReaper) NeedLeaderElection() bool {
+	return true
+}
+
+func (r *FailedResourceReaper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			r.Reap(ctx)
+		}
+	}
+}
+
+// Reap deletes every retained volume whose TTL has passed.
+func (r *FailedResourceReaper) Reap(ctx context.Context) {
+	logger := logf.FromContext(ctx).WithName("failed-resource-reaper")
+
+	claims := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, claims, client.HasLabels{crdv1.VMDiskImageFailedAttemptLabel}); err != nil {
+		logger.Error(err, "Failed to list retained claims")
+		return
+	}
+
+	now := time.Now()
+	for _, claim := range claims.Items {
+		retainUntil, err := time.Parse(time.RFC3339, claim.Annotations[crdv1.VMDiskImageRetainUntilAnnotation])
+		if err != nil || now.Before(retainUntil) || !claim.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if err := r.Delete(ctx, &claim); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "Failed to delete a retained claim", "namespace", claim.Namespace, "name", claim.Name)
+			continue
+		}
+		logger.Info("Deleted a retained claim past its TTL", "namespace", claim.Namespace, "name", claim.Name)
+	}
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("RetainFailedResources", func() {
+	var vmdi *crdv1.VMDiskImage
+	var claim *corev1.PersistentVolumeClaim
+	var volume *corev1.PersistentVolume
+
+	BeforeEach(func() {
+		vmdi = &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default", UID: "vmdi-uid"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://example.com/disk.img", DiskSize: "1Gi"},
+				Debug:      &crdv1.VMDiskImageDebug{RetainFailedResources: true, TTL: &metav1.Duration{Duration: time.Hour}},
+			},
+			Status: crdv1.VMDiskImageStatus{FailureCount: 2},
+		}
+		claim = &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ubuntu",
+				Namespace: "default",
+				Labels: map[string]string{
+					crdv1.VMDiskImageNameLabel: "ubuntu",
+					crdv1.VMDiskImageUIDLabel:  "vmdi-uid",
+				},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "cdi.kubevirt.io/v1beta1",
+					Kind:       "DataVolume",
+					Name:       "ubuntu",
+					UID:        "dv-uid",
+					Controller: ptr.To(true),
+				}},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-ubuntu"},
+		}
+		volume = &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-ubuntu"},
+			Spec: corev1.PersistentVolumeSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				Capacity:         corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+				StorageClassName: "standard",
+				ClaimRef:         &corev1.ObjectReference{Namespace: "default", Name: "ubuntu", UID: "claim-uid"},
+			},
+		}
+	})
+
+	It("moves the volume holding the data to a claim named after the failed attempt", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient(claim, volume), ResourceGenerator: &Generator{}}
+
+		retained, err := provisioner.RetainFailedResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retained).To(Equal(1))
+
+		retainedClaim := &corev1.PersistentVolumeClaim{}
+		Expect(provisioner.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ubuntu-failed-2"}, retainedClaim)).To(Succeed())
+		Expect(retainedClaim.OwnerReferences).To(BeEmpty())
+		Expect(retainedClaim.Labels).To(Equal(map[string]string{crdv1.VMDiskImageFailedAttemptLabel: "2"}))
+		Expect(retainedClaim.Annotations).To(HaveKeyWithValue(crdv1.VMDiskImageRetainedFromAnnotation, "default/ubuntu"))
+		Expect(retainedClaim.Annotations).To(HaveKey(crdv1.VMDiskImageRetainUntilAnnotation))
+		Expect(retainedClaim.Spec.VolumeName).To(Equal("pv-ubuntu"))
+		Expect(retainedClaim.Spec.StorageClassName).To(HaveValue(Equal("standard")))
+
+		movedVolume := &corev1.PersistentVolume{}
+		Expect(provisioner.Get(ctx, client.ObjectKeyFromObject(volume), movedVolume)).To(Succeed())
+		Expect(movedVolume.Spec.ClaimRef).To(And(
+			HaveField("Namespace", "default"),
+			HaveField("Name", "ubuntu-failed-2"),
+			HaveField("UID", BeEmpty()),
+		))
+
+		By("Leaving it out of the resources the teardown deletes")
+		remaining, err := provisioner.RemainingResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remaining).To(ConsistOf(HaveField("ObjectMeta.Name", "ubuntu")))
+	})
+
+	It("lets the next attempt import the disk while the retained claim exists", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient(vmdi, claim, volume), ResourceGenerator: &Generator{}}
+
+		_, err := provisioner.RetainFailedResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(provisioner.TearDownAllResources(ctx, vmdi)).To(Succeed())
+
+		Expect(provisioner.Preflight(ctx, vmdi)).To(Succeed())
+		Expect(provisioner.CreateResources(ctx, vmdi)).To(Succeed())
+		Expect(provisioner.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ubuntu"}, &cdiv1beta1.DataVolume{})).To(Succeed())
+		Expect(provisioner.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ubuntu-failed-2"}, &corev1.PersistentVolumeClaim{})).To(Succeed())
+	})
+
+	It("does not reuse the claim of an attempt that was already retained", func(ctx SpecContext) {
+		earlier := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-failed-2", Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-earlier"},
+		}
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient(claim, volume, earlier), ResourceGenerator: &Generator{}}
+
+		_, err := provisioner.RetainFailedResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+
+		retainedClaim := &corev1.PersistentVolumeClaim{}
+		Expect(provisioner.Get(ctx, client.ObjectKey{Namespace: "default", Name: "ubuntu-failed-3"}, retainedClaim)).To(Succeed())
+		Expect(retainedClaim.Spec.VolumeName).To(Equal("pv-ubuntu"))
+	})
+
+	It("keeps nothing unless asked to", func(ctx SpecContext) {
+		vmdi.Spec.Debug = nil
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient(claim)}
+
+		retained, err := provisioner.RetainFailedResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retained).To(BeZero())
+	})
+})
+
+var _ = Describe("FailedResourceReaper", func() {
+	retainedClaim := func(name string, retainUntil time.Time) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{crdv1.VMDiskImageFailedAttemptLabel: "1"},
+				Annotations: map[string]string{crdv1.VMDiskImageRetainUntilAnnotation: retainUntil.UTC().Format(time.RFC3339)},
+			},
+		}
+	}
+
+	It("deletes the retained claims past their TTL", func(ctx SpecContext) {
+		expired := retainedClaim("expired", time.Now().Add(-time.Minute))
+		kept := retainedClaim("kept", time.Now().Add(time.Hour))
+		reaper := &FailedResourceReaper{Client: newFakeClient(expired, kept)}
+
+		reaper.Reap(ctx)
+
+		Expect(apierrors.IsNotFound(reaper.Get(ctx, client.ObjectKeyFromObject(expired), &corev1.PersistentVolumeClaim{}))).To(BeTrue())
+		Expect(reaper.Get(ctx, client.ObjectKeyFromObject(kept), &corev1.PersistentVolumeClaim{})).To(Succeed())
+	})
+})
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// How many log lines of each importer pod are kept.
+const diagnosticsLogLines = 200
+
+// DiagnosticsReader reads what the API server knows about pods beyond their
+// objects, which the controller-runtime client cannot.
+type DiagnosticsReader interface {
+	PodLogs(ctx context.Context, namespace string, name string, tailLines int64) (string, error)
+	Events(ctx context.Context, namespace string, involvedObjectName string) ([]corev1.Event, error)
+}
+
+// ClientsetDiagnosticsReader reads diagnostics through a client-go clientset.
+type ClientsetDiagnosticsReader struct {
+	kubernetes.Interface
+}
+
+func (r ClientsetDiagnosticsReader) PodLogs(ctx context.Context, namespace string, name string, tailLines int64) (string, error) {
+	stream, err := r.CoreV1().Pods(namespace).GetLogs(name, &corev1.PodLogOptions{TailLines: &tailLines}).Stream(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = stream.Close() }()
+
+	logs, err := io.ReadAll(stream)
+	return string(logs), err
+}
+
+func (r ClientsetDiagnosticsReader) Events(ctx context.Context, namespace string, involvedObjectName string) ([]corev1.Event, error) {
+	events, err := r.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("involvedObject.name", involvedObjectName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events.Items, nil
+}
+
+// Save what explains a failed sync before its resources are torn down: the
+// tail of the importer pod logs, their termination messages and the recent
+// Events of the disks' resources. They are kept in a ConfigMap owned by the
+// VMDiskImage, of which only the most recent ones are retained. Returns the
+// name of the ConfigMap.
+func (p K8sVMDIProvisioner) CollectFailureDiagnostics(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	failure error,
+) (string, error) {
+	if p.Diagnostics == nil || p.RetainedFailureDiagnostics <= 0 {
+		return "", nil
+	}
+	logger := logf.FromContext(ctx)
+
+	now := time.Now()
+	data := map[string]string{
+		"error":        failure.Error(),
+		"time":         now.UTC().Format(time.RFC3339),
+		"failureCount": strconv.Itoa(vmdi.Status.FailureCount),
+	}
+
+	dataVolumes, err := p.getDataVolumesByName(ctx, vmdi)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range slices.Sorted(maps.Keys(dataVolumes)) {
+		involved := []string{name}
+
+		for _, pod := range p.importerPods(ctx, vmdi, name) {
+			involved = append(involved, pod.Name)
+
+			logs, err := p.Diagnostics.PodLogs(ctx, pod.Namespace, pod.Name, diagnosticsLogLines)
+			if err != nil {
+				logger.Error(err, "Failed to read the importer pod logs", "pod", pod.Name)
+				logs = "failed to read the logs: " + err.Error()
+			}
+			data[pod.Name+".log"] = logs
+
+			if message := terminationMessage(pod); message != "" {
+				data[pod.Name+".termination-message"] = message
+			}
+		}
+
+		var events []corev1.Event
+		for _, involvedName := range involved {
+			found, err := p.Diagnostics.Events(ctx, vmdi.Namespace, involvedName)
+			if err != nil {
+				logger.Error(err, "Failed to list the events of a resource", "name", involvedName)
+				continue
+			}
+			events = append(events, found...)
+		}
+		if len(events) > 0 {
+			data[name+".events"] = formatEvents(events)
+		}
+	}
+
+	configMap := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			// Creation failures do not count towards the failure count so
+			// the name is keyed on the time of the failure
+			Name:            fmt.Sprintf("%s-failure-%d", vmdi.Name, now.Unix()),
+			Namespace:       vmdi.Namespace,
+			Labels:          withDiagnosticsLabel(withOperatorLabels(nil, vmdi)),
+			OwnerReferences: createOwnerReferences(vmdi),
+		},
+		Data: limitDataSize(data, p.FailureDiagnosticsMaxBytes),
+	}
+	err = p.Patch(ctx, configMap, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+	if err != nil {
+		return "", fmt.Errorf("failed to save the failure diagnostics: %w", err)
+	}
+
+	if err := p.pruneFailureDiagnostics(ctx, vmdi); err != nil {
+		logger.Error(err, "Failed to prune old failure diagnostics")
+	}
+
+	return configMap.Name, nil
+}
+
+// The pods CDI imports a DataVolume with. They are named after the PVC or,
+// when CDI uses volume populators, after the UID of the PVC.
+func (p K8sVMDIProvisioner) importerPods(ctx context.Context, vmdi *crdv1.VMDiskImage, claimName string) []corev1.Pod {
+	names := []string{"importer-" + claimName}
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: claimName}, claim); err == nil {
+		names = append(names, "importer-prime-"+string(claim.UID))
+	}
+
+	var pods []corev1.Pod
+	for _, name := range names {
+		pod := &corev1.Pod{}
+		if err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: name}, pod); err == nil {
+			pods = append(pods, *pod)
+		}
+	}
+
+	return pods
+}
+
+func terminationMessage(pod corev1.Pod) string {
+	var messages []string
+	for _, status := range pod.Status.ContainerStatuses {
+		for _, state := range []corev1.ContainerState{status.State, status.LastTerminationState} {
+			if state.Terminated != nil && state.Terminated.Message != "" {
+				messages = append(messages, status.Name+": "+state.Terminated.Message)
+			}
+		}
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+func formatEvents(events []corev1.Event) string {
+	slices.SortFunc(events, func(a, b corev1.Event) int {
+		return eventTime(a).Compare(eventTime(b))
+	})
+
+	lines := make([]string, 0, len(events))
+	for _, event := range events {
+		lines = append(lines, fmt.Sprintf(
+			"%s %s %s/%s %s: %s",
+			eventTime(event).UTC().Format(time.RFC3339), event.Type,
+			event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Reason, event.Message,
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func eventTime(event corev1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+
+	return event.CreationTimestamp.Time
+}
+
+// Trim the largest values until the data fits, keeping the end of each value
+// since that is where logs explain failures.
+func limitDataSize(data map[string]string, maxBytes int) map[string]string {
+	if maxBytes <= 0 {
+		return data
+	}
+
+	const marker = "[truncated]\n"
+	size := 0
+	for key, value := range data {
+		size += len(key) + len(value)
+	}
+	for size > maxBytes {
+		largest := slices.MaxFunc(slices.Collect(maps.Keys(data)), func(a, b string) int {
+			return cmp.Compare(len(data[a]), len(data[b]))
+		})
+		value := data[largest]
+		keep := max(len(value)-(size-maxBytes)-len(marker), 0)
+		if keep == 0 && len(value) <= len(marker) {
+			break
+		}
+		data[largest] = marker + value[len(value)-keep:]
+		size -= len(value) - len(data[largest])
+	}
+
+	return data
+}
+
+// Delete all but the most recent failure diagnostics of a VMDiskImage.
+func (p K8sVMDIProvisioner) pruneFailureDiagnostics(ctx context.Context, vmdi *crdv1.VMDiskImage) error {
+	configMaps := &corev1.ConfigMapList{}
+	err := p.List(ctx, configMaps,
+		client.InNamespace(vmdi.Namespace),
+		getLabelsToMatch(vmdi),
+		client.HasLabels{crdv1.VMDiskImageDiagnosticsLabel},
+	)
+	if err != nil {
+		return err
+	}
+	if len(configMaps.Items) <= p.RetainedFailureDiagnostics {
+		return nil
+	}
+
+	slices.SortFunc(configMaps.Items, func(a, b corev1.ConfigMap) int {
+		return cmp.Or(
+			b.CreationTimestamp.Compare(a.CreationTimestamp.Time),
+			cmp.Compare(b.Name, a.Name),
+		)
+	})
+	for _, configMap := range configMaps.Items[p.RetainedFailureDiagnostics:] {
+		if err := p.Delete(ctx, &configMap); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func withDiagnosticsLabel(labels map[string]string) map[string]string {
+	labels[crdv1.VMDiskImageDiagnosticsLabel] = "true"
+	return labels
+}
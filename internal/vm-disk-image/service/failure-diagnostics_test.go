@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Serves fixed logs and Events instead of asking the API server.
+type fakeDiagnosticsReader struct {
+	logs   map[string]string
+	events map[string][]corev1.Event
+}
+
+func (r fakeDiagnosticsReader) PodLogs(_ context.Context, _ string, name string, _ int64) (string, error) {
+	logs, found := r.logs[name]
+	if !found {
+		return "", errors.New("no logs")
+	}
+	return logs, nil
+}
+
+func (r fakeDiagnosticsReader) Events(_ context.Context, _ string, name string) ([]corev1.Event, error) {
+	return r.events[name], nil
+}
+
+var _ = Describe("limitDataSize", func() {
+	It("leaves data that fits alone", func() {
+		data := map[string]string{"error": "boom", "pod.log": "line"}
+
+		Expect(limitDataSize(data, 100)).To(Equal(map[string]string{"error": "boom", "pod.log": "line"}))
+		Expect(limitDataSize(data, 0)).To(Equal(data))
+	})
+
+	It("trims the start of the largest values until the data fits", func() {
+		data := map[string]string{
+			"error":   "boom",
+			"pod.log": strings.Repeat("a", 500) + "the end",
+		}
+
+		limited := limitDataSize(data, 100)
+
+		size := 0
+		for key, value := range limited {
+			size += len(key) + len(value)
+		}
+		Expect(size).To(BeNumerically("<=", 100))
+		Expect(limited["error"]).To(Equal("boom"))
+		Expect(limited["pod.log"]).To(HavePrefix("[truncated]\n"))
+		Expect(limited["pod.log"]).To(HaveSuffix("the end"))
+	})
+
+	It("gives up once every value is as small as the marker", func() {
+		data := map[string]string{"a": "1234", "b": "5678"}
+
+		Expect(limitDataSize(data, 1)).To(HaveLen(2))
+	})
+})
+
+var _ = Describe("failure diagnostics", func() {
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "uid-1"},
+		Spec: crdv1.VMDiskImageSpec{
+			VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://example.com/disk.img"},
+		},
+		Status: crdv1.VMDiskImageStatus{FailureCount: 2},
+	}
+
+	diagnostics := func(name string, vmdi *crdv1.VMDiskImage, age time.Duration) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         vmdi.Namespace,
+			Labels:            withDiagnosticsLabel(withOperatorLabels(nil, vmdi)),
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		}}
+	}
+	listDiagnostics := func(ctx context.Context, c client.Client) []string {
+		configMaps := &corev1.ConfigMapList{}
+		Expect(c.List(ctx, configMaps, client.InNamespace(vmdi.Namespace))).To(Succeed())
+
+		var names []string
+		for _, configMap := range configMaps.Items {
+			names = append(names, configMap.Name)
+		}
+		return names
+	}
+
+	It("keeps only the most recent diagnostics of a VMDiskImage", func(ctx SpecContext) {
+		other := vmdi.DeepCopy()
+		other.Name, other.UID = "debian", "uid-2"
+		c := newFakeClient(
+			diagnostics("ubuntu-failure-1", vmdi, 3*time.Hour),
+			diagnostics("ubuntu-failure-2", vmdi, 2*time.Hour),
+			diagnostics("ubuntu-failure-3", vmdi, time.Hour),
+			diagnostics("debian-failure-1", other, 4*time.Hour),
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: vmdi.Namespace}},
+		)
+		provisioner := K8sVMDIProvisioner{Client: c, RetainedFailureDiagnostics: 2}
+
+		Expect(provisioner.pruneFailureDiagnostics(ctx, vmdi)).To(Succeed())
+		Expect(listDiagnostics(ctx, c)).To(ConsistOf("ubuntu-failure-2", "ubuntu-failure-3", "debian-failure-1", "unrelated"))
+	})
+
+	It("saves the importer logs, termination messages and Events of a failed sync", func(ctx SpecContext) {
+		claimName := diskResourceName(vmdi, vmdi.Spec.GetDisks()[0])
+		c := newFakeClient(
+			diagnostics("ubuntu-failure-1", vmdi, time.Hour),
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "importer-" + claimName, Namespace: vmdi.Namespace},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "importer",
+					State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: "Unable to connect"}},
+				}}},
+			},
+			&cdiv1beta1.DataVolume{ObjectMeta: metav1.ObjectMeta{
+				Name:      claimName,
+				Namespace: vmdi.Namespace,
+				Labels:    withOperatorLabels(nil, vmdi),
+			}},
+		)
+		provisioner := K8sVMDIProvisioner{
+			Client: c,
+			Diagnostics: fakeDiagnosticsReader{
+				logs: map[string]string{"importer-" + claimName: "connection refused"},
+				events: map[string][]corev1.Event{claimName: {{
+					InvolvedObject: corev1.ObjectReference{Kind: "DataVolume", Name: claimName},
+					Type:           "Warning",
+					Reason:         "Error",
+					Message:        "Unable to connect to http data source",
+				}}},
+			},
+			RetainedFailureDiagnostics: 2,
+		}
+
+		name, err := provisioner.CollectFailureDiagnostics(ctx, vmdi, errors.New("the sync failed"))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(HavePrefix("ubuntu-failure-"))
+		Expect(listDiagnostics(ctx, c)).To(ConsistOf("ubuntu-failure-1", name))
+
+		configMap := &corev1.ConfigMap{}
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: name}, configMap)).To(Succeed())
+		Expect(configMap.Data).To(HaveKeyWithValue("error", "the sync failed"))
+		Expect(configMap.Data).To(HaveKeyWithValue("failureCount", "2"))
+		Expect(configMap.Data).To(HaveKeyWithValue("importer-"+claimName+".log", "connection refused"))
+		Expect(configMap.Data).To(HaveKeyWithValue("importer-"+claimName+".termination-message", "importer: Unable to connect"))
+		Expect(configMap.Data).To(HaveKeyWithValue(claimName+".events", ContainSubstring("Warning DataVolume/"+claimName+" Error")))
+	})
+})
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	uploadv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/upload/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var ErrImportFailed = errors.New("the import of the source artifact failed")
+
+// How the import job tells cmd/disk-importer where to upload the artifact it
+// downloads. The source is described like for the checksum verifier.
+const (
+	// Bits per second, e.g. "500M".
+	ImportBandwidthLimitEnv = "BANDWIDTH_LIMIT"
+	ImportUploadProxyURLEnv = "UPLOAD_PROXY_URL"
+	// Where the upload secret of the job is mounted.
+	ImportUploadDir      = "/etc/disk-importer/upload"
+	ImportUploadTokenKey = "token"
+	ImportUploadCAKey    = "ca.crt"
+	DiskImporterBinary   = "/disk-importer"
+)
+
+// When the token of an upload secret was issued.
+const uploadTokenIssuedAnnotation = "vmdiskimage.pelotech.ot/upload-token-issued"
+
+// Upload tokens are only valid for 5 minutes and are checked when an upload
+// starts, so the token of an import job is reissued this often until the job
+// is done. Kubelet takes up to about a minute and a half to update the
+// mounted secret.
+const uploadTokenRefreshInterval = time.Minute
+
+// The key of CDI's signer bundles holding the CA certificates.
+const caBundleKey = "ca-bundle.crt"
+
+// UploadTokenIssuer hands out the tokens CDI's upload proxy accepts uploads to
+// a PVC with.
+type UploadTokenIssuer interface {
+	IssueUploadToken(ctx context.Context, namespace string, claimName string) (string, error)
+}
+
+// CDIUploadTokenIssuer requests upload tokens from CDI's API server.
+type CDIUploadTokenIssuer struct {
+	client.Client
+}
+
+func (i CDIUploadTokenIssuer) IssueUploadToken(ctx context.Context, namespace string, claimName string) (string, error) {
+	request := &uploadv1beta1.UploadTokenRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claimName,
+			Namespace: namespace,
+		},
+		Spec: uploadv1beta1.UploadTokenRequestSpec{
+			PvcName: claimName,
+		},
+	}
+	if err := i.Create(ctx, request); err != nil {
+		return "", fmt.Errorf("failed to request an upload token for %s/%s: %w", namespace, claimName, err)
+	}
+	if request.Status.Token == "" {
+		return "", fmt.Errorf("CDI issued no upload token for %s/%s", namespace, claimName)
+	}
+
+	return request.Status.Token, nil
+}
+
+// Start the import jobs of the disks whose DataVolume is waiting for their
+// upload and keep the upload tokens of the jobs fresh until they are done.
+// The DataVolumes decide since the placement of a VMDiskImage can change
+// while it syncs.
+func (p K8sVMDIProvisioner) runImportJobs(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	dataVolumes map[string]cdiv1beta1.DataVolume,
+) error {
+	for _, disk := range vmdi.Spec.GetDisks() {
+		dv, found := dataVolumes[diskResourceName(vmdi, disk)]
+		if !found || dv.Spec.Source == nil || dv.Spec.Source.Upload == nil || !isDownloadSource(disk) {
+			continue
+		}
+		// importErrors fails the sync of disks that cannot be imported
+		if !p.ImportJobs {
+			return nil
+		}
+
+		// The upload server accepts the data once CDI has started it
+		if dv.Status.Phase != cdiv1beta1.UploadReady {
+			continue
+		}
+
+		job := &batchv1.Job{}
+		err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: importJobName(vmdi, disk)}, job)
+		if apierrors.IsNotFound(err) {
+			job = p.ResourceGenerator.CreateImportJobManifest(vmdi, disk)
+			err = p.Patch(ctx, job, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create the import job of the disk %s: %w", disk.Name, err)
+		}
+		if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+			continue
+		}
+
+		if err := p.refreshUploadSecret(ctx, job, dv.Name); err != nil {
+			return fmt.Errorf("failed to refresh the upload token of the disk %s: %w", disk.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Issue a new upload token to an import job once its current one gets old.
+func (p K8sVMDIProvisioner) refreshUploadSecret(ctx context.Context, job *batchv1.Job, claimName string) error {
+	secret := &corev1.Secret{}
+	err := p.Get(ctx, client.ObjectKeyFromObject(job), secret)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	if err == nil {
+		issued, err := time.Parse(time.RFC3339, secret.Annotations[uploadTokenIssuedAnnotation])
+		if err == nil && time.Since(issued) < uploadTokenRefreshInterval {
+			return nil
+		}
+	}
+
+	token, err := p.UploadTokens.IssueUploadToken(ctx, job.Namespace, claimName)
+	if err != nil {
+		return err
+	}
+
+	caBundle, err := p.uploadProxyCABundle(ctx)
+	if err != nil {
+		return err
+	}
+
+	secret = p.ResourceGenerator.CreateUploadSecretManifest(job, token, caBundle)
+	return p.Patch(ctx, secret, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+}
+
+// The CA certificates of CDI's upload proxy. Proxies whose certificate the
+// system trusts need none.
+func (p K8sVMDIProvisioner) uploadProxyCABundle(ctx context.Context) ([]byte, error) {
+	if p.UploadProxyCABundle.Name == "" {
+		return nil, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := p.Get(ctx, p.UploadProxyCABundle, configMap)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the CA bundle of the upload proxy: %w", err)
+	}
+
+	return []byte(configMap.Data[caBundleKey]), nil
+}
+
+// Surface the import jobs that failed.
+func (p K8sVMDIProvisioner) importErrors(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if !isDownloadSource(disk) {
+			continue
+		}
+		if !p.ImportJobs && p.ResourceGenerator.UsesImportJob(vmdi, disk) {
+			return fmt.Errorf("%w: no disk importer image is configured", ErrImportFailed)
+		}
+
+		job := &batchv1.Job{}
+		err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: importJobName(vmdi, disk)}, job)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if job.Status.Failed == 0 {
+			continue
+		}
+
+		message, err := p.jobTerminationMessage(ctx, job)
+		if err != nil {
+			return err
+		}
+		// The importer reports artifacts that are gone like the probe does
+		if strings.Contains(message, ErrMissingSourceArtifact.Error()) {
+			return fmt.Errorf("%w: %s", ErrMissingSourceArtifact, message)
+		}
+
+		return fmt.Errorf("%w: the import job of the disk %s failed: %s", ErrImportFailed, disk.Name, message)
+	}
+
+	return nil
+}
+
+// The termination message the pod of a finished job left.
+func (p K8sVMDIProvisioner) jobTerminationMessage(ctx context.Context, job *batchv1.Job) (string, error) {
+	podList := &corev1.PodList{}
+	err := p.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{batchv1.JobNameLabel: job.Name})
+	if err != nil {
+		return "", fmt.Errorf("failed to list the pods of the job %s: %w", job.Name, err)
+	}
+
+	for _, pod := range podList.Items {
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			if terminated := containerStatus.State.Terminated; terminated != nil && terminated.Message != "" {
+				return strings.TrimSpace(terminated.Message), nil
+			}
+		}
+	}
+
+	return "unknown error", nil
+}
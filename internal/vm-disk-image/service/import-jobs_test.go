@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Hands out numbered tokens.
+type fakeUploadTokenIssuer struct {
+	issued *int
+}
+
+func (i fakeUploadTokenIssuer) IssueUploadToken(_ context.Context, _ string, _ string) (string, error) {
+	*i.issued++
+	return fmt.Sprintf("token-%d", *i.issued), nil
+}
+
+var _ = Describe("Import jobs", func() {
+	var (
+		k8sClient   client.Client
+		provisioner K8sVMDIProvisioner
+		issued      int
+	)
+
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "vmdi-uid"},
+		Spec: crdv1.VMDiskImageSpec{
+			VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://example.com/disk.img", DiskSize: "1Gi"},
+		},
+		Status: crdv1.VMDiskImageStatus{BandwidthLimit: "100M"},
+	}
+	disk := vmdi.Spec.GetDisks()[0]
+	caBundle := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cdi-uploadproxy-signer-bundle", Namespace: "cdi"},
+		Data:       map[string]string{caBundleKey: "proxy-ca"},
+	}
+
+	dataVolumeIn := func(phase cdiv1beta1.DataVolumePhase) map[string]cdiv1beta1.DataVolume {
+		return map[string]cdiv1beta1.DataVolume{
+			"ubuntu": {
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+				Spec: cdiv1beta1.DataVolumeSpec{
+					Source: &cdiv1beta1.DataVolumeSource{Upload: &cdiv1beta1.DataVolumeSourceUpload{}},
+				},
+				Status: cdiv1beta1.DataVolumeStatus{Phase: phase},
+			},
+		}
+	}
+
+	newProvisioner := func(objects ...client.Object) {
+		issued = 0
+		k8sClient = newFakeClient(append(objects, caBundle)...)
+		provisioner = K8sVMDIProvisioner{
+			Client:              k8sClient,
+			ResourceGenerator:   &Generator{DiskImporterImage: "operator:v1"},
+			ImportJobs:          true,
+			UploadTokens:        fakeUploadTokenIssuer{issued: &issued},
+			UploadProxyCABundle: types.NamespacedName{Namespace: "cdi", Name: "cdi-uploadproxy-signer-bundle"},
+		}
+	}
+
+	getUploadSecret := func(ctx SpecContext) *corev1.Secret {
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "images", Name: "ubuntu-import"}, secret)).To(Succeed())
+		return secret
+	}
+
+	// An import job and its upload secret issued the given time ago.
+	existingJob := func(status batchv1.JobStatus, issuedAgo time.Duration) (*batchv1.Job, *corev1.Secret) {
+		job := (&Generator{}).CreateImportJobManifest(vmdi, disk)
+		job.TypeMeta = metav1.TypeMeta{}
+		job.Status = status
+		secret := (&Generator{}).CreateUploadSecretManifest(job, "token-0", nil)
+		secret.TypeMeta = metav1.TypeMeta{}
+		secret.Annotations[uploadTokenIssuedAnnotation] = time.Now().Add(-issuedAgo).UTC().Format(time.RFC3339)
+		return job, secret
+	}
+
+	It("waits for the upload server before starting the import job", func(ctx SpecContext) {
+		newProvisioner()
+
+		Expect(provisioner.runImportJobs(ctx, vmdi, dataVolumeIn(cdiv1beta1.UploadScheduled))).To(Succeed())
+
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "images", Name: "ubuntu-import"}, &batchv1.Job{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(issued).To(BeZero())
+	})
+
+	It("starts the import job with an upload token", func(ctx SpecContext) {
+		newProvisioner()
+
+		Expect(provisioner.runImportJobs(ctx, vmdi, dataVolumeIn(cdiv1beta1.UploadReady))).To(Succeed())
+
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "images", Name: "ubuntu-import"}, job)).To(Succeed())
+		Expect(job.Spec.Template.Annotations).To(HaveKeyWithValue(ingressBandwidthAnnotation, "100M"))
+		Expect(job.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: ImportBandwidthLimitEnv, Value: "100M"}))
+
+		secret := getUploadSecret(ctx)
+		Expect(secret.Data).To(HaveKeyWithValue(ImportUploadTokenKey, []byte("token-1")))
+		Expect(secret.Data).To(HaveKeyWithValue(ImportUploadCAKey, []byte("proxy-ca")))
+		Expect(secret.OwnerReferences).To(ContainElement(HaveField("Name", "ubuntu-import")))
+	})
+
+	It("reissues upload tokens once they get old", func(ctx SpecContext) {
+		job, secret := existingJob(batchv1.JobStatus{Active: 1}, 2*time.Minute)
+		newProvisioner(job, secret)
+
+		Expect(provisioner.runImportJobs(ctx, vmdi, dataVolumeIn(cdiv1beta1.UploadReady))).To(Succeed())
+		Expect(getUploadSecret(ctx).Data).To(HaveKeyWithValue(ImportUploadTokenKey, []byte("token-1")))
+
+		Expect(provisioner.runImportJobs(ctx, vmdi, dataVolumeIn(cdiv1beta1.UploadReady))).To(Succeed())
+		Expect(issued).To(Equal(1))
+	})
+
+	It("leaves the tokens of finished jobs alone", func(ctx SpecContext) {
+		job, secret := existingJob(batchv1.JobStatus{Succeeded: 1}, 2*time.Minute)
+		newProvisioner(job, secret)
+
+		Expect(provisioner.runImportJobs(ctx, vmdi, dataVolumeIn(cdiv1beta1.UploadReady))).To(Succeed())
+		Expect(issued).To(BeZero())
+	})
+
+	Context("when a job fails", func() {
+		failedJob := func(message string) []client.Object {
+			job, _ := existingJob(batchv1.JobStatus{Failed: 1}, 0)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      job.Name + "-x",
+					Namespace: job.Namespace,
+					Labels:    map[string]string{batchv1.JobNameLabel: job.Name},
+				},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+					State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Message: message}},
+				}}},
+			}
+			return []client.Object{job, pod}
+		}
+
+		It("fails the import with the message of its pod", func(ctx SpecContext) {
+			newProvisioner(failedJob("the upload proxy returned 401 Unauthorized")...)
+
+			err := provisioner.importErrors(ctx, vmdi)
+			Expect(err).To(MatchError(ErrImportFailed))
+			Expect(err).To(MatchError(ContainSubstring("401 Unauthorized")))
+		})
+
+		It("reports artifacts that are gone", func(ctx SpecContext) {
+			newProvisioner(failedJob(ErrMissingSourceArtifact.Error() + ": https://example.com/disk.img returned 404 Not Found")...)
+
+			Expect(provisioner.importErrors(ctx, vmdi)).To(MatchError(ErrMissingSourceArtifact))
+		})
+	})
+
+	It("fails limited disks when there is no importer", func(ctx SpecContext) {
+		newProvisioner()
+		provisioner.ImportJobs = false
+
+		Expect(provisioner.runImportJobs(ctx, vmdi, dataVolumeIn(cdiv1beta1.UploadReady))).To(Succeed())
+		Expect(provisioner.importErrors(ctx, vmdi)).To(MatchError(ErrImportFailed))
+	})
+})
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	coreconfig "pelotech/data-sync-operator/internal/core/config"
+)
+
+// SourceRequestFromEnv reads the source artifact a checksum or import job was
+// given from its environment and mounted files. It is how cmd/checksum-verifier
+// and cmd/disk-importer learn what to download.
+func SourceRequestFromEnv() (SourceProbeRequest, error) {
+	request := SourceProbeRequest{
+		SourceType: coreconfig.GetStringEnvOrDefault(ChecksumSourceTypeEnv, ""),
+		URL:        coreconfig.GetStringEnvOrDefault(ChecksumSourceURLEnv, ""),
+		ETag:       coreconfig.GetStringEnvOrDefault(ChecksumSourceETagEnv, ""),
+	}
+
+	accessKey, hasAccessKey := os.LookupEnv(ChecksumAccessKeyEnv)
+	secretKey, hasSecretKey := os.LookupEnv(ChecksumSecretKeyEnv)
+	if hasAccessKey || hasSecretKey {
+		request.Credentials = &RegistryCredentials{Username: accessKey, Password: secretKey}
+	}
+
+	certs, err := ReadMountedFiles(ChecksumCertsDir)
+	if err != nil {
+		return SourceProbeRequest{}, fmt.Errorf("failed to read the CA bundle: %w", err)
+	}
+	for _, cert := range certs {
+		request.CABundle = append(request.CABundle, []byte(cert+"\n")...)
+	}
+
+	headerLines := strings.Split(coreconfig.GetStringEnvOrDefault(ChecksumExtraHeadersEnv, ""), "\n")
+	secretHeaders, err := ReadMountedFiles(ChecksumHeadersDir)
+	if err != nil {
+		return SourceProbeRequest{}, fmt.Errorf("failed to read the header secrets: %w", err)
+	}
+	request.Headers = ParseHeaderLines(append(headerLines, secretHeaders...))
+
+	return request, nil
+}
+
+// ReadMountedFiles returns the contents of the files mounted under a
+// directory, in the order of their paths. The hidden files and directories of
+// projected volumes are skipped. A directory that does not exist holds
+// nothing.
+func ReadMountedFiles(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), "..") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+
+	contents := make([]string, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, string(content))
+	}
+
+	return contents, nil
+}
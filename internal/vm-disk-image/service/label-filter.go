@@ -0,0 +1,36 @@
+package service
+
+import (
+	"path"
+	"slices"
+)
+
+// LabelFilter decides which labels of a VMDiskImage are copied to its child
+// resources. Patterns are matched against label keys with path.Match, e.g.
+// "argocd.argoproj.io/*".
+type LabelFilter struct {
+	// Only labels matching one of these are copied. Every label is when empty.
+	Include []string
+	// Labels matching one of these are never copied.
+	Exclude []string
+}
+
+// Filter returns a new map holding the labels that are copied.
+func (f LabelFilter) Filter(labels map[string]string) map[string]string {
+	filtered := map[string]string{}
+	for key, value := range labels {
+		included := len(f.Include) == 0 || slices.ContainsFunc(f.Include, matchesKey(key))
+		if included && !slices.ContainsFunc(f.Exclude, matchesKey(key)) {
+			filtered[key] = value
+		}
+	}
+
+	return filtered
+}
+
+func matchesKey(key string) func(string) bool {
+	return func(pattern string) bool {
+		matched, err := path.Match(pattern, key)
+		return err == nil && matched
+	}
+}
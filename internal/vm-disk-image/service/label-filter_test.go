@@ -0,0 +1,57 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("LabelFilter", func() {
+	labels := map[string]string{
+		"team":                                  "vdi",
+		"app.kubernetes.io/name":                "ubuntu",
+		"app.kubernetes.io/instance":            "images",
+		"argocd.argoproj.io/instance":           "images",
+		"kustomize.toolkit.fluxcd.io/name":      "images",
+		"kustomize.toolkit.fluxcd.io/namespace": "flux-system",
+	}
+
+	DescribeTable("copies the labels that are included and not excluded",
+		func(filter LabelFilter, expected []string) {
+			filtered := filter.Filter(labels)
+
+			keys := make([]string, 0, len(filtered))
+			for key, value := range filtered {
+				Expect(value).To(Equal(labels[key]))
+				keys = append(keys, key)
+			}
+			Expect(keys).To(ConsistOf(expected))
+		},
+		Entry("everything without patterns", LabelFilter{},
+			[]string{"team", "app.kubernetes.io/name", "app.kubernetes.io/instance", "argocd.argoproj.io/instance", "kustomize.toolkit.fluxcd.io/name", "kustomize.toolkit.fluxcd.io/namespace"}),
+		Entry("only included labels", LabelFilter{Include: []string{"team", "app.kubernetes.io/*"}},
+			[]string{"team", "app.kubernetes.io/name", "app.kubernetes.io/instance"}),
+		Entry("everything but excluded labels", LabelFilter{Exclude: []string{"app.kubernetes.io/instance", "argocd.argoproj.io/*", "kustomize.toolkit.fluxcd.io/*"}},
+			[]string{"team", "app.kubernetes.io/name"}),
+		Entry("exclusions over inclusions", LabelFilter{Include: []string{"app.kubernetes.io/*"}, Exclude: []string{"app.kubernetes.io/instance"}},
+			[]string{"app.kubernetes.io/name"}),
+		Entry("nothing for invalid patterns", LabelFilter{Include: []string{"[team"}},
+			[]string{}),
+	)
+
+	It("never lets a filtered label replace the labels the operator manages", func() {
+		vmdi := &crdv1.VMDiskImage{ObjectMeta: metav1.ObjectMeta{
+			Name:   "ubuntu",
+			UID:    "uid-1",
+			Labels: map[string]string{crdv1.VMDiskImageNameLabel: "spoofed", "team": "vdi"},
+		}}
+
+		childLabels := (&Generator{}).childLabels(vmdi)
+
+		Expect(childLabels).To(HaveKeyWithValue(crdv1.VMDiskImageNameLabel, "ubuntu"))
+		Expect(childLabels).To(HaveKeyWithValue(crdv1.VMDiskImageUIDLabel, "uid-1"))
+		Expect(childLabels).To(HaveKeyWithValue("team", "vdi"))
+	})
+})
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// LegacyLabelMigrator moves child resources created before the switch to the
+// name and UID labels over to them, so they keep being found by their
+// VMDiskImage. The unprefixed disk and source namespace labels are moved
+// under the operator's prefix along the way. It runs once on the leader and
+// retries until it succeeds.
+type LegacyLabelMigrator struct {
+	client.Client
+	VolumeGroupSnapshotsAvailable bool
+
+	done atomic.Bool
+}
+
+func (m *LegacyLabelMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+func (m *LegacyLabelMigrator) Start(ctx context.Context) error {
+	logger := logf.FromContext(ctx).WithName("label-migration")
+
+	for {
+		err := m.Migrate(ctx)
+		if err == nil {
+			m.done.Store(true)
+			return nil
+		}
+		logger.Error(err, "Failed to migrate the labels of child resources. Retrying...")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// Whether every child resource carries the name and UID labels. Until then
+// the child resources of a VMDiskImage are also found by the legacy label.
+func (m *LegacyLabelMigrator) Done() bool {
+	return m.done.Load()
+}
+
+// The unprefixed labels of child resources and the labels replacing them.
+var legacyLabels = map[string]string{
+	crdv1.VMDiskImageLegacyDiskLabel:            crdv1.VMDiskImageDiskLabel,
+	crdv1.VMDiskImageLegacySourceNamespaceLabel: crdv1.VMDiskImageSourceNamespaceLabel,
+}
+
+// Migrate relabels every child resource that still carries the legacy owner
+// label or one of the unprefixed labels. Resources whose VMDiskImage is gone
+// are left alone.
+func (m *LegacyLabelMigrator) Migrate(ctx context.Context) error {
+	logger := logf.FromContext(ctx).WithName("label-migration")
+
+	vmdiList := &crdv1.VMDiskImageList{}
+	if err := m.List(ctx, vmdiList); err != nil {
+		return err
+	}
+	existing := map[types.NamespacedName]types.UID{}
+	for _, vmdi := range vmdiList.Items {
+		existing[types.NamespacedName{Namespace: vmdi.Namespace, Name: vmdi.Name}] = vmdi.UID
+	}
+
+	for _, kind := range childKinds(m.VolumeGroupSnapshotsAvailable) {
+		objs, err := m.listLegacyLabeled(ctx, kind)
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range objs {
+			labels := obj.GetLabels()
+			var uid types.UID
+			var isChild bool
+			if _, hasOwnerLabel := labels[crdv1.VMDiskImageLegacyOwnerLabel]; hasOwnerLabel {
+				uid, isChild = legacyOwnerOf(obj, existing)
+			} else {
+				owner := types.NamespacedName{Namespace: ownerNamespaceOf(obj), Name: labels[crdv1.VMDiskImageNameLabel]}
+				uid, isChild = existing[owner]
+				isChild = isChild && string(uid) == labels[crdv1.VMDiskImageUIDLabel]
+			}
+			if !isChild {
+				continue
+			}
+
+			patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+			if name, hasOwnerLabel := labels[crdv1.VMDiskImageLegacyOwnerLabel]; hasOwnerLabel {
+				labels[crdv1.VMDiskImageNameLabel] = name
+				labels[crdv1.VMDiskImageUIDLabel] = string(uid)
+				delete(labels, crdv1.VMDiskImageLegacyOwnerLabel)
+			}
+			for legacyLabel, label := range legacyLabels {
+				if value, found := labels[legacyLabel]; found {
+					labels[label] = value
+					delete(labels, legacyLabel)
+				}
+			}
+			obj.SetLabels(labels)
+
+			if err := client.IgnoreNotFound(m.Patch(ctx, obj, patch)); err != nil {
+				return err
+			}
+			logger.Info("Migrated the labels of a child resource", "kind", kind.name, "namespace", obj.GetNamespace(), "name", obj.GetName())
+		}
+	}
+
+	return nil
+}
+
+// The resources of a kind with the legacy owner label, and those with the
+// name label that still carry an unprefixed label.
+func (m *LegacyLabelMigrator) listLegacyLabeled(ctx context.Context, kind childKind) ([]client.Object, error) {
+	selectors := []client.HasLabels{{crdv1.VMDiskImageLegacyOwnerLabel}}
+	for legacyLabel := range legacyLabels {
+		selectors = append(selectors, client.HasLabels{crdv1.VMDiskImageNameLabel, legacyLabel})
+	}
+
+	var objs []client.Object
+	seen := map[types.UID]bool{}
+	for _, selector := range selectors {
+		list := kind.newList()
+		if err := m.List(ctx, list, selector); err != nil {
+			return nil, err
+		}
+		found, err := extractObjects(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range found {
+			if !seen[obj.GetUID()] {
+				seen[obj.GetUID()] = true
+				objs = append(objs, obj)
+			}
+		}
+	}
+
+	return objs, nil
+}
+
+// Snapshot copies live outside of the namespace of their VMDiskImage, which
+// they record in the source namespace label. Copies made before it was
+// prefixed carry the unprefixed one.
+func ownerNamespaceOf(obj client.Object) string {
+	labels := obj.GetLabels()
+	if sourceNamespace, isCopy := labels[crdv1.VMDiskImageSourceNamespaceLabel]; isCopy {
+		return sourceNamespace
+	}
+	if sourceNamespace, isCopy := labels[crdv1.VMDiskImageLegacySourceNamespaceLabel]; isCopy {
+		return sourceNamespace
+	}
+
+	return obj.GetNamespace()
+}
+
+// Find the UID of the VMDiskImage a resource with the legacy owner label
+// belongs to. Resources that merely carry an owner label without being one of
+// ours are never touched.
+func legacyOwnerOf(obj client.Object, existing map[types.NamespacedName]types.UID) (types.UID, bool) {
+	labels := obj.GetLabels()
+
+	// Snapshot copies have no owner reference since they live outside of the
+	// VMDiskImage's namespace.
+	if namespace := ownerNamespaceOf(obj); namespace != obj.GetNamespace() {
+		uid, found := existing[types.NamespacedName{Namespace: namespace, Name: labels[crdv1.VMDiskImageLegacyOwnerLabel]}]
+		return uid, found
+	}
+
+	controller := metav1.GetControllerOf(obj)
+	if controller == nil {
+		return "", false
+	}
+
+	uid, found := existing[types.NamespacedName{Namespace: obj.GetNamespace(), Name: labels[crdv1.VMDiskImageLegacyOwnerLabel]}]
+	switch {
+	case controller.Kind == "VMDiskImage" && controller.APIVersion == crdv1.GroupVersion.String():
+		return uid, found && uid == controller.UID
+	case controller.Kind == "DataVolume":
+		// CDI owns the PVCs of our DataVolumes but copies our labels onto them
+		_, isPVC := obj.(*corev1.PersistentVolumeClaim)
+		return uid, found && isPVC
+	default:
+		return "", false
+	}
+}
+
+// The child resources of a VMDiskImage that still carry the legacy owner
+// label, in any namespace. Nothing is looked for once the migration is done.
+func (p K8sVMDIProvisioner) legacyChildren(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) ([]client.Object, error) {
+	migrator := p.LegacyLabelMigrator
+	if migrator == nil || migrator.Done() {
+		return nil, nil
+	}
+
+	existing := map[types.NamespacedName]types.UID{
+		{Namespace: vmdi.Namespace, Name: vmdi.Name}: vmdi.UID,
+	}
+
+	var children []client.Object
+	for _, kind := range childKinds(migrator.VolumeGroupSnapshotsAvailable) {
+		objs, err := p.listChildren(ctx, kind, client.MatchingLabels{crdv1.VMDiskImageLegacyOwnerLabel: vmdi.Name})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the legacy %s resources of the VMDiskImage %s: %w", kind.name, vmdi.Name, err)
+		}
+		for _, obj := range objs {
+			if uid, isChild := legacyOwnerOf(obj, existing); isChild && uid == vmdi.UID {
+				children = append(children, obj)
+			}
+		}
+	}
+
+	return children, nil
+}
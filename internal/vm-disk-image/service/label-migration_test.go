@@ -0,0 +1,143 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("legacy labeled child resources", func() {
+	var (
+		vmdi          *crdv1.VMDiskImage
+		legacyVolume  *cdiv1beta1.DataVolume
+		legacyCopy    *snapshotv1.VolumeSnapshot
+		foreignVolume *cdiv1beta1.DataVolume
+		migrator      *LegacyLabelMigrator
+		provisioner   K8sVMDIProvisioner
+	)
+
+	BeforeEach(func() {
+		vmdi = &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "vmdi-uid"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"},
+			},
+		}
+		legacyVolume = &cdiv1beta1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ubuntu",
+				Namespace: "images",
+				UID:       "dv-uid",
+				Labels:    map[string]string{crdv1.VMDiskImageLegacyOwnerLabel: "ubuntu"},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: crdv1.GroupVersion.String(),
+					Kind:       "VMDiskImage",
+					Name:       "ubuntu",
+					UID:        "vmdi-uid",
+					Controller: ptr.To(true),
+				}},
+			},
+		}
+		legacyCopy = &snapshotv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ubuntu",
+				Namespace: "team-a",
+				UID:       "copy-uid",
+				Labels: map[string]string{
+					crdv1.VMDiskImageLegacyOwnerLabel:           "ubuntu",
+					crdv1.VMDiskImageLegacySourceNamespaceLabel: "images",
+				},
+			},
+		}
+		// Something else's resource that happens to use the same label
+		foreignVolume = &cdiv1beta1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other",
+				Namespace: "images",
+				UID:       "other-uid",
+				Labels:    map[string]string{crdv1.VMDiskImageLegacyOwnerLabel: "ubuntu"},
+			},
+		}
+
+		k8sClient := newFakeClient(vmdi, legacyVolume, legacyCopy, foreignVolume)
+		migrator = &LegacyLabelMigrator{Client: k8sClient}
+		provisioner = K8sVMDIProvisioner{
+			Client:              k8sClient,
+			ResourceGenerator:   &Generator{},
+			LegacyLabelMigrator: migrator,
+		}
+	})
+
+	It("counts them as remaining until the migration is done", func(ctx SpecContext) {
+		remaining, err := provisioner.RemainingResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remaining).To(HaveLen(2))
+		Expect(remaining).To(ContainElement(HaveField("ObjectMeta.UID", legacyVolume.UID)))
+		Expect(remaining).To(ContainElement(HaveField("ObjectMeta.UID", legacyCopy.UID)))
+
+		migrator.done.Store(true)
+		remaining, err = provisioner.RemainingResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remaining).To(BeEmpty())
+	})
+
+	It("tears them down with the rest of the child resources", func(ctx SpecContext) {
+		Expect(provisioner.TearDownAllResources(ctx, vmdi)).To(Succeed())
+
+		err := provisioner.Get(ctx, client.ObjectKeyFromObject(legacyVolume), &cdiv1beta1.DataVolume{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = provisioner.Get(ctx, client.ObjectKeyFromObject(legacyCopy), &snapshotv1.VolumeSnapshot{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(provisioner.Get(ctx, client.ObjectKeyFromObject(foreignVolume), &cdiv1beta1.DataVolume{})).To(Succeed())
+	})
+	It("moves the legacy labels of its child resources under the operator's prefix", func(ctx SpecContext) {
+		unprefixedVolume := &cdiv1beta1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ubuntu-root",
+				Namespace: "images",
+				UID:       "root-uid",
+				Labels: map[string]string{
+					crdv1.VMDiskImageNameLabel:       "ubuntu",
+					crdv1.VMDiskImageUIDLabel:        "vmdi-uid",
+					crdv1.VMDiskImageLegacyDiskLabel: "root",
+				},
+			},
+		}
+		Expect(provisioner.Create(ctx, unprefixedVolume)).To(Succeed())
+
+		Expect(migrator.Migrate(ctx)).To(Succeed())
+
+		migrated := &cdiv1beta1.DataVolume{}
+		Expect(provisioner.Get(ctx, client.ObjectKeyFromObject(legacyVolume), migrated)).To(Succeed())
+		Expect(migrated.Labels).To(Equal(map[string]string{
+			crdv1.VMDiskImageNameLabel: "ubuntu",
+			crdv1.VMDiskImageUIDLabel:  "vmdi-uid",
+		}))
+
+		Expect(provisioner.Get(ctx, client.ObjectKeyFromObject(unprefixedVolume), migrated)).To(Succeed())
+		Expect(migrated.Labels).To(Equal(map[string]string{
+			crdv1.VMDiskImageNameLabel: "ubuntu",
+			crdv1.VMDiskImageUIDLabel:  "vmdi-uid",
+			crdv1.VMDiskImageDiskLabel: "root",
+		}))
+
+		migratedCopy := &snapshotv1.VolumeSnapshot{}
+		Expect(provisioner.Get(ctx, client.ObjectKeyFromObject(legacyCopy), migratedCopy)).To(Succeed())
+		Expect(migratedCopy.Labels).To(Equal(map[string]string{
+			crdv1.VMDiskImageNameLabel:            "ubuntu",
+			crdv1.VMDiskImageUIDLabel:             "vmdi-uid",
+			crdv1.VMDiskImageSourceNamespaceLabel: "images",
+		}))
+
+		foreign := &cdiv1beta1.DataVolume{}
+		Expect(provisioner.Get(ctx, client.ObjectKeyFromObject(foreignVolume), foreign)).To(Succeed())
+		Expect(foreign.Labels).To(Equal(foreignVolume.Labels))
+	})
+})
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	orphanedResources = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vmdiskimage_orphaned_resources",
+			Help: "Child resources found by the last sweep whose VMDiskImage no longer exists.",
+		},
+		[]string{"kind"},
+	)
+	orphanedResourcesDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vmdiskimage_orphaned_resources_deleted_total",
+			Help: "Child resources deleted because their VMDiskImage no longer exists.",
+		},
+		[]string{"kind"},
+	)
+	versionsPruned = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "vmdiskimage_versions_pruned_total",
+			Help: "VMDiskImages deleted because their image version is older than the retained ones.",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedResources, orphanedResourcesDeleted, versionsPruned)
+}
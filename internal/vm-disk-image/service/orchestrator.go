@@ -1,18 +1,23 @@
 package service
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	types "k8s.io/apimachinery/pkg/types"
 	"k8s.io/utils/ptr"
 	crutils "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -29,6 +34,7 @@ type VMDiskImageOrchestrator interface {
 	AttemptSyncingOfResource(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error)
 	TransitonFromSyncing(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error)
 	AttemptRetry(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error)
+	ReconcileReadyResource(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error)
 	DeleteResource(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error)
 }
 
@@ -39,6 +45,15 @@ type Orchestrator struct {
 	MaxRetryBackoff     time.Duration
 	MaxSyncTime         time.Duration
 	ConcurrentSyncLimit int
+	// Applies to VMDiskImages that do not set a deletion policy.
+	DefaultDeletionPolicy string
+	// How often the consumers of Ready VMDiskImages are looked for. 0 disables
+	// usage tracking and lets in-use VMDiskImages be deleted.
+	UsageRefreshInterval time.Duration
+	// Applies to VMDiskImages that do not set a bandwidth limit.
+	DefaultBandwidthLimit *resource.Quantity
+	// The bandwidth shared by all syncs.
+	BandwidthBudget *resource.Quantity
 }
 
 func (o Orchestrator) GetVMDiskImage(ctx context.Context, namespace types.NamespacedName, vmdi *crdv1.VMDiskImage) error {
@@ -108,6 +123,21 @@ func (o Orchestrator) AttemptSyncingOfResource(
 ) (ctrl.Result, error) {
 	logger := logf.FromContext(ctx)
 
+	// Adopting existing resources downloads nothing so it does not wait for a sync slot
+	if AdoptsResources(vmdi) {
+		return o.adoptResources(ctx, vmdi)
+	}
+
+	// Broken credentials or CA bundles should not take a sync slot
+	err := o.Provisioner.Preflight(ctx, vmdi)
+	if errors.Is(err, ErrPreflightFailed) {
+		return o.handlePreflightFailure(ctx, vmdi, err)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to run the preflight checks")
+		return ctrl.Result{}, err
+	}
+
 	syncingList, err := o.ListVMDiskImagesByPhase(ctx, crdv1.PhaseSyncing)
 	if err != nil {
 		logger.Error(err, "Failed to list syncing resources")
@@ -118,6 +148,24 @@ func (o Orchestrator) AttemptSyncingOfResource(
 		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
 	}
 
+	o.allocateBandwidth(vmdi, len(syncingList.Items))
+
+	// A missing artifact fails before any resources are created to import it
+	err = o.Provisioner.ProbeSources(ctx, vmdi)
+	if errors.Is(err, ErrPreflightFailed) {
+		return o.handlePreflightFailure(ctx, vmdi, err)
+	}
+	if errors.Is(err, ErrMissingSourceArtifact) {
+		return o.HandleSyncError(ctx, vmdi, err, "The source artifact does not exist")
+	}
+	if errors.Is(err, ErrUnsizableDisk) {
+		return o.failUnsizableDisks(ctx, vmdi, err)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to probe the sources")
+		return ctrl.Result{}, err
+	}
+
 	err = o.Provisioner.CreateResources(ctx, vmdi)
 	if err != nil {
 		o.Recorder.Eventf(vmdi, "Warning", "ResourceCreationFailed", "Failed to create resources: "+err.Error())
@@ -142,6 +190,131 @@ func (o Orchestrator) AttemptSyncingOfResource(
 	return ctrl.Result{}, nil
 }
 
+// Save the importer logs and Events of a failed sync. The importer pods go
+// away with the teardown so this has to happen first. The caller is
+// responsible for persisting the status.
+func (o Orchestrator) collectFailureDiagnostics(ctx context.Context, vmdi *crdv1.VMDiskImage, failure error) {
+	diagnostics, err := o.Provisioner.CollectFailureDiagnostics(ctx, vmdi, failure)
+	if err != nil {
+		logf.FromContext(ctx).Error(err, "Failed to collect the failure diagnostics")
+	}
+	if diagnostics != "" {
+		vmdi.Status.LastFailureDiagnostics = diagnostics
+	}
+}
+
+// Keep the volumes of a failed sync around for debugging when asked to.
+func (o Orchestrator) retainFailedResources(ctx context.Context, vmdi *crdv1.VMDiskImage) {
+	retained, err := o.Provisioner.RetainFailedResources(ctx, vmdi)
+	if err != nil {
+		logf.FromContext(ctx).Error(err, "Failed to retain the volumes of the failed sync")
+		o.Recorder.Eventf(vmdi, "Warning", "RetainFailedResourcesFailed", "Failed to retain the volumes of the failed sync: %s", err.Error())
+	}
+	if retained > 0 {
+		o.Recorder.Eventf(vmdi, "Normal", "FailedResourcesRetained", "Retained %d volumes of the failed sync for debugging", retained)
+	}
+}
+
+// Keep a VMDiskImage that failed its preflight checks queued. Fixing the
+// Secret or ConfigMap it refers to triggers another attempt.
+func (o Orchestrator) handlePreflightFailure(ctx context.Context, vmdi *crdv1.VMDiskImage, preflightErr error) (ctrl.Result, error) {
+	message := strings.TrimPrefix(preflightErr.Error(), ErrPreflightFailed.Error()+": ")
+
+	changed := meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+		Type:    crdv1.ConditionTypeReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  crdv1.ReasonPreflightFailed,
+		Message: message,
+	})
+	if changed {
+		vmdi.Status.Message = "Waiting for the preflight checks to pass: " + message
+		if err := o.Status().Update(ctx, vmdi); err != nil {
+			return o.HandleResourceUpdateError(ctx, vmdi, err, "Failed to update the preflight status")
+		}
+		o.Recorder.Eventf(vmdi, "Warning", crdv1.ReasonPreflightFailed, "Preflight checks failed: %s", message)
+	}
+
+	return ctrl.Result{RequeueAfter: 5 * time.Minute}, nil
+}
+
+// Fail a VMDiskImage whose disks cannot be sized. Nothing was created for it
+// yet so there is nothing to diagnose, retain or tear down, and retrying
+// cannot help until its spec is fixed.
+func (o Orchestrator) failUnsizableDisks(ctx context.Context, vmdi *crdv1.VMDiskImage, sizingErr error) (ctrl.Result, error) {
+	logf.FromContext(ctx).Error(sizingErr, "The disks cannot be sized")
+
+	vmdi.Status.Phase = crdv1.PhaseFailed
+	vmdi.Status.Message = "Failed permanently: " + sizingErr.Error()
+	meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+		Type:    crdv1.ConditionTypeReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  crdv1.ReasonUnsizableDisk,
+		Message: sizingErr.Error(),
+	})
+	if err := o.Status().Update(ctx, vmdi); err != nil {
+		return o.HandleResourceUpdateError(ctx, vmdi, err, "Failed to update status to Failed")
+	}
+	o.Recorder.Eventf(vmdi, "Warning", crdv1.ReasonUnsizableDisk, sizingErr.Error())
+
+	return ctrl.Result{}, nil
+}
+
+// Take existing resources under management and move straight to Ready once
+// their snapshots can be used. Resources that cannot be adopted are retried
+// until the VMDiskImage or the resources are fixed.
+func (o Orchestrator) adoptResources(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error) {
+	logger := logf.FromContext(ctx)
+
+	ready, err := o.Provisioner.AdoptResources(ctx, vmdi)
+	if err != nil {
+		logger.Error(err, "Failed to adopt existing resources")
+		o.Recorder.Eventf(vmdi, "Warning", "AdoptionFailed", "Failed to adopt existing resources: "+err.Error())
+		vmdi.Status.Message = "Failed to adopt existing resources: " + err.Error()
+		meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+			Type:    crdv1.ConditionTypeReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  crdv1.ReasonAdoptionFailed,
+			Message: err.Error(),
+		})
+		if err := o.Status().Update(ctx, vmdi); err != nil {
+			logger.Error(err, "Could not update status after an adoption failure")
+		}
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	if !ready {
+		vmdi.Status.Message = "Waiting for the snapshots of the adopted resources."
+		meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+			Type:    crdv1.ConditionTypeReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  crdv1.ReasonAdopting,
+			Message: "Existing resources are being adopted.",
+		})
+		if err := o.Status().Update(ctx, vmdi); err != nil {
+			return o.HandleResourceUpdateError(ctx, vmdi, err, "Failed to update the adoption status")
+		}
+
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	vmdi.Status.Phase = crdv1.PhaseReady
+	vmdi.Status.Message = "Existing resources were adopted."
+	meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+		Type:    crdv1.ConditionTypeReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  crdv1.ReasonAdopted,
+		Message: "The existing resources were adopted.",
+	})
+
+	if err := o.Status().Update(ctx, vmdi); err != nil {
+		return o.HandleResourceUpdateError(ctx, vmdi, err, "Failed to update status to Ready")
+	}
+	o.Recorder.Eventf(vmdi, "Normal", "Adopted", "Existing resources were adopted")
+
+	return ctrl.Result{}, nil
+}
+
 func (o Orchestrator) TransitonFromSyncing(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error) {
 	logger := logf.FromContext(ctx)
 
@@ -156,7 +329,14 @@ func (o Orchestrator) TransitonFromSyncing(ctx context.Context, vmdi *crdv1.VMDi
 	if err != nil {
 		logger.Error(err, "Unable to verify if resource is ready or not.")
 	}
+
+	disksChanged := o.refreshDiskStatuses(ctx, vmdi)
 	if !isDone {
+		if disksChanged {
+			if err := o.Status().Update(ctx, vmdi); err != nil {
+				logger.Error(err, "Failed to update the status of the disks")
+			}
+		}
 		logger.Info("Sync is not complete. Requeuing.")
 		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
 	}
@@ -210,17 +390,197 @@ func (o Orchestrator) AttemptRetry(ctx context.Context, vmdi *crdv1.VMDiskImage)
 
 }
 
+// Keep the resources published from a Ready VMDiskImage up to date. That is
+// its CDI DataSources and the snapshot copies in its target namespaces.
+func (o Orchestrator) ReconcileReadyResource(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error) {
+	logger := logf.FromContext(ctx)
+
+	previousStatus := vmdi.Status.DeepCopy()
+
+	if err := o.Provisioner.PublishDataSources(ctx, vmdi); err != nil {
+		logger.Error(err, "Failed to publish the datasources")
+		o.Recorder.Eventf(vmdi, "Warning", "DataSourcePublishFailed", "Failed to publish datasources: "+err.Error())
+		return ctrl.Result{}, err
+	}
+
+	allCopiesReady := true
+	if HasSnapshotDistribution(vmdi) {
+		if err := o.Provisioner.DistributeSnapshots(ctx, vmdi); err != nil {
+			logger.Error(err, "Failed to distribute the snapshots to the target namespaces")
+			o.Recorder.Eventf(vmdi, "Warning", "DistributionFailed", "Failed to copy snapshots to the target namespaces: "+err.Error())
+			return ctrl.Result{}, err
+		}
+
+		for _, snapshotCopy := range vmdi.Status.Copies {
+			allCopiesReady = allCopiesReady && snapshotCopy.ReadyToUse
+		}
+	}
+
+	if o.UsageRefreshInterval > 0 {
+		consumers, err := o.Provisioner.FindConsumers(ctx, vmdi)
+		if err != nil {
+			logger.Error(err, "Failed to look for the consumers of the VMDiskImage")
+			return ctrl.Result{}, err
+		}
+		setConsumerStatus(vmdi, consumers)
+	}
+
+	if !equality.Semantic.DeepEqual(previousStatus, &vmdi.Status) {
+		if err := o.Status().Update(ctx, vmdi); err != nil {
+			logger.Error(err, "Failed to update the status of the published resources")
+			return ctrl.Result{}, err
+		}
+
+		dataSourcesChanged := !equality.Semantic.DeepEqual(previousStatus.DataSources, vmdi.Status.DataSources)
+		if dataSourcesChanged && len(vmdi.Status.DataSources) > 0 {
+			o.Recorder.Eventf(vmdi, "Normal", "DataSourcePublished", "Published datasources: %s", strings.Join(vmdi.Status.DataSources, ", "))
+		}
+
+		copiesChanged := !equality.Semantic.DeepEqual(previousStatus.Copies, vmdi.Status.Copies)
+		if copiesChanged && allCopiesReady && len(vmdi.Status.Copies) > 0 {
+			o.Recorder.Eventf(vmdi, "Normal", "SnapshotsDistributed", "Snapshots are ready in %d target namespace copies", len(vmdi.Status.Copies))
+		}
+	}
+
+	if !allCopiesReady {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	return ctrl.Result{RequeueAfter: o.UsageRefreshInterval}, nil
+}
+
+// Tear down the child resources of a VMDiskImage that is being deleted and
+// release it once they are all gone. Failures are retried with backoff.
 func (o Orchestrator) DeleteResource(ctx context.Context, vmdi *crdv1.VMDiskImage) (ctrl.Result, error) {
 	logger := logf.FromContext(ctx)
 
-	err := o.Provisioner.TearDownAllResources(ctx, vmdi)
+	if vmdi.Status.Phase != crdv1.PhaseDeleting {
+		vmdi.Status.Phase = crdv1.PhaseDeleting
+		vmdi.Status.Message = "Tearing down child resources."
+		meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+			Type:    crdv1.ConditionTypeReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  crdv1.ReasonDeleting,
+			Message: "The resource is being deleted.",
+		})
+		if err := o.Status().Update(ctx, vmdi); err != nil {
+			return o.handleDeletionError(ctx, vmdi, err, "Failed to update status to Deleting")
+		}
+		o.Recorder.Eventf(vmdi, "Normal", "DeletionStarted", "Tearing down child resources")
+	}
+
+	deletionPolicy := cmp.Or(vmdi.Spec.DeletionPolicy, o.DefaultDeletionPolicy, crdv1.DeletionPolicyDelete)
+	if deletionPolicy == crdv1.DeletionPolicyDelete {
+		inUse, err := o.waitForConsumers(ctx, vmdi)
+		if err != nil {
+			return o.handleDeletionError(ctx, vmdi, err, "Failed to look for the consumers of the VMDiskImage")
+		}
+		if inUse {
+			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+		}
+	}
+
+	released, err := o.Provisioner.ReleaseResources(ctx, vmdi, deletionPolicy)
 	if err != nil {
-		logger.Error(err, "failed to cleanup child resources of VMDiskImage.")
+		return o.handleDeletionError(ctx, vmdi, err, "Failed to release the retained child resources")
+	}
+	if released > 0 {
+		o.Recorder.Eventf(vmdi, "Normal", "ResourcesRetained", "Released %d child resources according to the %s deletion policy", released, deletionPolicy)
+	}
+
+	err = o.Provisioner.TearDownAllResources(ctx, vmdi)
+	if err != nil {
+		return o.handleDeletionError(ctx, vmdi, err, "Failed to tear down child resources")
+	}
+
+	remaining, err := o.Provisioner.RemainingResources(ctx, vmdi)
+	if err != nil {
+		return o.handleDeletionError(ctx, vmdi, err, "Failed to check for remaining child resources")
+	}
+
+	if len(remaining) > 0 {
+		if vmdi.Annotations[crdv1.VMDiskImageForceDeleteAnnotation] == "true" {
+			o.Recorder.Eventf(vmdi, "Warning", "ForceDeleting", "Removing the finalizers of %d remaining child resources", len(remaining))
+			if err := o.Provisioner.ForceRemoveResources(ctx, remaining); err != nil {
+				return o.handleDeletionError(ctx, vmdi, err, "Failed to force delete child resources")
+			}
+		}
+
+		message := fmt.Sprintf("Waiting for %d child resources to be deleted.", len(remaining))
+		if vmdi.Status.Message != message {
+			logger.Info("Waiting for child resources to be deleted", "remaining", len(remaining))
+			o.Recorder.Eventf(vmdi, "Normal", "WaitingForTeardown", "Waiting for %d child resources to be deleted", len(remaining))
+			vmdi.Status.Message = message
+			if err := o.Status().Update(ctx, vmdi); err != nil {
+				return o.handleDeletionError(ctx, vmdi, err, "Failed to update the deletion status")
+			}
+		}
+
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
+	o.Recorder.Eventf(vmdi, "Normal", "DeletionCompleted", "All child resources have been deleted")
+
+	if err := o.Provisioner.RemoveFinalizer(ctx, vmdi); err != nil {
+		return o.handleDeletionError(ctx, vmdi, err, "Failed to remove the finalizer")
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// Deleting the snapshots of a VMDiskImage breaks the restores and clones still
+// reading from them, so the teardown waits until nothing was restored or
+// cloned from the VMDiskImage anymore. The force delete annotation skips the
+// wait. Returns whether the VMDiskImage is still in use.
+func (o Orchestrator) waitForConsumers(ctx context.Context, vmdi *crdv1.VMDiskImage) (bool, error) {
+	if o.UsageRefreshInterval <= 0 || vmdi.Annotations[crdv1.VMDiskImageForceDeleteAnnotation] == "true" {
+		return false, nil
+	}
+
+	consumers, err := o.Provisioner.FindConsumers(ctx, vmdi)
+	if err != nil {
+		return false, err
+	}
+	if !setConsumerStatus(vmdi, consumers) {
+		return false, nil
+	}
+
+	message := fmt.Sprintf("Waiting for %d resources restored or cloned from the VMDiskImage to be deleted.", len(consumers))
+	if vmdi.Status.Message != message {
+		logf.FromContext(ctx).Info("Deletion is waiting for the consumers of the VMDiskImage", "consumers", len(consumers))
+		o.Recorder.Eventf(vmdi, "Warning", crdv1.ReasonWaitingForConsumers, "Waiting for %d resources restored or cloned from the VMDiskImage to be deleted", len(consumers))
+		vmdi.Status.Message = message
+		if err := o.Status().Update(ctx, vmdi); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// Returning the error makes controller-runtime retry the deletion with its
+// exponential backoff.
+func (o Orchestrator) handleDeletionError(ctx context.Context, vmdi *crdv1.VMDiskImage, originalErr error, message string) (ctrl.Result, error) {
+	logger := logf.FromContext(ctx)
+	logger.Error(originalErr, message)
+
+	o.Recorder.Eventf(vmdi, "Warning", "DeletionFailed", message+": "+originalErr.Error())
+
+	vmdi.Status.Message = message + ": " + originalErr.Error()
+	meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
+		Type:    crdv1.ConditionTypeReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  crdv1.ReasonDeletionFailed,
+		Message: originalErr.Error(),
+	})
+
+	if err := o.Status().Update(ctx, vmdi); err != nil {
+		logger.Error(err, "Could not update status after a deletion failure")
+	}
+
+	return ctrl.Result{}, originalErr
+}
+
 func (o Orchestrator) HandleResourceUpdateError(
 	ctx context.Context,
 	vmdi *crdv1.VMDiskImage,
@@ -233,6 +593,7 @@ func (o Orchestrator) HandleResourceUpdateError(
 	// Mark the resource as Failed
 	vmdi.Status.Phase = crdv1.PhaseRetryableFailure
 	vmdi.Status.Message = "An error occurred during reconciliation: " + originalErr.Error()
+
 	meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
 		Type:    crdv1.ConditionTypeReady,
 		Status:  metav1.ConditionFalse,
@@ -261,11 +622,14 @@ func (o Orchestrator) HandleResourceCreationError(ctx context.Context, vmdi *crd
 		Reason:  crdv1.ReasonResourceCreationFailed,
 		Message: originalErr.Error(),
 	})
+	o.collectFailureDiagnostics(ctx, vmdi, originalErr)
 
 	if err := o.Status().Update(ctx, vmdi); err != nil {
 		logger.Error(err, "Could not update status to Failed resource creation failure")
 	}
 
+	o.retainFailedResources(ctx, vmdi)
+
 	err := o.Provisioner.TearDownAllResources(ctx, vmdi)
 	if err != nil {
 		logger.Error(err, "Failed to teardown resources.")
@@ -285,6 +649,12 @@ func (o Orchestrator) HandleSyncError(ctx context.Context, vmdi *crdv1.VMDiskIma
 	vmdi.Status.LastFailureTime = ptr.To(metav1.Now())
 	vmdi.Status.Message = "An error occurred during reconciliation: " + originalErr.Error()
 
+	// Retrying cannot fix data that does not match its checksum
+	if errors.Is(originalErr, ErrChecksumMismatch) {
+		vmdi.Status.Phase = crdv1.PhaseFailed
+		vmdi.Status.Message = "Failed permanently: " + originalErr.Error()
+	}
+
 	reason := crdv1.ReasonUnknownSyncFailure
 	switch {
 	case errors.Is(originalErr, ErrSyncAttemptExceedsMaxDuration):
@@ -293,6 +663,14 @@ func (o Orchestrator) HandleSyncError(ctx context.Context, vmdi *crdv1.VMDiskIma
 		reason = crdv1.ReasonRetryLimitExceeded
 	case errors.Is(originalErr, ErrMissingSourceArtifact):
 		reason = crdv1.ReasonMissingSourceArtifact
+	case errors.Is(originalErr, ErrSnapshotFailed):
+		reason = crdv1.ReasonSnapshotFailed
+	case errors.Is(originalErr, ErrChecksumMismatch):
+		reason = crdv1.ReasonChecksumMismatch
+	case errors.Is(originalErr, ErrChecksumVerificationFailed):
+		reason = crdv1.ReasonChecksumVerificationFailed
+	case errors.Is(originalErr, ErrImportFailed):
+		reason = crdv1.ReasonImportFailed
 	}
 
 	meta.SetStatusCondition(&vmdi.Status.Conditions, metav1.Condition{
@@ -301,11 +679,14 @@ func (o Orchestrator) HandleSyncError(ctx context.Context, vmdi *crdv1.VMDiskIma
 		Reason:  reason,
 		Message: originalErr.Error(),
 	})
+	o.collectFailureDiagnostics(ctx, vmdi, originalErr)
 
 	if err := o.Status().Update(ctx, vmdi); err != nil {
 		logger.Error(err, "Could not update status to Failed after a sync error")
 	}
 
+	o.retainFailedResources(ctx, vmdi)
+
 	err := o.Provisioner.TearDownAllResources(ctx, vmdi)
 	if err != nil {
 		logger.Error(err, "Failed to teardown resources.")
@@ -313,3 +694,17 @@ func (o Orchestrator) HandleSyncError(ctx context.Context, vmdi *crdv1.VMDiskIma
 
 	return ctrl.Result{}, nil
 }
+
+// Refresh the per disk status of our VMDiskImage. Returns whether it changed.
+func (o Orchestrator) refreshDiskStatuses(ctx context.Context, vmdi *crdv1.VMDiskImage) bool {
+	logger := logf.FromContext(ctx)
+
+	previous := vmdi.Status.DeepCopy()
+	if err := o.Provisioner.RefreshDiskStatuses(ctx, vmdi); err != nil {
+		logger.Error(err, "Unable to get the status of the disks.")
+		return false
+	}
+
+	return !equality.Semantic.DeepEqual(previous.Disks, vmdi.Status.Disks) ||
+		previous.GroupSnapshotName != vmdi.Status.GroupSnapshotName
+}
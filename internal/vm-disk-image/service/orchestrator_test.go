@@ -0,0 +1,214 @@
+package service
+
+import (
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Orchestrator", func() {
+	var (
+		vmdi         *crdv1.VMDiskImage
+		k8sClient    client.Client
+		recorder     *record.FakeRecorder
+		orchestrator Orchestrator
+	)
+
+	newOrchestrator := func(objects ...client.Object) {
+		k8sClient = newFakeClient(objects...)
+		recorder = record.NewFakeRecorder(100)
+		orchestrator = Orchestrator{
+			Client:   k8sClient,
+			Recorder: recorder,
+			Provisioner: K8sVMDIProvisioner{
+				Client:                 k8sClient,
+				ResourceGenerator:      &Generator{},
+				MaxSyncAttemptDuration: time.Hour,
+				MaxSyncAttemptRetries:  3,
+			},
+			MaxRetryBackoff:       time.Minute,
+			MaxSyncTime:           time.Hour,
+			ConcurrentSyncLimit:   1,
+			DefaultDeletionPolicy: crdv1.DeletionPolicyDelete,
+		}
+	}
+
+	getVMDiskImage := func(ctx SpecContext) *crdv1.VMDiskImage {
+		current := &crdv1.VMDiskImage{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(vmdi), current)).To(Succeed())
+		return current
+	}
+
+	Context("when a disk cannot be sized", func() {
+		BeforeEach(func() {
+			vmdi = &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "vmdi-uid"},
+				Spec: crdv1.VMDiskImageSpec{
+					VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://images.example.com/ubuntu.qcow2"},
+				},
+				Status: crdv1.VMDiskImageStatus{Phase: crdv1.PhaseQueued},
+			}
+			newOrchestrator(vmdi)
+		})
+
+		It("fails it without counting a failed attempt or touching any resources", func(ctx SpecContext) {
+			current := getVMDiskImage(ctx)
+			_, err := orchestrator.AttemptSyncingOfResource(ctx, current)
+			Expect(err).NotTo(HaveOccurred())
+
+			current = getVMDiskImage(ctx)
+			Expect(current.Status.Phase).To(Equal(crdv1.PhaseFailed))
+			Expect(current.Status.FailureCount).To(BeZero())
+			Expect(current.Status.LastFailureTime).To(BeNil())
+			Expect(current.Status.LastFailureDiagnostics).To(BeEmpty())
+
+			condition := meta.FindStatusCondition(current.Status.Conditions, crdv1.ConditionTypeReady)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal(crdv1.ReasonUnsizableDisk))
+			Expect(condition.Message).To(ContainSubstring("diskSize must be set since source probing is disabled"))
+
+			dataVolumes := &cdiv1beta1.DataVolumeList{}
+			Expect(k8sClient.List(ctx, dataVolumes)).To(Succeed())
+			Expect(dataVolumes.Items).To(BeEmpty())
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning " + crdv1.ReasonUnsizableDisk)))
+		})
+	})
+
+	Context("when deleting", func() {
+		var childLabels map[string]string
+
+		// A child PVC of the VMDiskImage. Finalizers keep it around once it is
+		// deleted, like the pvc-protection finalizer does while it is in use.
+		childClaim := func(name string, finalizers ...string) *corev1.PersistentVolumeClaim {
+			return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+				Name:       name,
+				Namespace:  "images",
+				Labels:     childLabels,
+				Finalizers: finalizers,
+			}}
+		}
+
+		// A PVC restored from the snapshot of the VMDiskImage.
+		consumer := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "restored", Namespace: "images"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				DataSource: &corev1.TypedLocalObjectReference{Kind: "VolumeSnapshot", Name: "ubuntu"},
+			},
+		}
+
+		isDeleted := func(ctx SpecContext, obj client.Object) bool {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+			if apierrors.IsNotFound(err) {
+				return true
+			}
+			Expect(err).NotTo(HaveOccurred())
+			return false
+		}
+
+		BeforeEach(func() {
+			vmdi = &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "ubuntu",
+					Namespace:         "images",
+					UID:               "vmdi-uid",
+					Finalizers:        []string{crdv1.VMDiskImageFinalizer},
+					DeletionTimestamp: &metav1.Time{Time: time.Now()},
+				},
+				Spec: crdv1.VMDiskImageSpec{
+					VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"},
+				},
+				Status: crdv1.VMDiskImageStatus{
+					Phase: crdv1.PhaseReady,
+					Disks: []crdv1.VMDiskImageDiskStatus{{SnapshotName: "ubuntu", SnapshotReady: true}},
+				},
+			}
+			childLabels = getLabelsToMatch(vmdi)
+		})
+
+		It("waits for the consumers of the VMDiskImage to be deleted", func(ctx SpecContext) {
+			snapshot := &snapshotv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", Labels: childLabels}}
+			newOrchestrator(vmdi, snapshot, consumer)
+			orchestrator.UsageRefreshInterval = time.Minute
+
+			result, err := orchestrator.DeleteResource(ctx, getVMDiskImage(ctx))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(30 * time.Second))
+
+			current := getVMDiskImage(ctx)
+			Expect(current.Finalizers).To(ContainElement(crdv1.VMDiskImageFinalizer))
+			Expect(current.Status.Phase).To(Equal(crdv1.PhaseDeleting))
+			Expect(current.Status.Message).To(Equal("Waiting for 1 resources restored or cloned from the VMDiskImage to be deleted."))
+			Expect(current.Status.Consumers).To(ConsistOf(HaveField("Name", "restored")))
+			Expect(isDeleted(ctx, snapshot)).To(BeFalse())
+		})
+
+		It("ignores the consumers when it is forced", func(ctx SpecContext) {
+			snapshot := &snapshotv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", Labels: childLabels}}
+			vmdi.Annotations = map[string]string{crdv1.VMDiskImageForceDeleteAnnotation: "true"}
+			newOrchestrator(vmdi, snapshot, consumer)
+			orchestrator.UsageRefreshInterval = time.Minute
+
+			result, err := orchestrator.DeleteResource(ctx, getVMDiskImage(ctx))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeZero())
+
+			Expect(isDeleted(ctx, snapshot)).To(BeTrue())
+			Expect(isDeleted(ctx, vmdi)).To(BeTrue())
+		})
+
+		It("keeps its finalizer until every child resource is gone", func(ctx SpecContext) {
+			stuck := childClaim("ubuntu", "kubernetes.io/pvc-protection")
+			newOrchestrator(vmdi, stuck)
+
+			for range 2 {
+				result, err := orchestrator.DeleteResource(ctx, getVMDiskImage(ctx))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.RequeueAfter).To(Equal(5 * time.Second))
+			}
+
+			current := getVMDiskImage(ctx)
+			Expect(current.Finalizers).To(ContainElement(crdv1.VMDiskImageFinalizer))
+			Expect(current.Status.Message).To(Equal("Waiting for 1 child resources to be deleted."))
+			Expect(isDeleted(ctx, stuck)).To(BeFalse())
+			Expect(stuck.DeletionTimestamp).NotTo(BeNil())
+			Expect(stuck.Finalizers).To(ConsistOf("kubernetes.io/pvc-protection"))
+
+			stuck.Finalizers = nil
+			Expect(k8sClient.Update(ctx, stuck)).To(Succeed())
+
+			result, err := orchestrator.DeleteResource(ctx, getVMDiskImage(ctx))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(isDeleted(ctx, vmdi)).To(BeTrue())
+		})
+
+		It("removes the finalizers of stuck child resources when it is forced", func(ctx SpecContext) {
+			stuck := childClaim("ubuntu", "kubernetes.io/pvc-protection")
+			vmdi.Annotations = map[string]string{crdv1.VMDiskImageForceDeleteAnnotation: "true"}
+			newOrchestrator(vmdi, stuck)
+
+			result, err := orchestrator.DeleteResource(ctx, getVMDiskImage(ctx))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(5 * time.Second))
+			Expect(isDeleted(ctx, stuck)).To(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("DeletionStarted")))
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning ForceDeleting")))
+
+			result, err = orchestrator.DeleteResource(ctx, getVMDiskImage(ctx))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(isDeleted(ctx, vmdi)).To(BeTrue())
+		})
+	})
+})
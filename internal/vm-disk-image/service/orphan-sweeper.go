@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// OrphanSweeper periodically deletes child resources whose VMDiskImage is
+// gone without having torn them down, e.g. because it was force-deleted or
+// its finalizer was removed. It only runs on the leader.
+type OrphanSweeper struct {
+	client.Client
+	Interval                      time.Duration
+	GracePeriod                   time.Duration
+	DryRun                        bool
+	VolumeGroupSnapshotsAvailable bool
+
+	// When each orphaned resource was first seen, keyed by its UID.
+	orphanedSince map[types.UID]time.Time
+}
+
+func (s *OrphanSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+func (s *OrphanSweeper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.Sweep(ctx)
+		}
+	}
+}
+
+// Sweep runs a single pass over the child resources. Resources stay in place
+// until they have been orphaned for longer than the grace period.
+func (s *OrphanSweeper) Sweep(ctx context.Context) {
+	logger := logf.FromContext(ctx).WithName("orphan-sweeper")
+
+	if s.orphanedSince == nil {
+		s.orphanedSince = map[types.UID]time.Time{}
+	}
+
+	vmdiList := &crdv1.VMDiskImageList{}
+	if err := s.List(ctx, vmdiList); err != nil {
+		logger.Error(err, "Failed to list VMDiskImages")
+		return
+	}
+	existing := map[types.NamespacedName]types.UID{}
+	for _, vmdi := range vmdiList.Items {
+		existing[types.NamespacedName{Namespace: vmdi.Namespace, Name: vmdi.Name}] = vmdi.UID
+	}
+
+	now := time.Now()
+	seen := map[types.UID]bool{}
+	for _, kind := range childKinds(s.VolumeGroupSnapshotsAvailable) {
+		list := kind.newList()
+		err := s.List(ctx, list, client.HasLabels{crdv1.VMDiskImageNameLabel, crdv1.VMDiskImageUIDLabel})
+		if err != nil {
+			logger.Error(err, "Failed to list child resources", "kind", kind.name)
+			continue
+		}
+		objs, err := extractObjects(list)
+		if err != nil {
+			logger.Error(err, "Failed to read child resources", "kind", kind.name)
+			continue
+		}
+
+		orphans := 0
+		for _, obj := range objs {
+			if !obj.GetDeletionTimestamp().IsZero() || !isOrphaned(obj, existing) {
+				continue
+			}
+
+			orphans++
+			seen[obj.GetUID()] = true
+			firstSeen, tracked := s.orphanedSince[obj.GetUID()]
+			if !tracked {
+				s.orphanedSince[obj.GetUID()] = now
+				logger.Info("Found orphaned child resource", "kind", kind.name, "namespace", obj.GetNamespace(), "name", obj.GetName())
+				continue
+			}
+			if now.Sub(firstSeen) < s.GracePeriod {
+				continue
+			}
+
+			if s.DryRun {
+				logger.Info("Would delete orphaned child resource", "kind", kind.name, "namespace", obj.GetNamespace(), "name", obj.GetName())
+				continue
+			}
+
+			err := s.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !errors.IsNotFound(err) {
+				logger.Error(err, "Failed to delete orphaned child resource", "kind", kind.name, "namespace", obj.GetNamespace(), "name", obj.GetName())
+				continue
+			}
+			logger.Info("Deleted orphaned child resource", "kind", kind.name, "namespace", obj.GetNamespace(), "name", obj.GetName())
+			orphanedResourcesDeleted.WithLabelValues(kind.name).Inc()
+			delete(s.orphanedSince, obj.GetUID())
+		}
+		orphanedResources.WithLabelValues(kind.name).Set(float64(orphans))
+	}
+
+	// Forget resources that were deleted or adopted since the last sweep
+	for uid := range s.orphanedSince {
+		if !seen[uid] {
+			delete(s.orphanedSince, uid)
+		}
+	}
+}
+
+// A child resource is orphaned when the VMDiskImage it belongs to no longer
+// exists or has been replaced by a new one of the same name.
+func isOrphaned(obj client.Object, existing map[types.NamespacedName]types.UID) bool {
+	labels := obj.GetLabels()
+
+	owner := types.NamespacedName{Namespace: ownerNamespaceOf(obj), Name: labels[crdv1.VMDiskImageNameLabel]}
+	uid, found := existing[owner]
+
+	return !found || string(uid) != labels[crdv1.VMDiskImageUIDLabel]
+}
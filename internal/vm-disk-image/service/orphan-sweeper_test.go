@@ -0,0 +1,113 @@
+package service
+
+import (
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("OrphanSweeper", func() {
+	vmdi := &crdv1.VMDiskImage{ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "uid-live"}}
+
+	childClaim := func(name string, uid types.UID, ownerUID types.UID) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "images",
+			UID:       uid,
+			Labels: map[string]string{
+				crdv1.VMDiskImageNameLabel: "ubuntu",
+				crdv1.VMDiskImageUIDLabel:  string(ownerUID),
+			},
+		}}
+	}
+	claimExists := func(ctx SpecContext, c client.Client, name string) bool {
+		err := c.Get(ctx, client.ObjectKey{Namespace: "images", Name: name}, &corev1.PersistentVolumeClaim{})
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+		return err == nil
+	}
+
+	var c client.Client
+	var sweeper *OrphanSweeper
+
+	BeforeEach(func() {
+		c = newFakeClient(
+			vmdi,
+			childClaim("live", "uid-claim-live", "uid-live"),
+			childClaim("orphan", "uid-claim-orphan", "uid-replaced"),
+		)
+		sweeper = &OrphanSweeper{Client: c, GracePeriod: time.Hour}
+	})
+
+	It("only starts tracking resources orphaned for the first time", func(ctx SpecContext) {
+		sweeper.Sweep(ctx)
+
+		Expect(claimExists(ctx, c, "orphan")).To(BeTrue())
+		Expect(sweeper.orphanedSince).To(HaveKey(types.UID("uid-claim-orphan")))
+		Expect(sweeper.orphanedSince).NotTo(HaveKey(types.UID("uid-claim-live")))
+	})
+
+	It("keeps orphans within the grace period", func(ctx SpecContext) {
+		sweeper.orphanedSince = map[types.UID]time.Time{"uid-claim-orphan": time.Now().Add(-time.Minute)}
+
+		sweeper.Sweep(ctx)
+
+		Expect(claimExists(ctx, c, "orphan")).To(BeTrue())
+	})
+
+	It("deletes orphans past the grace period", func(ctx SpecContext) {
+		sweeper.orphanedSince = map[types.UID]time.Time{"uid-claim-orphan": time.Now().Add(-2 * time.Hour)}
+
+		sweeper.Sweep(ctx)
+
+		Expect(claimExists(ctx, c, "orphan")).To(BeFalse())
+		Expect(claimExists(ctx, c, "live")).To(BeTrue())
+		Expect(sweeper.orphanedSince).To(BeEmpty())
+	})
+
+	It("only reports orphans in dry run mode", func(ctx SpecContext) {
+		sweeper.DryRun = true
+		sweeper.orphanedSince = map[types.UID]time.Time{"uid-claim-orphan": time.Now().Add(-2 * time.Hour)}
+
+		sweeper.Sweep(ctx)
+
+		Expect(claimExists(ctx, c, "orphan")).To(BeTrue())
+	})
+
+	It("forgets resources that stopped being orphans", func(ctx SpecContext) {
+		sweeper.orphanedSince = map[types.UID]time.Time{"uid-gone": time.Now().Add(-30 * time.Minute)}
+
+		sweeper.Sweep(ctx)
+
+		Expect(sweeper.orphanedSince).NotTo(HaveKey(types.UID("uid-gone")))
+	})
+})
+
+var _ = Describe("isOrphaned", func() {
+	existing := map[types.NamespacedName]types.UID{{Namespace: "images", Name: "ubuntu"}: "uid-live"}
+
+	DescribeTable("tells whether the VMDiskImage of a resource is gone",
+		func(namespace string, labels map[string]string, orphaned bool) {
+			obj := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Labels: labels}}
+			Expect(isOrphaned(obj, existing)).To(Equal(orphaned))
+		},
+		Entry("resources of existing VMDiskImages", "images",
+			map[string]string{crdv1.VMDiskImageNameLabel: "ubuntu", crdv1.VMDiskImageUIDLabel: "uid-live"}, false),
+		Entry("resources of deleted VMDiskImages", "images",
+			map[string]string{crdv1.VMDiskImageNameLabel: "debian", crdv1.VMDiskImageUIDLabel: "uid-other"}, true),
+		Entry("resources of replaced VMDiskImages", "images",
+			map[string]string{crdv1.VMDiskImageNameLabel: "ubuntu", crdv1.VMDiskImageUIDLabel: "uid-replaced"}, true),
+		Entry("snapshot copies in other namespaces", "vms",
+			map[string]string{
+				crdv1.VMDiskImageNameLabel:            "ubuntu",
+				crdv1.VMDiskImageUIDLabel:             "uid-live",
+				crdv1.VMDiskImageSourceNamespaceLabel: "images",
+			}, false),
+	)
+})
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var ErrPreflightFailed = errors.New("the preflight checks failed")
+
+// The keys CDI reads from the secretRef of a source. S3, HTTP and registry
+// sources all authenticate with the same pair.
+var requiredSecretKeys = []string{"accessKeyId", "secretKey"}
+
+// Check that the Secrets and ConfigMaps the disks of a VMDiskImage refer to
+// exist and hold what the importer needs, so a broken reference fails before
+// the VMDiskImage takes a sync slot instead of deep inside the importer.
+func (p K8sVMDIProvisioner) Preflight(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	var problems []string
+
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.SecretRef != "" {
+			problem, err := p.checkSecret(ctx, vmdi.Namespace, disk.SecretRef, requiredSecretKeys)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				problems = append(problems, diskProblem(disk, problem))
+			}
+		}
+
+		for _, secretName := range disk.SecretExtraHeaders {
+			problem, err := p.checkSecret(ctx, vmdi.Namespace, secretName, nil)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				problems = append(problems, diskProblem(disk, problem))
+			}
+		}
+
+		if disk.CertConfigMap != nil && *disk.CertConfigMap != "" {
+			problem, err := p.checkConfigMap(ctx, vmdi.Namespace, *disk.CertConfigMap)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				problems = append(problems, diskProblem(disk, problem))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrPreflightFailed, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Prefix a problem with the disk it was found on. Single disk VMDiskImages
+// have one unnamed disk so there is nothing to prefix.
+func diskProblem(disk crdv1.VMDiskImageDisk, problem string) string {
+	if disk.Name == "" {
+		return problem
+	}
+
+	return fmt.Sprintf("disk %s: %s", disk.Name, problem)
+}
+
+// Describe what is wrong with a Secret, or return an empty string when it is usable.
+func (p K8sVMDIProvisioner) checkSecret(ctx context.Context, namespace, name string, keys []string) (string, error) {
+	secret := &corev1.Secret{}
+	err := p.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret)
+	if apierrors.IsNotFound(err) {
+		return fmt.Sprintf("the secret %s does not exist", name), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get the secret %s: %w", name, err)
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if _, found := secret.Data[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Sprintf("the secret %s is missing the keys %s", name, strings.Join(missing, ", ")), nil
+	}
+
+	return "", nil
+}
+
+// Describe what is wrong with a ConfigMap, or return an empty string when it is usable.
+func (p K8sVMDIProvisioner) checkConfigMap(ctx context.Context, namespace, name string) (string, error) {
+	configMap := &corev1.ConfigMap{}
+	err := p.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, configMap)
+	if apierrors.IsNotFound(err) {
+		return fmt.Sprintf("the configmap %s does not exist", name), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get the configmap %s: %w", name, err)
+	}
+	if len(configMap.Data) == 0 && len(configMap.BinaryData) == 0 {
+		return fmt.Sprintf("the configmap %s is empty", name), nil
+	}
+
+	return "", nil
+}
+
+// Whether a VMDiskImage refers to the named Secret or ConfigMap from any of
+// its disks. The kind is passed along since watches only see the metadata of
+// the object.
+func ReferencesObject(vmdi *crdv1.VMDiskImage, kind string, obj client.Object) bool {
+	if vmdi.Namespace != obj.GetNamespace() {
+		return false
+	}
+
+	for _, disk := range vmdi.Spec.GetDisks() {
+		switch kind {
+		case "Secret":
+			if disk.SecretRef == obj.GetName() || slices.Contains(disk.SecretExtraHeaders, obj.GetName()) {
+				return true
+			}
+		case "ConfigMap":
+			if ptr.Deref(disk.CertConfigMap, "") == obj.GetName() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
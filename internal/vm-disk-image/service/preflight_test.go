@@ -0,0 +1,91 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+var _ = Describe("Preflight", func() {
+	credentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"},
+		Data:       map[string][]byte{"accessKeyId": []byte("id"), "secretKey": []byte("key")},
+	}
+
+	It("passes disks whose references hold what the importer needs", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient(credentials)}
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "s3", SecretRef: "credentials"},
+			},
+		}
+
+		Expect(provisioner.Preflight(ctx, vmdi)).To(Succeed())
+	})
+
+	It("describes the problems of a single disk without a disk prefix", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient()}
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "s3", SecretRef: "missing"},
+			},
+		}
+
+		err := provisioner.Preflight(ctx, vmdi)
+		Expect(err).To(MatchError(ErrPreflightFailed))
+		Expect(err).To(MatchError(ContainSubstring(": the secret missing does not exist")))
+		Expect(err.Error()).NotTo(ContainSubstring("disk"))
+	})
+
+	It("names the disk of each problem of a multi-disk VMDiskImage", func(ctx SpecContext) {
+		empty := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "default"}}
+		provisioner := K8sVMDIProvisioner{Client: newFakeClient(empty)}
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default"},
+			Spec: crdv1.VMDiskImageSpec{
+				Disks: []crdv1.VMDiskImageDisk{
+					{Name: "root", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "s3", SecretRef: "empty"}},
+					{Name: "data", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", CertConfigMap: ptr.To("certs")}},
+				},
+			},
+		}
+
+		err := provisioner.Preflight(ctx, vmdi)
+		Expect(err).To(MatchError(ContainSubstring("disk root: the secret empty is missing the keys accessKeyId, secretKey")))
+		Expect(err).To(MatchError(ContainSubstring("disk data: the configmap certs does not exist")))
+	})
+})
+
+var _ = Describe("ReferencesObject", func() {
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default"},
+		Spec: crdv1.VMDiskImageSpec{
+			VMDiskSpec: crdv1.VMDiskSpec{
+				SecretRef:          "credentials",
+				SecretExtraHeaders: []string{"token"},
+				CertConfigMap:      ptr.To("certs"),
+			},
+		},
+	}
+	metadataOf := func(namespace string, name string) *metav1.PartialObjectMetadata {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+
+	It("matches the Secrets and ConfigMaps of the disks by their metadata", func() {
+		Expect(ReferencesObject(vmdi, "Secret", metadataOf("default", "credentials"))).To(BeTrue())
+		Expect(ReferencesObject(vmdi, "Secret", metadataOf("default", "token"))).To(BeTrue())
+		Expect(ReferencesObject(vmdi, "ConfigMap", metadataOf("default", "certs"))).To(BeTrue())
+	})
+
+	It("ignores other kinds, names and namespaces", func() {
+		Expect(ReferencesObject(vmdi, "ConfigMap", metadataOf("default", "credentials"))).To(BeFalse())
+		Expect(ReferencesObject(vmdi, "Secret", metadataOf("default", "certs"))).To(BeFalse())
+		Expect(ReferencesObject(vmdi, "Secret", metadataOf("other", "credentials"))).To(BeFalse())
+	})
+})
@@ -8,27 +8,71 @@ import (
 	"strings"
 	"time"
 
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	crutils "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 type VMDiskImageProvisioner interface {
+	Preflight(ctx context.Context, resource *crdv1.VMDiskImage) error
+	ProbeSources(ctx context.Context, resource *crdv1.VMDiskImage) error
 	CreateResources(ctx context.Context, resource *crdv1.VMDiskImage) error
 	TearDownAllResources(ctx context.Context, resource *crdv1.VMDiskImage) error
+	RemainingResources(ctx context.Context, resource *crdv1.VMDiskImage) ([]client.Object, error)
+	ForceRemoveResources(ctx context.Context, resources []client.Object) error
+	ReleaseResources(ctx context.Context, resource *crdv1.VMDiskImage, deletionPolicy string) (int, error)
+	AdoptResources(ctx context.Context, resource *crdv1.VMDiskImage) (bool, error)
+	RemoveFinalizer(ctx context.Context, resource *crdv1.VMDiskImage) error
+	CollectFailureDiagnostics(ctx context.Context, resource *crdv1.VMDiskImage, failure error) (string, error)
+	RetainFailedResources(ctx context.Context, resource *crdv1.VMDiskImage) (int, error)
 	ResourcesAreReady(ctx context.Context, resource *crdv1.VMDiskImage) (bool, error)
 	ResourcesHaveErrors(ctx context.Context, resource *crdv1.VMDiskImage) error
+	RefreshDiskStatuses(ctx context.Context, resource *crdv1.VMDiskImage) error
+	DistributeSnapshots(ctx context.Context, resource *crdv1.VMDiskImage) error
+	PublishDataSources(ctx context.Context, resource *crdv1.VMDiskImage) error
+	FindConsumers(ctx context.Context, resource *crdv1.VMDiskImage) ([]crdv1.VMDiskImageConsumer, error)
 }
 
 type K8sVMDIProvisioner struct {
 	client.Client
-	ResourceGenerator      VMDIResourceGenerator
-	MaxSyncAttemptDuration time.Duration
-	MaxSyncAttemptRetries  int
+	ResourceGenerator VMDIResourceGenerator
+	RegistryClient    RegistryClient
+	SourceProbe       SourceProbe
+	SniffSourceFormat bool
+	// How much larger than their source disks without a diskSize are made.
+	DiskSizeOverheadPercent int
+	// Reads importer pod logs and Events when a sync fails. Nothing is
+	// collected without it.
+	Diagnostics DiagnosticsReader
+	// How many failure diagnostics are kept per VMDiskImage and how large each may be.
+	RetainedFailureDiagnostics int
+	FailureDiagnosticsMaxBytes int
+	MaxSyncAttemptDuration     time.Duration
+	MaxSyncAttemptRetries      int
+	// Whether the cluster serves the KubeVirt VirtualMachine API. VirtualMachines
+	// are only looked at for consumers when it does.
+	VirtualMachinesAvailable bool
+	// Whether there is an image to run checksum jobs with. Disks with a
+	// checksum fail verification without one.
+	ChecksumVerification bool
+	// Whether there is an image to run import jobs with. Disks with a
+	// bandwidth limit fail to import without one.
+	ImportJobs bool
+	// Hands out the upload tokens of the import jobs.
+	UploadTokens UploadTokenIssuer
+	// The ConfigMap whose ca-bundle.crt verifies CDI's upload proxy.
+	UploadProxyCABundle types.NamespacedName
+	// Child resources are also found by the legacy owner label until it has
+	// migrated them.
+	LegacyLabelMigrator *LegacyLabelMigrator
 }
 
 const dataVolumeDonePhase = "Succeeded"
@@ -36,36 +80,51 @@ const dataVolumeDonePhase = "Succeeded"
 var ErrMissingSourceArtifact = errors.New("the requested artifact does not exist")
 var ErrSyncAttemptExceedsRetries = errors.New("the sync attempt has failed beyond the retry limit")
 var ErrSyncAttemptExceedsMaxDuration = errors.New("the sync attempt has lasted beyond its max duration")
+var ErrSnapshotFailed = errors.New("the snapshot of the synced data failed")
 
 // Create resources for a given VMDiskImage. Stops creating them if
-// a single resource fails to create. Does not cleanup after itself
+// a single resource fails to create. Does not cleanup after itself.
+// Registry images are pinned to the digests ProbeSources recorded.
 func (p K8sVMDIProvisioner) CreateResources(
 	ctx context.Context,
 	vmdi *crdv1.VMDiskImage,
 ) error {
 	logger := logf.FromContext(ctx)
 
-	vs, dv, err := p.ResourceGenerator.CreateStorageManifests(vmdi)
-	if err != nil {
-		logger.Error(err, "Failed to create the storage manifests for VMDiskImage", vmdi.Name)
+	if err := p.verifyCloneSources(ctx, vmdi); err != nil {
+		logger.Error(err, "Cannot clone the source volumes of VMDiskImage", "name", vmdi.Name)
 		return err
 	}
 
-	// Create the Data volume
-	err = p.Patch(ctx, dv, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+	manifests, err := p.ResourceGenerator.CreateStorageManifests(vmdi)
 	if err != nil {
-		logger.Error(err, "Failed to create the backing datavolume for ", vmdi.Name, " within the cluster")
+		logger.Error(err, "Failed to create the storage manifests for VMDiskImage", "name", vmdi.Name)
 		return err
 	}
 
-	// Create the volume snapshot
-	err = p.Patch(ctx, vs, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
-	if err != nil {
-		logger.Error(err, "Failed to create the backing volumesnapshot for ", vmdi.Name, " within the cluster")
-		return err
+	for _, disk := range manifests {
+		// Create the Data volume
+		err = p.Patch(ctx, disk.DataVolume, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+		if err != nil {
+			logger.Error(err, "Failed to create the backing datavolume within the cluster", "name", vmdi.Name, "disk", disk.Disk.Name)
+			return err
+		}
+
+		// Disks snapshotted as a group get their snapshot once every disk is
+		// synced and disks with a checksum once their data is verified.
+		if disk.VolumeSnapshot == nil || disk.Disk.Checksum != nil {
+			continue
+		}
+
+		// Create the volume snapshot
+		err = p.Patch(ctx, disk.VolumeSnapshot, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+		if err != nil {
+			logger.Error(err, "Failed to create the backing volumesnapshot within the cluster", "name", vmdi.Name, "disk", disk.Disk.Name)
+			return err
+		}
 	}
 
-	return err
+	return nil
 }
 
 // Tear down the resources associated with a given VMDiskImage.
@@ -75,8 +134,37 @@ func (p K8sVMDIProvisioner) TearDownAllResources(
 ) error {
 	deleteByLabels := getLabelsToMatch(vmdi)
 
-	// First we tear down the PVCs that back the data volumes
-	err := p.DeleteAllOf(
+	// First we tear down the copies of our snapshots in other namespaces
+	err := p.removeUntargetedCopies(ctx, vmdi, nil)
+	if err != nil {
+		return err
+	}
+
+	// Then the DataSources pointing at our disks
+	err = p.DeleteAllOf(
+		ctx,
+		&cdiv1beta1.DataSource{},
+		client.InNamespace(vmdi.Namespace),
+		deleteByLabels,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Then the checksum and import jobs, along with the upload secrets of the latter
+	err = p.DeleteAllOf(
+		ctx,
+		&batchv1.Job{},
+		client.InNamespace(vmdi.Namespace),
+		deleteByLabels,
+		client.PropagationPolicy(metav1.DeletePropagationBackground),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Then the PVCs that back the data volumes
+	err = p.DeleteAllOf(
 		ctx,
 		&corev1.PersistentVolumeClaim{},
 		client.InNamespace(vmdi.Namespace),
@@ -97,7 +185,20 @@ func (p K8sVMDIProvisioner) TearDownAllResources(
 		return err
 	}
 
-	// Finally the volumesnapshots
+	// Then the group snapshot if the disks were snapshotted together
+	if p.ResourceGenerator.UsesGroupSnapshot(vmdi) {
+		err = p.DeleteAllOf(
+			ctx,
+			&groupsnapshotv1beta2.VolumeGroupSnapshot{},
+			client.InNamespace(vmdi.Namespace),
+			deleteByLabels,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Then the volumesnapshots
 	err = p.DeleteAllOf(
 		ctx,
 		&snapshotv1.VolumeSnapshot{},
@@ -108,43 +209,82 @@ func (p K8sVMDIProvisioner) TearDownAllResources(
 		return err
 	}
 
-	// If we have a finalizer remove it.
-	if crutils.ContainsFinalizer(vmdi, crdv1.VMDiskImageFinalizer) {
-		crutils.RemoveFinalizer(vmdi, crdv1.VMDiskImageFinalizer)
-		if err := p.Update(ctx, vmdi); err != nil {
-			return err
+	// Finally whatever has not been migrated off the legacy owner label yet
+	legacy, err := p.legacyChildren(ctx, vmdi)
+	if err != nil {
+		return err
+	}
+	for _, obj := range legacy {
+		if err := client.IgnoreNotFound(p.Delete(ctx, obj)); err != nil {
+			return fmt.Errorf("failed to delete %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
 		}
 	}
 
 	return nil
 }
 
-// This function will check if the datavolumes assoicated with our VMDiskImage
-// are ready. Currently we only check if the datavolumes are done syncing in our
-// manual process. We do not check if any of the other resources are ready.
+// This function will check if the resources of every disk of our VMDiskImage
+// are ready. A disk is ready once its datavolume is done syncing, its data
+// matches its checksum if it has one and the snapshot of its data can be used.
 func (p K8sVMDIProvisioner) ResourcesAreReady(
 	ctx context.Context,
 	vmdi *crdv1.VMDiskImage,
 ) (bool, error) {
-	searchLabels := getLabelsToMatch(vmdi)
-	listOps := []client.ListOption{
-		searchLabels,
+	dataVolumes, err := p.getDataVolumesByName(ctx, vmdi)
+	if err != nil {
+		return false, err
 	}
 
-	dataVolumeList := &cdiv1beta1.DataVolumeList{}
-	if err := p.List(ctx, dataVolumeList, listOps...); err != nil {
-		return false, fmt.Errorf("failed to list data volumes with the vm disk image %s: %w", vmdi.Name, err)
+	if err := p.runImportJobs(ctx, vmdi, dataVolumes); err != nil {
+		return false, err
 	}
 
-	dataVolumesReady := true
-	for _, dv := range dataVolumeList.Items {
-		if dv.Status.Phase != dataVolumeDonePhase {
-			dataVolumesReady = false
-			break
+	for _, disk := range vmdi.Spec.GetDisks() {
+		dv, found := dataVolumes[diskResourceName(vmdi, disk)]
+		if !found || dv.Status.Phase != dataVolumeDonePhase {
+			return false, nil
 		}
 	}
 
-	return dataVolumesReady, nil
+	checksumsVerified, err := p.checksumsAreVerified(ctx, vmdi)
+	if err != nil || !checksumsVerified {
+		return false, err
+	}
+
+	if p.ResourceGenerator.UsesGroupSnapshot(vmdi) {
+		return p.groupSnapshotIsReady(ctx, vmdi)
+	}
+
+	snapshots, err := p.getVolumeSnapshotsByName(ctx, vmdi)
+	if err != nil {
+		return false, err
+	}
+
+	manifests, err := p.ResourceGenerator.CreateStorageManifests(vmdi)
+	if err != nil {
+		return false, err
+	}
+
+	allReady := true
+	for _, disk := range manifests {
+		vs, found := snapshots[disk.VolumeSnapshot.Name]
+		if found {
+			allReady = allReady && volumeSnapshotIsReady(vs)
+			continue
+		}
+
+		// The snapshot of a verified disk is created once its data is verified
+		allReady = false
+		if disk.Disk.Checksum == nil {
+			continue
+		}
+		err := p.Patch(ctx, disk.VolumeSnapshot, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+		if err != nil {
+			return false, fmt.Errorf("failed to create the volumesnapshot of the disk %s: %w", disk.Disk.Name, err)
+		}
+	}
+
+	return allReady, nil
 }
 
 // Check if our resources have errors that would require us to
@@ -182,17 +322,12 @@ func (p K8sVMDIProvisioner) ResourcesHaveErrors(
 		return ErrSyncAttemptExceedsMaxDuration
 	}
 
-	searchLabels := getLabelsToMatch(vmdi)
-	listOps := []client.ListOption{
-		searchLabels,
-	}
-	dataVolumeList := &cdiv1beta1.DataVolumeList{}
-
-	if err := p.List(ctx, dataVolumeList, listOps...); err != nil {
-		return fmt.Errorf("failed to list datavolumes with the VMDiskImage %s: %w", vmdi.Name, err)
+	dataVolumes, err := p.getDataVolumesByName(ctx, vmdi)
+	if err != nil {
+		return err
 	}
 
-	for _, dv := range dataVolumeList.Items {
+	for _, dv := range dataVolumes {
 		for _, cond := range dv.Status.Conditions {
 			missingSourceArtifact := strings.Contains(cond.Message, "404") || strings.Contains(strings.ToLower(cond.Message), "not found")
 			if missingSourceArtifact {
@@ -206,12 +341,192 @@ func (p K8sVMDIProvisioner) ResourcesHaveErrors(
 
 	}
 
+	if err := p.importErrors(ctx, vmdi); err != nil {
+		return err
+	}
+
+	if err := p.checksumErrors(ctx, vmdi); err != nil {
+		return err
+	}
+
+	if p.ResourceGenerator.UsesGroupSnapshot(vmdi) {
+		vgs := &groupsnapshotv1beta2.VolumeGroupSnapshot{}
+		err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: vmdi.Name}, vgs)
+		if client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to get the volumegroupsnapshot of the VMDiskImage %s: %w", vmdi.Name, err)
+		}
+		if err == nil && vgs.Status != nil && vgs.Status.Error != nil {
+			return fmt.Errorf("%w: %s", ErrSnapshotFailed, ptr.Deref(vgs.Status.Error.Message, "unknown error"))
+		}
+
+		return nil
+	}
+
+	snapshots, err := p.getVolumeSnapshotsByName(ctx, vmdi)
+	if err != nil {
+		return err
+	}
+
+	for _, vs := range snapshots {
+		if vs.Status != nil && vs.Status.Error != nil {
+			return fmt.Errorf("%w: %s", ErrSnapshotFailed, ptr.Deref(vs.Status.Error.Message, "unknown error"))
+		}
+	}
+
+	return nil
+}
+
+// Record the state of the resources backing each disk on the status of our
+// VMDiskImage. The caller is responsible for persisting the status.
+func (p K8sVMDIProvisioner) RefreshDiskStatuses(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	dataVolumes, err := p.getDataVolumesByName(ctx, vmdi)
+	if err != nil {
+		return err
+	}
+
+	usesGroupSnapshot := p.ResourceGenerator.UsesGroupSnapshot(vmdi)
+
+	var snapshots map[string]snapshotv1.VolumeSnapshot
+	var groupMembers map[string]groupSnapshotMember
+	groupSnapshotReady := false
+	if usesGroupSnapshot {
+		var content *groupsnapshotv1beta2.VolumeGroupSnapshotContent
+		content, groupMembers, err = p.getGroupSnapshotMembers(ctx, vmdi)
+		groupSnapshotReady = content != nil
+	} else {
+		snapshots, err = p.getVolumeSnapshotsByName(ctx, vmdi)
+	}
+	if err != nil {
+		return err
+	}
+
+	disks := vmdi.Spec.GetDisks()
+	statuses := make([]crdv1.VMDiskImageDiskStatus, 0, len(disks))
+	for _, disk := range disks {
+		name := diskResourceName(vmdi, disk)
+		status := crdv1.VMDiskImageDiskStatus{
+			Name:           disk.Name,
+			DataVolumeName: name,
+		}
+
+		if dv, found := dataVolumes[name]; found {
+			status.Phase = string(dv.Status.Phase)
+			status.Progress = string(dv.Status.Progress)
+			if runningCondition := findDataVolumeCondition(dv, cdiv1beta1.DataVolumeRunning); runningCondition != nil {
+				status.Message = runningCondition.Message
+			}
+		}
+
+		if disk.Checksum != nil {
+			result, err := p.getChecksumResult(ctx, vmdi, disk)
+			if err != nil {
+				return err
+			}
+			status.Checksum = checksumStatus(result, disk.Checksum)
+		}
+
+		if usesGroupSnapshot {
+			status.SnapshotName = groupMembers[disk.Name].SnapshotName
+			status.SnapshotReady = groupSnapshotReady
+		} else if vs, found := snapshots[name]; found {
+			status.SnapshotName = vs.Name
+			status.SnapshotReady = volumeSnapshotIsReady(vs)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	vmdi.Status.Disks = statuses
+	vmdi.Status.GroupSnapshotName = ""
+	if usesGroupSnapshot {
+		vmdi.Status.GroupSnapshotName = vmdi.Name
+	}
+
+	return nil
+}
+
+// The group snapshot can only capture the disks once every one of them is
+// done syncing, so it is created here rather than with the datavolumes.
+func (p K8sVMDIProvisioner) groupSnapshotIsReady(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (bool, error) {
+	vgs := p.ResourceGenerator.CreateGroupSnapshotManifest(vmdi)
+	err := p.Patch(ctx, vgs, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+	if err != nil {
+		return false, fmt.Errorf("failed to create the volumegroupsnapshot of the VMDiskImage %s: %w", vmdi.Name, err)
+	}
+
+	return vgs.Status != nil && ptr.Deref(vgs.Status.ReadyToUse, false), nil
+}
+
+func (p K8sVMDIProvisioner) getDataVolumesByName(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (map[string]cdiv1beta1.DataVolume, error) {
+	searchLabels := getLabelsToMatch(vmdi)
+	listOps := []client.ListOption{
+		client.InNamespace(vmdi.Namespace),
+		searchLabels,
+	}
+
+	dataVolumeList := &cdiv1beta1.DataVolumeList{}
+	if err := p.List(ctx, dataVolumeList, listOps...); err != nil {
+		return nil, fmt.Errorf("failed to list data volumes with the vm disk image %s: %w", vmdi.Name, err)
+	}
+
+	dataVolumes := make(map[string]cdiv1beta1.DataVolume, len(dataVolumeList.Items))
+	for _, dv := range dataVolumeList.Items {
+		dataVolumes[dv.Name] = dv
+	}
+
+	return dataVolumes, nil
+}
+
+func (p K8sVMDIProvisioner) getVolumeSnapshotsByName(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (map[string]snapshotv1.VolumeSnapshot, error) {
+	searchLabels := getLabelsToMatch(vmdi)
+	listOps := []client.ListOption{
+		client.InNamespace(vmdi.Namespace),
+		searchLabels,
+	}
+
+	snapshotList := &snapshotv1.VolumeSnapshotList{}
+	if err := p.List(ctx, snapshotList, listOps...); err != nil {
+		return nil, fmt.Errorf("failed to list volume snapshots with the vm disk image %s: %w", vmdi.Name, err)
+	}
+
+	snapshots := make(map[string]snapshotv1.VolumeSnapshot, len(snapshotList.Items))
+	for _, vs := range snapshotList.Items {
+		snapshots[vs.Name] = vs
+	}
+
+	return snapshots, nil
+}
+
+func volumeSnapshotIsReady(vs snapshotv1.VolumeSnapshot) bool {
+	return vs.Status != nil && ptr.Deref(vs.Status.ReadyToUse, false)
+}
+
+func findDataVolumeCondition(dv cdiv1beta1.DataVolume, conditionType cdiv1beta1.DataVolumeConditionType) *cdiv1beta1.DataVolumeCondition {
+	for i := range dv.Status.Conditions {
+		if dv.Status.Conditions[i].Type == conditionType {
+			return &dv.Status.Conditions[i]
+		}
+	}
+
 	return nil
 }
 
 func getLabelsToMatch(vmdi *crdv1.VMDiskImage) client.MatchingLabels {
 	labelsToMatch := map[string]string{
-		crdv1.VMDiskImageOwnerLabel: vmdi.Name,
+		crdv1.VMDiskImageNameLabel: vmdi.Name,
+		crdv1.VMDiskImageUIDLabel:  string(vmdi.UID),
 	}
 
 	return client.MatchingLabels(labelsToMatch)
@@ -0,0 +1,116 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("RefreshDiskStatuses", func() {
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "vmdi-uid"},
+		Spec: crdv1.VMDiskImageSpec{
+			Disks: []crdv1.VMDiskImageDisk{
+				{Name: "root", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"}},
+				{Name: "data", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"}},
+			},
+		},
+	}
+
+	// The objects CSI and the snapshot controller leave behind for a ready
+	// group snapshot of both disks.
+	groupSnapshotObjects := func() []client.Object {
+		objects := []client.Object{
+			&groupsnapshotv1beta2.VolumeGroupSnapshot{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+				Status: &groupsnapshotv1beta2.VolumeGroupSnapshotStatus{
+					ReadyToUse:                          ptr.To(true),
+					BoundVolumeGroupSnapshotContentName: ptr.To("group-content"),
+				},
+			},
+			&groupsnapshotv1beta2.VolumeGroupSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{Name: "group-content"},
+				Status: &groupsnapshotv1beta2.VolumeGroupSnapshotContentStatus{
+					VolumeSnapshotInfoList: []groupsnapshotv1beta2.VolumeSnapshotInfo{
+						{VolumeHandle: "volume-root", SnapshotHandle: "snapshot-root"},
+						{VolumeHandle: "volume-data", SnapshotHandle: "snapshot-data"},
+					},
+				},
+			},
+		}
+		for _, disk := range []string{"root", "data"} {
+			objects = append(objects,
+				&corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-" + disk, Namespace: "images"},
+					Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-" + disk},
+				},
+				&corev1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{Name: "pv-" + disk},
+					Spec: corev1.PersistentVolumeSpec{
+						PersistentVolumeSource: corev1.PersistentVolumeSource{
+							CSI: &corev1.CSIPersistentVolumeSource{Driver: "csi.example.com", VolumeHandle: "volume-" + disk},
+						},
+					},
+				},
+				&snapshotv1.VolumeSnapshot{
+					ObjectMeta: metav1.ObjectMeta{Name: "snapshot-abc-" + disk, Namespace: "images"},
+					Status: &snapshotv1.VolumeSnapshotStatus{
+						VolumeGroupSnapshotName:        ptr.To("ubuntu"),
+						BoundVolumeSnapshotContentName: ptr.To("content-" + disk),
+					},
+				},
+				&snapshotv1.VolumeSnapshotContent{
+					ObjectMeta: metav1.ObjectMeta{Name: "content-" + disk},
+					Status:     &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: ptr.To("snapshot-" + disk)},
+				},
+			)
+		}
+
+		return objects
+	}
+
+	It("records the snapshots the group snapshot took of each disk", func(ctx SpecContext) {
+		provisioner := K8sVMDIProvisioner{
+			Client:            newFakeClient(groupSnapshotObjects()...),
+			ResourceGenerator: &Generator{VolumeGroupSnapshotsAvailable: true},
+		}
+		refreshed := vmdi.DeepCopy()
+
+		Expect(provisioner.RefreshDiskStatuses(ctx, refreshed)).To(Succeed())
+		Expect(refreshed.Status.GroupSnapshotName).To(Equal("ubuntu"))
+		Expect(refreshed.Status.Disks).To(HaveLen(2))
+		Expect(refreshed.Status.Disks[0]).To(And(
+			HaveField("Name", "root"),
+			HaveField("SnapshotName", "snapshot-abc-root"),
+			HaveField("SnapshotReady", true),
+		))
+		Expect(refreshed.Status.Disks[1]).To(And(
+			HaveField("Name", "data"),
+			HaveField("SnapshotName", "snapshot-abc-data"),
+			HaveField("SnapshotReady", true),
+		))
+	})
+
+	It("leaves the snapshot names out until the group snapshot is ready", func(ctx SpecContext) {
+		objects := groupSnapshotObjects()
+		objects[0].(*groupsnapshotv1beta2.VolumeGroupSnapshot).Status.ReadyToUse = ptr.To(false)
+		provisioner := K8sVMDIProvisioner{
+			Client:            newFakeClient(objects...),
+			ResourceGenerator: &Generator{VolumeGroupSnapshotsAvailable: true},
+		}
+		refreshed := vmdi.DeepCopy()
+
+		Expect(provisioner.RefreshDiskStatuses(ctx, refreshed)).To(Succeed())
+		for _, disk := range refreshed.Status.Disks {
+			Expect(disk.SnapshotName).To(BeEmpty())
+			Expect(disk.SnapshotReady).To(BeFalse())
+		}
+	})
+})
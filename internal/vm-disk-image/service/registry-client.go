@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrInvalidImageReference = errors.New("the registry url is not a valid docker image reference")
+
+// The manifest types we accept, most specific last. Index types come first so
+// multi-arch images resolve to the digest of their index like `docker pull`.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// RegistryCredentials are the username and password used to log into a
+// registry, read from the accessKeyId and secretKey of a CDI secret.
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
+// RegistryClient talks to container registries on behalf of the operator.
+type RegistryClient interface {
+	// ResolveDigest returns the digest the tag of an image currently points at.
+	// It returns an error wrapping ErrMissingSourceArtifact when there is no
+	// such image.
+	ResolveDigest(ctx context.Context, image RegistryImage, credentials *RegistryCredentials, caBundle []byte) (string, error)
+}
+
+// HTTPRegistryClient speaks the OCI distribution API directly.
+type HTTPRegistryClient struct {
+	Timeout time.Duration
+}
+
+// RegistryImage is a parsed docker://host/repository:tag@digest reference.
+type RegistryImage struct {
+	Host       string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Parse a CDI registry url. Images without a registry host come from Docker
+// Hub like they do for `docker pull`.
+func ParseRegistryImage(rawURL string) (RegistryImage, error) {
+	reference, found := strings.CutPrefix(rawURL, "docker://")
+	if !found || reference == "" {
+		return RegistryImage{}, fmt.Errorf("%w: %s", ErrInvalidImageReference, rawURL)
+	}
+
+	image := RegistryImage{}
+	reference, image.Digest, _ = strings.Cut(reference, "@")
+
+	host, path, hasHost := strings.Cut(reference, "/")
+	if !hasHost || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		host, path = "docker.io", reference
+	}
+	if host == "docker.io" && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+
+	lastSlash := strings.LastIndex(path, "/")
+	if colon := strings.LastIndex(path, ":"); colon > lastSlash {
+		path, image.Tag = path[:colon], path[colon+1:]
+	}
+	if image.Tag == "" && image.Digest == "" {
+		image.Tag = "latest"
+	}
+
+	image.Host = host
+	image.Repository = path
+	if image.Repository == "" {
+		return RegistryImage{}, fmt.Errorf("%w: %s", ErrInvalidImageReference, rawURL)
+	}
+
+	return image, nil
+}
+
+// The url importing exactly the given digest of the image.
+func (i RegistryImage) PinnedURL(digest string) string {
+	return "docker://" + i.Host + "/" + i.Repository + "@" + digest
+}
+
+func (i RegistryImage) reference() string {
+	if i.Digest != "" {
+		return i.Digest
+	}
+
+	return i.Tag
+}
+
+// Docker Hub serves its API from a different host than its image names use.
+func (i RegistryImage) apiHost() string {
+	if i.Host == "docker.io" {
+		return "registry-1.docker.io"
+	}
+
+	return i.Host
+}
+
+func (c HTTPRegistryClient) ResolveDigest(
+	ctx context.Context,
+	image RegistryImage,
+	credentials *RegistryCredentials,
+	caBundle []byte,
+) (string, error) {
+	httpClient, err := c.httpClient(caBundle)
+	if err != nil {
+		return "", err
+	}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", image.apiHost(), image.Repository, image.reference())
+	response, err := c.getManifest(ctx, httpClient, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+
+	// Registries tell us how to authenticate when we try without credentials
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		_ = response.Body.Close()
+
+		authorization, err := c.authorize(ctx, httpClient, challenge, credentials)
+		if err != nil {
+			return "", err
+		}
+		response, err = c.getManifest(ctx, httpClient, manifestURL, authorization)
+		if err != nil {
+			return "", err
+		}
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return "", fmt.Errorf("%w: the image %s/%s:%s does not exist", ErrMissingSourceArtifact, image.Host, image.Repository, image.reference())
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get the manifest of %s/%s: %s", image.Host, image.Repository, response.Status)
+	}
+
+	if digest := response.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// Not every registry sends the digest so we compute it ourselves
+	hash := sha256.New()
+	if _, err := io.Copy(hash, response.Body); err != nil {
+		return "", fmt.Errorf("failed to read the manifest of %s/%s: %w", image.Host, image.Repository, err)
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c HTTPRegistryClient) httpClient(caBundle []byte) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caBundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("the cert config map does not hold any PEM encoded certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+func (c HTTPRegistryClient) getManifest(
+	ctx context.Context,
+	httpClient *http.Client,
+	manifestURL string,
+	authorization string,
+) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	return httpClient.Do(request)
+}
+
+// Answer a WWW-Authenticate challenge with either basic auth or a bearer token
+// from the registry's token service.
+func (c HTTPRegistryClient) authorize(
+	ctx context.Context,
+	httpClient *http.Client,
+	challenge string,
+	credentials *RegistryCredentials,
+) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if credentials == nil {
+			return "", errors.New("the registry requires credentials but no secretRef was provided")
+		}
+		request, _ := http.NewRequest(http.MethodGet, "", nil)
+		request.SetBasicAuth(credentials.Username, credentials.Password)
+		return request.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry authentication challenge %q", challenge)
+	}
+
+	fields := parseChallengeParams(params)
+	tokenURL, err := url.Parse(fields["realm"])
+	if err != nil || fields["realm"] == "" {
+		return "", fmt.Errorf("invalid registry token realm %q", fields["realm"])
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value := fields[key]; value != "" {
+			query.Set(key, value)
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credentials != nil {
+		request.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get a registry token: %s", response.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to read the registry token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+// Parse the key="value" pairs of a WWW-Authenticate challenge.
+func parseChallengeParams(params string) map[string]string {
+	fields := map[string]string{}
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(params, "=")
+		key = strings.TrimSpace(key)
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+			params = strings.TrimPrefix(params, ",")
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		fields[key] = value
+	}
+
+	return fields
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseRegistryImage", func() {
+	DescribeTable("parses CDI registry urls",
+		func(rawURL string, expected RegistryImage) {
+			Expect(ParseRegistryImage(rawURL)).To(Equal(expected))
+		},
+		Entry("official Docker Hub images", "docker://ubuntu",
+			RegistryImage{Host: "docker.io", Repository: "library/ubuntu", Tag: "latest"}),
+		Entry("tagged Docker Hub images", "docker://ubuntu:22.04",
+			RegistryImage{Host: "docker.io", Repository: "library/ubuntu", Tag: "22.04"}),
+		Entry("user Docker Hub images", "docker://kubevirt/fedora-cloud-container-disk-demo",
+			RegistryImage{Host: "docker.io", Repository: "kubevirt/fedora-cloud-container-disk-demo", Tag: "latest"}),
+		Entry("other registries", "docker://quay.io/containerdisks/fedora:40",
+			RegistryImage{Host: "quay.io", Repository: "containerdisks/fedora", Tag: "40"}),
+		Entry("registries with a port", "docker://registry.local:5000/images/disk:v1",
+			RegistryImage{Host: "registry.local:5000", Repository: "images/disk", Tag: "v1"}),
+		Entry("localhost", "docker://localhost/disk",
+			RegistryImage{Host: "localhost", Repository: "disk", Tag: "latest"}),
+		Entry("digests", "docker://quay.io/containerdisks/fedora@sha256:abc",
+			RegistryImage{Host: "quay.io", Repository: "containerdisks/fedora", Digest: "sha256:abc"}),
+		Entry("tags and digests", "docker://quay.io/containerdisks/fedora:40@sha256:abc",
+			RegistryImage{Host: "quay.io", Repository: "containerdisks/fedora", Tag: "40", Digest: "sha256:abc"}),
+	)
+
+	DescribeTable("rejects urls that are not registry images",
+		func(rawURL string) {
+			_, err := ParseRegistryImage(rawURL)
+			Expect(err).To(MatchError(ErrInvalidImageReference))
+		},
+		Entry("other schemes", "https://quay.io/containerdisks/fedora"),
+		Entry("empty references", "docker://"),
+		Entry("empty repositories", "docker://quay.io/"),
+	)
+
+	It("pins an image to a digest", func() {
+		image, err := ParseRegistryImage("docker://ubuntu:22.04")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(image.PinnedURL("sha256:abc")).To(Equal("docker://docker.io/library/ubuntu@sha256:abc"))
+	})
+})
+
+var _ = Describe("HTTPRegistryClient.ResolveDigest", func() {
+	manifest := []byte(`{"schemaVersion":2}`)
+	manifestSum := sha256.Sum256(manifest)
+	computedDigest := "sha256:" + hex.EncodeToString(manifestSum[:])
+
+	var server *httptest.Server
+	var caBundle []byte
+	var challenge string
+	var tokenRequests []*http.Request
+
+	BeforeEach(func() {
+		challenge = ""
+		tokenRequests = nil
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				tokenRequests = append(tokenRequests, r)
+				if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				_, _ = fmt.Fprint(w, `{"access_token":"secret-token"}`)
+				return
+			}
+
+			authorized := r.Header.Get("Authorization") == "Bearer secret-token"
+			if username, password, _ := r.BasicAuth(); username == "user" && password == "pass" {
+				authorized = true
+			}
+			if challenge != "" && !authorized {
+				w.Header().Set("WWW-Authenticate", challenge)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/missing/manifests/latest"):
+				w.WriteHeader(http.StatusNotFound)
+			case strings.HasSuffix(r.URL.Path, "/gone/manifests/latest"):
+				w.WriteHeader(http.StatusGone)
+			case strings.HasSuffix(r.URL.Path, "/nodigest/manifests/latest"):
+				_, _ = w.Write(manifest)
+			case !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json"):
+				w.WriteHeader(http.StatusNotAcceptable)
+			default:
+				w.Header().Set("Docker-Content-Digest", "sha256:served")
+				_, _ = w.Write(manifest)
+			}
+		}))
+		DeferCleanup(server.Close)
+		caBundle = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	})
+
+	resolve := func(ctx SpecContext, repository string, credentials *RegistryCredentials) (string, error) {
+		image := RegistryImage{Host: server.Listener.Addr().String(), Repository: repository, Tag: "latest"}
+		return HTTPRegistryClient{}.ResolveDigest(ctx, image, credentials, caBundle)
+	}
+
+	It("reads the digest the registry sends", func(ctx SpecContext) {
+		Expect(resolve(ctx, "images/disk", nil)).To(Equal("sha256:served"))
+	})
+
+	It("computes the digest when the registry does not send it", func(ctx SpecContext) {
+		Expect(resolve(ctx, "images/nodigest", nil)).To(Equal(computedDigest))
+	})
+
+	It("gets a token from the realm of a bearer challenge", func(ctx SpecContext) {
+		challenge = fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:images/disk:pull"`, server.URL)
+
+		Expect(resolve(ctx, "images/disk", &RegistryCredentials{Username: "user", Password: "pass"})).To(Equal("sha256:served"))
+		Expect(tokenRequests).To(HaveLen(1))
+		Expect(tokenRequests[0].URL.Query().Get("service")).To(Equal("registry"))
+		Expect(tokenRequests[0].URL.Query().Get("scope")).To(Equal("repository:images/disk:pull"))
+	})
+
+	It("fails when the token service rejects the credentials", func(ctx SpecContext) {
+		challenge = fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, server.URL)
+
+		_, err := resolve(ctx, "images/disk", &RegistryCredentials{Username: "user", Password: "wrong"})
+		Expect(err).To(MatchError(ContainSubstring("failed to get a registry token")))
+	})
+
+	It("answers a basic challenge with the credentials", func(ctx SpecContext) {
+		challenge = `Basic realm="registry"`
+
+		Expect(resolve(ctx, "images/disk", &RegistryCredentials{Username: "user", Password: "pass"})).To(Equal("sha256:served"))
+
+		_, err := resolve(ctx, "images/disk", nil)
+		Expect(err).To(MatchError(ContainSubstring("requires credentials")))
+	})
+
+	DescribeTable("reports images that do not exist",
+		func(ctx SpecContext, repository string) {
+			_, err := resolve(ctx, repository, nil)
+			Expect(err).To(MatchError(ErrMissingSourceArtifact))
+		},
+		Entry("404", "images/missing"),
+		Entry("410", "images/gone"),
+	)
+})
+
+var _ = Describe("parseChallengeParams", func() {
+	It("parses quoted and bare values", func() {
+		Expect(parseChallengeParams(`realm="https://auth.docker.io/token",service="registry.docker.io",scope=repository:library/ubuntu:pull`)).To(Equal(map[string]string{
+			"realm":   "https://auth.docker.io/token",
+			"service": "registry.docker.io",
+			"scope":   "repository:library/ubuntu:pull",
+		}))
+	})
+})
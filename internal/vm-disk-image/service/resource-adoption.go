@@ -0,0 +1,330 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var ErrAdoptionSourceNotFound = errors.New("the resource to adopt does not exist")
+var ErrAdoptionIncompatible = errors.New("the resource to adopt is not compatible with the disk")
+
+// The existing resources a disk is adopted from. Snapshot is set when a
+// VolumeSnapshot is adopted, Claim when a PVC is. DataVolume is set when the
+// adopted PVC is controlled by one, which is then adopted along with it.
+type adoptedResources struct {
+	Disk       crdv1.VMDiskImageDisk
+	Snapshot   *snapshotv1.VolumeSnapshot
+	Claim      *corev1.PersistentVolumeClaim
+	DataVolume *cdiv1beta1.DataVolume
+}
+
+// Whether a VMDiskImage takes existing resources under management instead of
+// importing its data.
+func AdoptsResources(vmdi *crdv1.VMDiskImage) bool {
+	if vmdi.Annotations[crdv1.VMDiskImageAdoptAnnotation] == "true" {
+		return true
+	}
+
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.Adopt != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The disks of a VMDiskImage are adopted all together or imported. The CRD
+// rejects a mix, but VMDiskImages created before it did are only caught here.
+func checkAdoptedDisks(vmdi *crdv1.VMDiskImage) error {
+	if vmdi.Annotations[crdv1.VMDiskImageAdoptAnnotation] == "true" {
+		return nil
+	}
+
+	var imported []string
+	for _, disk := range vmdi.Spec.GetDisks() {
+		if disk.Adopt == nil {
+			imported = append(imported, disk.Name)
+		}
+	}
+	if len(imported) > 0 {
+		return fmt.Errorf("%w: the disks %q do not set adopt, either every disk or none of them must", ErrAdoptionIncompatible, imported)
+	}
+
+	return nil
+}
+
+// How the resource of a disk is adopted. The adopt annotation adopts the
+// VolumeSnapshot or PVC named like the resources of the disk.
+func adoptionOf(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) crdv1.VMDiskImageAdoption {
+	if disk.Adopt != nil {
+		return *disk.Adopt
+	}
+
+	return crdv1.VMDiskImageAdoption{Name: diskResourceName(vmdi, disk)}
+}
+
+// Take the existing resources of every disk under management. Nothing is
+// changed unless all of them are compatible with their disk. Adopted PVCs are
+// snapshotted in place. Returns whether the snapshots of all disks are ready.
+// The disk statuses are updated but the caller is responsible for persisting
+// them.
+func (p K8sVMDIProvisioner) AdoptResources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (bool, error) {
+	disks := vmdi.Spec.GetDisks()
+	if err := checkAdoptedDisks(vmdi); err != nil {
+		return false, err
+	}
+
+	adoptions := make([]adoptedResources, 0, len(disks))
+	for _, disk := range disks {
+		adopted, err := p.findAdoptedResources(ctx, vmdi, disk)
+		if err != nil {
+			return false, err
+		}
+		if err := checkAdoptionCompatibility(vmdi, adopted); err != nil {
+			return false, err
+		}
+		adoptions = append(adoptions, adopted)
+	}
+
+	allReady := true
+	statuses := make([]crdv1.VMDiskImageDiskStatus, 0, len(adoptions))
+	for _, adopted := range adoptions {
+		status := crdv1.VMDiskImageDiskStatus{Name: adopted.Disk.Name}
+
+		snapshot := adopted.Snapshot
+		if snapshot != nil {
+			if err := p.adopt(ctx, vmdi, adopted.Disk, snapshot); err != nil {
+				return false, err
+			}
+			status.Message = "Adopted the VolumeSnapshot " + snapshot.Name
+		} else {
+			if adopted.DataVolume != nil {
+				if err := p.adopt(ctx, vmdi, adopted.Disk, adopted.DataVolume); err != nil {
+					return false, err
+				}
+				status.DataVolumeName = adopted.DataVolume.Name
+			}
+			if err := p.adopt(ctx, vmdi, adopted.Disk, adopted.Claim); err != nil {
+				return false, err
+			}
+			status.Message = "Adopted the PersistentVolumeClaim " + adopted.Claim.Name
+
+			snapshot = p.ResourceGenerator.CreateAdoptedSnapshotManifest(vmdi, adopted.Disk, adopted.Claim.Name)
+			err := p.Patch(ctx, snapshot, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+			if err != nil {
+				return false, fmt.Errorf("failed to snapshot the adopted PVC %s: %w", adopted.Claim.Name, err)
+			}
+		}
+
+		status.SnapshotName = snapshot.Name
+		status.SnapshotReady = volumeSnapshotIsReady(*snapshot)
+		allReady = allReady && status.SnapshotReady
+		statuses = append(statuses, status)
+	}
+	vmdi.Status.Disks = statuses
+
+	return allReady, nil
+}
+
+func (p K8sVMDIProvisioner) findAdoptedResources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) (adoptedResources, error) {
+	adoption := adoptionOf(vmdi, disk)
+	adopted := adoptedResources{Disk: disk}
+
+	if adoption.Kind != crdv1.AdoptKindPersistentVolumeClaim {
+		snapshot := &snapshotv1.VolumeSnapshot{}
+		found, err := p.findAdoptionSource(ctx, vmdi, adoption, snapshot, &snapshotv1.VolumeSnapshotList{})
+		if err != nil {
+			return adopted, err
+		}
+		if found {
+			adopted.Snapshot = snapshot
+			return adopted, nil
+		}
+		if adoption.Kind == crdv1.AdoptKindVolumeSnapshot {
+			return adopted, fmt.Errorf("%w: no VolumeSnapshot found for the disk %q", ErrAdoptionSourceNotFound, disk.Name)
+		}
+	}
+
+	claim := &corev1.PersistentVolumeClaim{}
+	found, err := p.findAdoptionSource(ctx, vmdi, adoption, claim, &corev1.PersistentVolumeClaimList{})
+	if err != nil {
+		return adopted, err
+	}
+	if !found {
+		return adopted, fmt.Errorf("%w: no PersistentVolumeClaim found for the disk %q", ErrAdoptionSourceNotFound, disk.Name)
+	}
+	adopted.Claim = claim
+
+	// CDI made the PVC for a DataVolume so the DataVolume is adopted too
+	controller := metav1.GetControllerOf(claim)
+	if controller != nil && controller.Kind == "DataVolume" {
+		dataVolume := &cdiv1beta1.DataVolume{}
+		err := p.Get(ctx, client.ObjectKey{Namespace: claim.Namespace, Name: controller.Name}, dataVolume)
+		if client.IgnoreNotFound(err) != nil {
+			return adopted, fmt.Errorf("failed to get the datavolume of the PVC %s: %w", claim.Name, err)
+		}
+		if err == nil {
+			adopted.DataVolume = dataVolume
+		}
+	}
+
+	return adopted, nil
+}
+
+// Find the resource to adopt by name, or by selector in which case exactly one
+// resource has to match.
+func (p K8sVMDIProvisioner) findAdoptionSource(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	adoption crdv1.VMDiskImageAdoption,
+	obj client.Object,
+	list client.ObjectList,
+) (bool, error) {
+	if adoption.Selector == nil {
+		name := adoption.Name
+		err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: name}, obj)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get the resource %s to adopt: %w", name, err)
+		}
+		return true, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(adoption.Selector)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid selector: %w", ErrAdoptionIncompatible, err)
+	}
+	if err := p.List(ctx, list, client.InNamespace(vmdi.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return false, fmt.Errorf("failed to list the resources to adopt: %w", err)
+	}
+	objs, err := extractObjects(list)
+	if err != nil {
+		return false, err
+	}
+
+	switch len(objs) {
+	case 0:
+		return false, nil
+	case 1:
+		return true, p.Get(ctx, client.ObjectKeyFromObject(objs[0]), obj)
+	default:
+		return false, fmt.Errorf("%w: the selector matches %d resources", ErrAdoptionIncompatible, len(objs))
+	}
+}
+
+// Adopted resources must be usable, hold at least as much data as the disk
+// asks for and live on the requested classes.
+func checkAdoptionCompatibility(vmdi *crdv1.VMDiskImage, adopted adoptedResources) error {
+	disk := adopted.Disk
+
+	var diskSize *resource.Quantity
+	if disk.DiskSize != "" {
+		size, err := resource.ParseQuantity(disk.DiskSize)
+		if err != nil {
+			return fmt.Errorf("%w: invalid disk size %q: %w", ErrAdoptionIncompatible, disk.DiskSize, err)
+		}
+		diskSize = &size
+	}
+
+	if snapshot := adopted.Snapshot; snapshot != nil {
+		if err := checkAdoptionOwner(vmdi, snapshot); err != nil {
+			return err
+		}
+		if !snapshot.DeletionTimestamp.IsZero() {
+			return fmt.Errorf("%w: the VolumeSnapshot %s is being deleted", ErrAdoptionIncompatible, snapshot.Name)
+		}
+		if snapshot.Status != nil && snapshot.Status.Error != nil {
+			return fmt.Errorf("%w: the VolumeSnapshot %s failed: %s", ErrAdoptionIncompatible, snapshot.Name, ptr.Deref(snapshot.Status.Error.Message, ""))
+		}
+		restoreSize := snapshot.Status != nil && snapshot.Status.RestoreSize != nil
+		if diskSize != nil && restoreSize && snapshot.Status.RestoreSize.Cmp(*diskSize) < 0 {
+			return fmt.Errorf("%w: the VolumeSnapshot %s restores to %s which is smaller than %s", ErrAdoptionIncompatible, snapshot.Name, snapshot.Status.RestoreSize.String(), disk.DiskSize)
+		}
+		if disk.SnapshotClass != nil && ptr.Deref(snapshot.Spec.VolumeSnapshotClassName, "") != *disk.SnapshotClass {
+			return fmt.Errorf("%w: the VolumeSnapshot %s does not use the snapshot class %s", ErrAdoptionIncompatible, snapshot.Name, *disk.SnapshotClass)
+		}
+		return nil
+	}
+
+	claim := adopted.Claim
+	if adopted.DataVolume != nil {
+		if err := checkAdoptionOwner(vmdi, adopted.DataVolume); err != nil {
+			return err
+		}
+		if adopted.DataVolume.Status.Phase != dataVolumeDonePhase {
+			return fmt.Errorf("%w: the DataVolume %s has not succeeded", ErrAdoptionIncompatible, adopted.DataVolume.Name)
+		}
+	} else if err := checkAdoptionOwner(vmdi, claim); err != nil {
+		return err
+	}
+	if !claim.DeletionTimestamp.IsZero() {
+		return fmt.Errorf("%w: the PVC %s is being deleted", ErrAdoptionIncompatible, claim.Name)
+	}
+	if claim.Status.Phase != corev1.ClaimBound {
+		return fmt.Errorf("%w: the PVC %s is not bound", ErrAdoptionIncompatible, claim.Name)
+	}
+	capacity, hasCapacity := claim.Status.Capacity[corev1.ResourceStorage]
+	if diskSize != nil && hasCapacity && capacity.Cmp(*diskSize) < 0 {
+		return fmt.Errorf("%w: the PVC %s holds %s which is smaller than %s", ErrAdoptionIncompatible, claim.Name, capacity.String(), disk.DiskSize)
+	}
+	if disk.StorageClass != nil && ptr.Deref(claim.Spec.StorageClassName, "") != *disk.StorageClass {
+		return fmt.Errorf("%w: the PVC %s does not use the storage class %s", ErrAdoptionIncompatible, claim.Name, *disk.StorageClass)
+	}
+
+	return nil
+}
+
+// A resource already controlled by something other than our VMDiskImage is
+// never taken over.
+func checkAdoptionOwner(vmdi *crdv1.VMDiskImage, obj client.Object) error {
+	controller := metav1.GetControllerOf(obj)
+	if controller != nil && controller.UID != vmdi.UID {
+		return fmt.Errorf("%w: %s is controlled by the %s %s", ErrAdoptionIncompatible, obj.GetName(), controller.Kind, controller.Name)
+	}
+
+	return nil
+}
+
+// Label an adopted resource like the ones we create and make our VMDiskImage
+// its controller unless something else, like CDI for PVCs, already is.
+func (p K8sVMDIProvisioner) adopt(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	obj client.Object,
+) error {
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+
+	obj.SetLabels(withDiskLabel(withOperatorLabels(obj.GetLabels(), vmdi), disk))
+	if metav1.GetControllerOf(obj) == nil {
+		obj.SetOwnerReferences(append(obj.GetOwnerReferences(), createOwnerReferences(vmdi)...))
+	}
+
+	if err := p.Patch(ctx, obj, patch); err != nil {
+		return fmt.Errorf("failed to adopt %s: %w", obj.GetName(), err)
+	}
+
+	return nil
+}
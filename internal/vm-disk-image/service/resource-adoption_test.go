@@ -0,0 +1,44 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("checkAdoptedDisks", func() {
+	adopt := &crdv1.VMDiskImageAdoption{Kind: crdv1.AdoptKindVolumeSnapshot}
+
+	vmdiWith := func(disks ...crdv1.VMDiskImageDisk) *crdv1.VMDiskImage {
+		return &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "default"},
+			Spec:       crdv1.VMDiskImageSpec{Disks: disks},
+		}
+	}
+
+	It("accepts VMDiskImages adopting every disk", func() {
+		vmdi := vmdiWith(
+			crdv1.VMDiskImageDisk{Name: "root", VMDiskSpec: crdv1.VMDiskSpec{Adopt: adopt}},
+			crdv1.VMDiskImageDisk{Name: "data", VMDiskSpec: crdv1.VMDiskSpec{Adopt: adopt}},
+		)
+		Expect(checkAdoptedDisks(vmdi)).To(Succeed())
+	})
+
+	It("accepts the adopt annotation on disks without adopt", func() {
+		vmdi := vmdiWith(crdv1.VMDiskImageDisk{Name: "root"}, crdv1.VMDiskImageDisk{Name: "data"})
+		vmdi.Annotations = map[string]string{crdv1.VMDiskImageAdoptAnnotation: "true"}
+		Expect(checkAdoptedDisks(vmdi)).To(Succeed())
+	})
+
+	It("rejects VMDiskImages mixing adopted and imported disks", func() {
+		vmdi := vmdiWith(
+			crdv1.VMDiskImageDisk{Name: "root", VMDiskSpec: crdv1.VMDiskSpec{Adopt: adopt}},
+			crdv1.VMDiskImageDisk{Name: "data", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"}},
+		)
+		err := checkAdoptedDisks(vmdi)
+		Expect(err).To(MatchError(ErrAdoptionIncompatible))
+		Expect(err.Error()).To(ContainSubstring(`["data"]`))
+	})
+})
@@ -2,11 +2,16 @@ package service
 
 import (
 	"errors"
+	"fmt"
 	"maps"
+	"strings"
+	"time"
 
 	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
 
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/utils/ptr"
@@ -15,63 +20,520 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// The url CRD default for disks that do not set one.
+const urlNotProvided = "not-provided"
+
 type VMDIResourceGenerator interface {
-	CreateStorageManifests(vmdi *crdv1.VMDiskImage) (*snapshotv1.VolumeSnapshot, *cdiv1beta1.DataVolume, error)
+	CreateStorageManifests(vmdi *crdv1.VMDiskImage) ([]DiskStorageManifests, error)
+	CreateGroupSnapshotManifest(vmdi *crdv1.VMDiskImage) *groupsnapshotv1beta2.VolumeGroupSnapshot
+	UsesGroupSnapshot(vmdi *crdv1.VMDiskImage) bool
+	ResolveSourceURL(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string
+	CreateAdoptedSnapshotManifest(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk, claimName string) *snapshotv1.VolumeSnapshot
+	CreateSnapshotCopyManifests(
+		vmdi *crdv1.VMDiskImage,
+		disk crdv1.VMDiskImageDisk,
+		namespace string,
+		source SnapshotSource,
+	) (*snapshotv1.VolumeSnapshotContent, *snapshotv1.VolumeSnapshot)
+	CreateDataSourceManifest(
+		vmdi *crdv1.VMDiskImage,
+		disk crdv1.VMDiskImageDisk,
+		source cdiv1beta1.DataSourceSource,
+	) *cdiv1beta1.DataSource
+	CreateChecksumJobManifest(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) *batchv1.Job
+	CreateImportJobManifest(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) *batchv1.Job
+	CreateUploadSecretManifest(job *batchv1.Job, token string, caBundle []byte) *corev1.Secret
+	UsesImportJob(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) bool
+}
+
+// Where the storage snapshot of a disk lives. Copies of the disk's snapshot
+// are pre-provisioned against the same handle.
+type SnapshotSource struct {
+	Driver            string
+	SnapshotHandle    string
+	SnapshotClassName *string
 }
 
-type Generator struct{}
+// The storage resources backing a single disk of a VMDiskImage. The
+// VolumeSnapshot is nil when the disk is snapshotted through a
+// VolumeGroupSnapshot instead.
+type DiskStorageManifests struct {
+	Disk           crdv1.VMDiskImageDisk
+	DataVolume     *cdiv1beta1.DataVolume
+	VolumeSnapshot *snapshotv1.VolumeSnapshot
+}
+
+type Generator struct {
+	// Whether the cluster serves the VolumeGroupSnapshot API. When it does
+	// the disks of a multi-disk VMDiskImage are snapshotted as a group.
+	VolumeGroupSnapshotsAvailable bool
+	// The image checksum jobs run cmd/checksum-verifier from, usually the
+	// operator's own.
+	ChecksumVerifierImage string
+	// The image import jobs run cmd/disk-importer from, usually the
+	// operator's own.
+	DiskImporterImage string
+	// Where import jobs upload the artifacts they download to.
+	UploadProxyURL string
+	// The urls of disks without one are built from these templates, keyed by
+	// source type, for VMDiskImages with an image identity.
+	URLTemplates map[string]string
+	// Whether DataVolumes are created with spec.storage rather than spec.pvc
+	// for disks that do not choose.
+	StorageAPI bool
+	// Decides which labels of a VMDiskImage are copied to its child resources.
+	LabelFilter LabelFilter
+	// Where the import and checksum jobs of VMDiskImages without an importer
+	// placement run.
+	DefaultImporterPlacement *crdv1.VMDiskImagePlacement
+}
 
 func (g *Generator) CreateStorageManifests(
 	vmdi *crdv1.VMDiskImage,
-) (*snapshotv1.VolumeSnapshot, *cdiv1beta1.DataVolume, error) {
-	volumeSnapshot := createVolumeSnapshot(vmdi)
+) ([]DiskStorageManifests, error) {
+	disks := vmdi.Spec.GetDisks()
+	useGroupSnapshot := g.UsesGroupSnapshot(vmdi)
 
-	dataVolume, err := createDataVolume(vmdi)
-	if err != nil {
-		return nil, nil, err
+	manifests := make([]DiskStorageManifests, 0, len(disks))
+	for _, disk := range disks {
+		disk.URL = g.ResolveSourceURL(vmdi, disk)
+		dataVolume, err := g.createDataVolume(vmdi, disk)
+		if err != nil {
+			return nil, err
+		}
+
+		diskManifests := DiskStorageManifests{
+			Disk:       disk,
+			DataVolume: dataVolume,
+		}
+		if !useGroupSnapshot {
+			diskManifests.VolumeSnapshot = g.createVolumeSnapshot(vmdi, disk, diskResourceName(vmdi, disk))
+		}
+
+		manifests = append(manifests, diskManifests)
 	}
 
-	return volumeSnapshot, dataVolume, nil
+	return manifests, nil
 }
 
-func createDataVolume(vmdi *crdv1.VMDiskImage) (*cdiv1beta1.DataVolume, error) {
-	ownerReferences := createOwnerReferences(vmdi)
+// A group snapshot keeps the disks of a multi-disk VMDiskImage crash
+// consistent with each other. It is only used when the cluster supports it
+// and the data of the disks is imported rather than adopted.
+func (g *Generator) UsesGroupSnapshot(vmdi *crdv1.VMDiskImage) bool {
+	return g.VolumeGroupSnapshotsAvailable && len(vmdi.Spec.Disks) > 1 && !AdoptsResources(vmdi)
+}
 
+// The url a disk is imported from. A disk without a url of its own gets one
+// from the template of its source type when the VMDiskImage names its image.
+func (g *Generator) ResolveSourceURL(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	if disk.URL != "" && disk.URL != urlNotProvided {
+		return disk.URL
+	}
+
+	template, found := g.URLTemplates[disk.SourceType]
+	if !found || vmdi.Spec.Image == nil {
+		return disk.URL
+	}
+
+	return strings.NewReplacer(
+		"{{name}}", vmdi.Spec.Image.Name,
+		"{{version}}", vmdi.Spec.Image.Version,
+		"{{disk}}", disk.Name,
+	).Replace(template)
+}
+
+// The snapshot of an adopted PVC is named like the resources of its disk.
+func (g *Generator) CreateAdoptedSnapshotManifest(
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	claimName string,
+) *snapshotv1.VolumeSnapshot {
+	return g.createVolumeSnapshot(vmdi, disk, claimName)
+}
+
+func (g *Generator) CreateGroupSnapshotManifest(vmdi *crdv1.VMDiskImage) *groupsnapshotv1beta2.VolumeGroupSnapshot {
 	meta := metav1.ObjectMeta{
 		Name:            vmdi.Name,
 		Namespace:       vmdi.Namespace,
-		Labels:          withOperatorLabels(vmdi.Labels, vmdi.Name),
-		OwnerReferences: ownerReferences,
-		Annotations: map[string]string{
-			"cdi.kubevirt.io/storage.bind.immediate.requested": "true",
+		Labels:          withOperatorLabels(withSnapshotTemplateLabels(g.LabelFilter.Filter(vmdi.Labels), vmdi), vmdi),
+		Annotations:     snapshotTemplateAnnotations(vmdi),
+		OwnerReferences: createOwnerReferences(vmdi),
+	}
+
+	spec := groupsnapshotv1beta2.VolumeGroupSnapshotSpec{
+		Source: groupsnapshotv1beta2.VolumeGroupSnapshotSource{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: getLabelsToMatch(vmdi),
+			},
 		},
+		VolumeGroupSnapshotClassName: vmdi.Spec.VolumeGroupSnapshotClass,
 	}
 
-	diskSizeResource, err := resource.ParseQuantity(vmdi.Spec.DiskSize)
-	if err != nil {
-		return nil, err
+	return &groupsnapshotv1beta2.VolumeGroupSnapshot{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "groupsnapshot.storage.k8s.io/v1beta2",
+			Kind:       "VolumeGroupSnapshot",
+		},
+		ObjectMeta: meta,
+		Spec:       spec,
 	}
+}
 
-	pvc := &corev1.PersistentVolumeClaimSpec{
-		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
-		Resources: corev1.VolumeResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceStorage: diskSizeResource,
+// Create a pre-provisioned VolumeSnapshotContent and VolumeSnapshot pair that
+// exposes the snapshot of a disk in another namespace. The content retains the
+// storage snapshot on deletion since it is shared with the original snapshot.
+func (g *Generator) CreateSnapshotCopyManifests(
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	namespace string,
+	source SnapshotSource,
+) (*snapshotv1.VolumeSnapshotContent, *snapshotv1.VolumeSnapshot) {
+	snapshotName := diskResourceName(vmdi, disk)
+	contentName := snapshotCopyContentName(vmdi, disk, namespace)
+	labels := withCopyLabels(withDiskLabel(g.childLabels(vmdi), disk), vmdi)
+
+	content := &snapshotv1.VolumeSnapshotContent{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "snapshot.storage.k8s.io/v1",
+			Kind:       "VolumeSnapshotContent",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   contentName,
+			Labels: labels,
+		},
+		Spec: snapshotv1.VolumeSnapshotContentSpec{
+			VolumeSnapshotRef: corev1.ObjectReference{
+				Name:      snapshotName,
+				Namespace: namespace,
+			},
+			DeletionPolicy:          snapshotv1.VolumeSnapshotContentRetain,
+			Driver:                  source.Driver,
+			VolumeSnapshotClassName: source.SnapshotClassName,
+			Source: snapshotv1.VolumeSnapshotContentSource{
+				SnapshotHandle: &source.SnapshotHandle,
 			},
 		},
 	}
 
-	if vmdi.Spec.StorageClass != nil {
-		pvc.StorageClassName = vmdi.Spec.StorageClass
+	snapshot := &snapshotv1.VolumeSnapshot{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "snapshot.storage.k8s.io/v1",
+			Kind:       "VolumeSnapshot",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshotName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: snapshotv1.VolumeSnapshotSpec{
+			Source: snapshotv1.VolumeSnapshotSource{
+				VolumeSnapshotContentName: &contentName,
+			},
+			VolumeSnapshotClassName: source.SnapshotClassName,
+		},
+	}
+
+	return content, snapshot
+}
+
+// Create the CDI DataSource publishing a disk of a Ready VMDiskImage.
+func (g *Generator) CreateDataSourceManifest(
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	source cdiv1beta1.DataSourceSource,
+) *cdiv1beta1.DataSource {
+	meta := metav1.ObjectMeta{
+		Name:            dataSourceName(vmdi, disk),
+		Namespace:       vmdi.Namespace,
+		Labels:          withDiskLabel(g.childLabels(vmdi), disk),
+		OwnerReferences: createOwnerReferences(vmdi),
+	}
+
+	return &cdiv1beta1.DataSource{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "cdi.kubevirt.io/v1beta1",
+			Kind:       "DataSource",
+		},
+		ObjectMeta: meta,
+		Spec: cdiv1beta1.DataSourceSpec{
+			Source: source,
+		},
+	}
+}
+
+// Create the job hashing the source artifact of a disk. It runs
+// cmd/checksum-verifier with the disk's credentials, CA bundle and headers and
+// reports the digest through its termination message.
+func (g *Generator) CreateChecksumJobManifest(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) *batchv1.Job {
+	// The artifact is hashed as it is stored rather than the volume, which
+	// holds whatever CDI converted and resized it to
+	container := corev1.Container{
+		Name:    "checksum",
+		Image:   g.ChecksumVerifierImage,
+		Command: []string{ChecksumVerifierBinary},
+		Env: []corev1.EnvVar{
+			{Name: ChecksumAlgorithmEnv, Value: disk.Checksum.Algorithm},
+		},
+	}
+
+	return g.createSourceJob(vmdi, disk, checksumJobName(vmdi, disk), container, nil)
+}
+
+// Create the job importing the source artifact of a disk in place of CDI's
+// importer. It runs cmd/disk-importer, which downloads the artifact at the
+// bandwidth limit of the sync, if it has one, and uploads it to the disk's
+// DataVolume through CDI's upload proxy with the token of the job's upload
+// secret.
+func (g *Generator) CreateImportJobManifest(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) *batchv1.Job {
+	name := importJobName(vmdi, disk)
+	container := corev1.Container{
+		Name:    "import",
+		Image:   g.DiskImporterImage,
+		Command: []string{DiskImporterBinary},
+		Env: []corev1.EnvVar{
+			{Name: ImportBandwidthLimitEnv, Value: vmdi.Status.BandwidthLimit},
+			{Name: ImportUploadProxyURLEnv, Value: g.UploadProxyURL},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "upload", MountPath: ImportUploadDir, ReadOnly: true},
+		},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "upload",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: name},
+			},
+		},
+	}
+
+	job := g.createSourceJob(vmdi, disk, name, container, volumes)
+	// The bandwidth CNI plugin enforces the limit too where it is installed
+	if vmdi.Status.BandwidthLimit != "" {
+		job.Spec.Template.Annotations = map[string]string{ingressBandwidthAnnotation: vmdi.Status.BandwidthLimit}
+	}
+
+	return job
+}
+
+// Create the secret holding the upload token and the CA bundle of CDI's
+// upload proxy for an import job. It belongs to the job so it goes away with
+// it.
+func (g *Generator) CreateUploadSecretManifest(job *batchv1.Job, token string, caBundle []byte) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name,
+			Namespace: job.Namespace,
+			Labels:    job.Labels,
+			Annotations: map[string]string{
+				uploadTokenIssuedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "batch/v1",
+					Kind:       "Job",
+					Name:       job.Name,
+					UID:        job.UID,
+				},
+			},
+		},
+		Data: map[string][]byte{
+			ImportUploadTokenKey: []byte(token),
+			ImportUploadCAKey:    caBundle,
+		},
+	}
+}
+
+// Whether a disk is imported by an import job of the operator rather than by
+// CDI. Only http and s3 artifacts can be, and only those with a bandwidth
+// limit or a placement are since CDI's importer pods can neither be throttled
+// nor placed per DataVolume.
+func (g *Generator) UsesImportJob(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) bool {
+	return isDownloadSource(disk) && (vmdi.Status.BandwidthLimit != "" || g.importerPlacement(vmdi) != nil)
+}
+
+// The placement of the pods downloading the disks of a VMDiskImage, nil when
+// the scheduler decides.
+func (g *Generator) importerPlacement(vmdi *crdv1.VMDiskImage) *crdv1.VMDiskImagePlacement {
+	if vmdi.Spec.ImporterPlacement != nil {
+		return vmdi.Spec.ImporterPlacement
+	}
+
+	return g.DefaultImporterPlacement
+}
+
+// Create a job running a binary of the operator's image against the source
+// artifact of a disk. The container is given the disk's source, credentials,
+// CA bundle and headers the way cmd/checksum-verifier and cmd/disk-importer
+// read them, and the pod is placed like the VMDiskImage's importers.
+func (g *Generator) createSourceJob(
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	name string,
+	container corev1.Container,
+	volumes []corev1.Volume,
+) *batchv1.Job {
+	meta := metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       vmdi.Namespace,
+		Labels:          withDiskLabel(g.childLabels(vmdi), disk),
+		OwnerReferences: createOwnerReferences(vmdi),
+	}
+
+	env := []corev1.EnvVar{
+		{Name: ChecksumSourceTypeEnv, Value: disk.SourceType},
+		{Name: ChecksumSourceURLEnv, Value: g.ResolveSourceURL(vmdi, disk)},
+	}
+	if status := sourceStatusOf(vmdi, disk); status != nil && status.ETag != "" {
+		env = append(env, corev1.EnvVar{Name: ChecksumSourceETagEnv, Value: status.ETag})
+	}
+	if disk.SecretRef != "" {
+		env = append(env,
+			secretKeyEnv(ChecksumAccessKeyEnv, disk.SecretRef, "accessKeyId"),
+			secretKeyEnv(ChecksumSecretKeyEnv, disk.SecretRef, "secretKey"),
+		)
+	}
+	if len(disk.ExtraHeaders) > 0 {
+		env = append(env, corev1.EnvVar{Name: ChecksumExtraHeadersEnv, Value: strings.Join(disk.ExtraHeaders, "\n")})
+	}
+	container.Env = append(env, container.Env...)
+
+	if disk.CertConfigMap != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: "certs",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: *disk.CertConfigMap},
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "certs", MountPath: ChecksumCertsDir, ReadOnly: true})
+	}
+	for i, secretName := range disk.SecretExtraHeaders {
+		volumeName := fmt.Sprintf("headers-%d", i)
+		volumes = append(volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: fmt.Sprintf("%s/%d", ChecksumHeadersDir, i),
+			ReadOnly:  true,
+		})
+	}
+
+	container.SecurityContext = &corev1.SecurityContext{
+		AllowPrivilegeEscalation: ptr.To(false),
+		ReadOnlyRootFilesystem:   ptr.To(true),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+	podSpec := corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyNever,
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsNonRoot: ptr.To(true),
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		},
+		Containers: []corev1.Container{container},
+		Volumes:    volumes,
+	}
+	if placement := g.importerPlacement(vmdi); placement != nil {
+		podSpec.NodeSelector = placement.NodeSelector
+		podSpec.Tolerations = placement.Tolerations
+		podSpec.Affinity = placement.Affinity
+	}
+
+	return &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: meta,
+		Spec: batchv1.JobSpec{
+			BackoffLimit: ptr.To(int32(0)),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withDiskLabel(g.childLabels(vmdi), disk),
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+}
+
+func (g *Generator) createDataVolume(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) (*cdiv1beta1.DataVolume, error) {
+	ownerReferences := createOwnerReferences(vmdi)
+
+	template := ptr.Deref(vmdi.Spec.DataVolumeTemplate, crdv1.VMDiskImageDataVolumeTemplate{})
+
+	labels := g.LabelFilter.Filter(vmdi.Labels)
+	maps.Copy(labels, template.Labels)
+
+	annotations := map[string]string{}
+	maps.Copy(annotations, template.Annotations)
+	maps.Copy(annotations, template.ImporterPodAnnotations)
+	if ptr.Deref(template.ImmediateBinding, true) {
+		annotations["cdi.kubevirt.io/storage.bind.immediate.requested"] = "true"
+	}
+
+	meta := metav1.ObjectMeta{
+		Name:            diskResourceName(vmdi, disk),
+		Namespace:       vmdi.Namespace,
+		Labels:          withDiskLabel(withOperatorLabels(labels, vmdi), disk),
+		OwnerReferences: ownerReferences,
+		Annotations:     annotations,
+	}
+
+	diskSizeResource, err := resource.ParseQuantity(effectiveDiskSize(vmdi, disk))
+	if err != nil {
+		return nil, err
+	}
+
+	if isCloneSource(disk) && disk.SourceRef == nil {
+		return nil, errors.New("attempted to clone a volume but no sourceRef was provided")
 	}
 
 	var source *cdiv1beta1.DataVolumeSource
-	switch vmdi.Spec.SourceType {
+	switch disk.SourceType {
 	case "s3":
 		source = &cdiv1beta1.DataVolumeSource{
 			S3: &cdiv1beta1.DataVolumeSourceS3{
-				URL:       vmdi.Spec.URL,
-				SecretRef: vmdi.Spec.SecretRef,
+				URL:           disk.URL,
+				SecretRef:     disk.SecretRef,
+				CertConfigMap: ptr.Deref(disk.CertConfigMap, ""),
+			},
+		}
+	case "http":
+		source = &cdiv1beta1.DataVolumeSource{
+			HTTP: &cdiv1beta1.DataVolumeSourceHTTP{
+				URL:                disk.URL,
+				SecretRef:          disk.SecretRef,
+				CertConfigMap:      ptr.Deref(disk.CertConfigMap, ""),
+				ExtraHeaders:       disk.ExtraHeaders,
+				SecretExtraHeaders: disk.SecretExtraHeaders,
+			},
+		}
+	case "pvc":
+		source = &cdiv1beta1.DataVolumeSource{
+			PVC: &cdiv1beta1.DataVolumeSourcePVC{
+				Namespace: cloneSourceNamespace(vmdi, disk),
+				Name:      disk.SourceRef.Name,
+			},
+		}
+	case "snapshot":
+		source = &cdiv1beta1.DataVolumeSource{
+			Snapshot: &cdiv1beta1.DataVolumeSourceSnapshot{
+				Namespace: cloneSourceNamespace(vmdi, disk),
+				Name:      disk.SourceRef.Name,
 			},
 		}
 	case "blank":
@@ -79,22 +541,65 @@ func createDataVolume(vmdi *crdv1.VMDiskImage) (*cdiv1beta1.DataVolume, error) {
 			Blank: &cdiv1beta1.DataVolumeBlankImage{},
 		}
 	default:
-		if vmdi.Spec.CertConfigMap == nil {
-			errMsg := "attempted to create a datavolume without a registry but no certConfigMap was provided"
-			return nil, errors.New(errMsg)
+		registry := &cdiv1beta1.DataVolumeSourceRegistry{
+			URL:           ptr.To(registryImageURL(vmdi, disk)),
+			CertConfigMap: disk.CertConfigMap,
+		}
+		if disk.SecretRef != "" {
+			registry.SecretRef = &disk.SecretRef
+		}
+		if disk.Registry != nil {
+			if disk.Registry.PullMethod != "" {
+				registry.PullMethod = ptr.To(cdiv1beta1.RegistryPullMethod(disk.Registry.PullMethod))
+			}
+			if disk.Registry.ImageStream != nil {
+				registry.URL = nil
+				registry.ImageStream = disk.Registry.ImageStream
+			}
 		}
 		source = &cdiv1beta1.DataVolumeSource{
-			Registry: &cdiv1beta1.DataVolumeSourceRegistry{
-				URL:           &vmdi.Spec.URL,
-				CertConfigMap: vmdi.Spec.CertConfigMap,
-				SecretRef:     &vmdi.Spec.SecretRef,
-			},
+			Registry: registry,
+		}
+	}
+
+	// CDI waits for the import job to upload the artifact instead
+	if g.UsesImportJob(vmdi, disk) {
+		source = &cdiv1beta1.DataVolumeSource{
+			Upload: &cdiv1beta1.DataVolumeSourceUpload{},
 		}
 	}
 
 	spec := cdiv1beta1.DataVolumeSpec{
-		PVC:    pvc,
-		Source: source,
+		Source:            source,
+		ContentType:       cdiv1beta1.DataVolumeContentType(disk.ContentType),
+		Preallocation:     template.Preallocation,
+		PriorityClassName: template.PriorityClassName,
+	}
+
+	resources := corev1.VolumeResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceStorage: diskSizeResource,
+		},
+	}
+	if ptr.Deref(disk.StorageAPI, g.StorageAPI) {
+		// The StorageProfile fills in whatever the disk leaves out
+		spec.Storage = &cdiv1beta1.StorageSpec{
+			AccessModes:      disk.AccessModes,
+			VolumeMode:       disk.VolumeMode,
+			Resources:        resources,
+			StorageClassName: disk.StorageClass,
+		}
+	} else {
+		accessModes := disk.AccessModes
+		if len(accessModes) == 0 {
+			accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+		}
+		spec.PVC = &corev1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			VolumeMode:       disk.VolumeMode,
+			Resources:        resources,
+			StorageClassName: disk.StorageClass,
+		}
 	}
 
 	dv := &cdiv1beta1.DataVolume{
@@ -109,24 +614,26 @@ func createDataVolume(vmdi *crdv1.VMDiskImage) (*cdiv1beta1.DataVolume, error) {
 	return dv, nil
 }
 
-func createVolumeSnapshot(vmdi *crdv1.VMDiskImage) *snapshotv1.VolumeSnapshot {
+func (g *Generator) createVolumeSnapshot(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk, claimName string) *snapshotv1.VolumeSnapshot {
 	ownerReferences := createOwnerReferences(vmdi)
+	name := diskResourceName(vmdi, disk)
 
 	meta := metav1.ObjectMeta{
-		Name:            vmdi.Name,
+		Name:            name,
 		Namespace:       vmdi.Namespace,
-		Labels:          withOperatorLabels(vmdi.Labels, vmdi.Name),
+		Labels:          withDiskLabel(withOperatorLabels(withSnapshotTemplateLabels(g.LabelFilter.Filter(vmdi.Labels), vmdi), vmdi), disk),
+		Annotations:     snapshotTemplateAnnotations(vmdi),
 		OwnerReferences: ownerReferences,
 	}
 
 	spec := snapshotv1.VolumeSnapshotSpec{
 		Source: snapshotv1.VolumeSnapshotSource{
-			PersistentVolumeClaimName: &vmdi.Name,
+			PersistentVolumeClaimName: &claimName,
 		},
 	}
 
-	if vmdi.Spec.SnapshotClass != nil {
-		spec.VolumeSnapshotClassName = vmdi.Spec.SnapshotClass
+	if disk.SnapshotClass != nil {
+		spec.VolumeSnapshotClassName = disk.SnapshotClass
 	}
 
 	return &snapshotv1.VolumeSnapshot{
@@ -152,8 +659,83 @@ func createOwnerReferences(vmdi *crdv1.VMDiskImage) []metav1.OwnerReference {
 	}
 }
 
+// The name shared by the DataVolume, PVC and VolumeSnapshot of a disk. A
+// single disk VMDiskImage keeps using its own name for its children.
+func diskResourceName(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	if disk.Name == "" {
+		return vmdi.Name
+	}
+
+	return vmdi.Name + "-" + disk.Name
+}
+
+// The VolumeSnapshot of a disk is named like its other resources unless an
+// existing snapshot was adopted for it.
+func diskSnapshotName(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	if disk.Adopt != nil && disk.Adopt.Kind == crdv1.AdoptKindVolumeSnapshot {
+		if disk.Adopt.Name != "" {
+			return disk.Adopt.Name
+		}
+		for _, status := range vmdi.Status.Disks {
+			if status.Name == disk.Name && status.SnapshotName != "" {
+				return status.SnapshotName
+			}
+		}
+	}
+
+	return diskResourceName(vmdi, disk)
+}
+
+func secretKeyEnv(name string, secretName string, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func checksumJobName(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	return diskResourceName(vmdi, disk) + "-checksum"
+}
+
+func importJobName(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	return diskResourceName(vmdi, disk) + "-import"
+}
+
+// Image names may hold characters DataSource names cannot.
+var dataSourceNameReplacer = strings.NewReplacer("_", "-", ".", "-")
+
+// The DataSource name is shared by every VMDiskImage publishing the same image
+// so it must not depend on the name of the VMDiskImage itself. It defaults to
+// the image name so each version of an image publishes through the same one.
+func dataSourceName(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	name := vmdi.Name
+	if vmdi.Spec.Image != nil {
+		name = strings.ToLower(dataSourceNameReplacer.Replace(vmdi.Spec.Image.Name))
+	}
+	if vmdi.Spec.DataSource != nil && vmdi.Spec.DataSource.Name != "" {
+		name = vmdi.Spec.DataSource.Name
+	}
+
+	if disk.Name == "" {
+		return name
+	}
+
+	return name + "-" + disk.Name
+}
+
+// VolumeSnapshotContents are cluster scoped so the name of a copy has to
+// include both the namespace of the VMDiskImage and the target namespace.
+func snapshotCopyContentName(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk, namespace string) string {
+	return vmdi.Namespace + "-" + diskResourceName(vmdi, disk) + "-to-" + namespace
+}
+
 // Give our created resources a new map of labels
-func withOperatorLabels(labels map[string]string, ownerName string) map[string]string {
+func withOperatorLabels(labels map[string]string, vmdi *crdv1.VMDiskImage) map[string]string {
 	// 1. Create a brand new map
 	newLabels := make(map[string]string)
 
@@ -162,7 +744,51 @@ func withOperatorLabels(labels map[string]string, ownerName string) map[string]s
 		maps.Copy(newLabels, labels)
 	}
 
-	newLabels[crdv1.VMDiskImageOwnerLabel] = ownerName
+	newLabels[crdv1.VMDiskImageNameLabel] = vmdi.Name
+	newLabels[crdv1.VMDiskImageUIDLabel] = string(vmdi.UID)
+	if vmdi.Spec.Image != nil {
+		newLabels[crdv1.VMDiskImageImageNameLabel] = vmdi.Spec.Image.Name
+		newLabels[crdv1.VMDiskImageImageVersionLabel] = vmdi.Spec.Image.Version
+	}
 
 	return newLabels
 }
+
+// The labels of a child resource: those of its VMDiskImage that pass the
+// label filter plus the ones the operator manages.
+func (g *Generator) childLabels(vmdi *crdv1.VMDiskImage) map[string]string {
+	return withOperatorLabels(g.LabelFilter.Filter(vmdi.Labels), vmdi)
+}
+
+func withSnapshotTemplateLabels(labels map[string]string, vmdi *crdv1.VMDiskImage) map[string]string {
+	if vmdi.Spec.SnapshotTemplate != nil {
+		maps.Copy(labels, vmdi.Spec.SnapshotTemplate.Labels)
+	}
+
+	return labels
+}
+
+func snapshotTemplateAnnotations(vmdi *crdv1.VMDiskImage) map[string]string {
+	if vmdi.Spec.SnapshotTemplate == nil || len(vmdi.Spec.SnapshotTemplate.Annotations) == 0 {
+		return nil
+	}
+
+	return maps.Clone(vmdi.Spec.SnapshotTemplate.Annotations)
+}
+
+// Mark the resources of a named disk so they can be told apart.
+func withDiskLabel(labels map[string]string, disk crdv1.VMDiskImageDisk) map[string]string {
+	if disk.Name != "" {
+		labels[crdv1.VMDiskImageDiskLabel] = disk.Name
+	}
+
+	return labels
+}
+
+// Copies live outside of the VMDiskImage's namespace so the owner label alone
+// does not identify them.
+func withCopyLabels(labels map[string]string, vmdi *crdv1.VMDiskImage) map[string]string {
+	labels[crdv1.VMDiskImageSourceNamespaceLabel] = vmdi.Namespace
+
+	return labels
+}
@@ -0,0 +1,339 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+var _ = Describe("dataSourceName", func() {
+	DescribeTable("names the DataSource of a disk",
+		func(image *crdv1.VMDiskImageIdentity, dataSource *crdv1.VMDiskImageDataSource, disk string, expected string) {
+			vmdi := &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-2404-v3", Namespace: "images"},
+				Spec:       crdv1.VMDiskImageSpec{Image: image, DataSource: dataSource},
+			}
+			Expect(dataSourceName(vmdi, crdv1.VMDiskImageDisk{Name: disk})).To(Equal(expected))
+		},
+		Entry("after the VMDiskImage without an image", nil, nil, "", "ubuntu-2404-v3"),
+		Entry("after the image", &crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "v3"}, nil, "", "ubuntu"),
+		Entry("after the image made a valid name", &crdv1.VMDiskImageIdentity{Name: "Ubuntu_24.04", Version: "v3"}, nil, "", "ubuntu-24-04"),
+		Entry("after the configured name over the image",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "v3"}, &crdv1.VMDiskImageDataSource{Name: "golden"}, "", "golden"),
+		Entry("suffixed with the disk", &crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "v3"}, nil, "data", "ubuntu-data"),
+	)
+})
+
+var _ = Describe("ResolveSourceURL", func() {
+	generator := &Generator{URLTemplates: map[string]string{
+		"s3":       "s3://images/{{name}}/{{version}}/{{disk}}.qcow2",
+		"http":     "https://images.example.com/{{name}}/{{version}}/vm.qcow2",
+		"registry": "docker://registry.example.com/{{name}}:{{version}}{{arch}}",
+	}}
+
+	DescribeTable("builds the url of disks without one",
+		func(image *crdv1.VMDiskImageIdentity, disk crdv1.VMDiskImageDisk, expected string) {
+			vmdi := &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-2404", Namespace: "images"},
+				Spec:       crdv1.VMDiskImageSpec{Image: image},
+			}
+			Expect(generator.ResolveSourceURL(vmdi, disk)).To(Equal(expected))
+		},
+		Entry("from the name, version and disk",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+			crdv1.VMDiskImageDisk{Name: "data", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "s3"}},
+			"s3://images/ubuntu/24.04/data.qcow2"),
+		Entry("with an empty disk for a single disk VMDiskImage",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+			crdv1.VMDiskImageDisk{VMDiskSpec: crdv1.VMDiskSpec{SourceType: "s3"}},
+			"s3://images/ubuntu/24.04/.qcow2"),
+		Entry("from the template of the source type",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+			crdv1.VMDiskImageDisk{VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: urlNotProvided}},
+			"https://images.example.com/ubuntu/24.04/vm.qcow2"),
+		Entry("leaving variables it does not know in place",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+			crdv1.VMDiskImageDisk{VMDiskSpec: crdv1.VMDiskSpec{SourceType: "registry"}},
+			"docker://registry.example.com/ubuntu:24.04{{arch}}"),
+		Entry("not without an image to fill in the name and version",
+			nil,
+			crdv1.VMDiskImageDisk{VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: urlNotProvided}},
+			urlNotProvided),
+		Entry("not without a template for the source type",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+			crdv1.VMDiskImageDisk{VMDiskSpec: crdv1.VMDiskSpec{SourceType: "gcs"}},
+			""),
+		Entry("not for disks with a url of their own",
+			&crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+			crdv1.VMDiskImageDisk{VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://mirror.example.com/ubuntu.qcow2"}},
+			"https://mirror.example.com/ubuntu.qcow2"),
+	)
+
+	// CDI imports s3:// urls as they are. The operator only maps them to the
+	// default AWS endpoint when it probes the source.
+	It("keeps s3 urls for CDI and probes them at the default AWS endpoint", func() {
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-2404", Namespace: "images"},
+			Spec: crdv1.VMDiskImageSpec{
+				Image:      &crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: "24.04"},
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "s3", DiskSize: "10Gi"},
+			},
+		}
+		disk := vmdi.Spec.GetDisks()[0]
+		disk.Name = "root"
+
+		resolved := generator.ResolveSourceURL(vmdi, disk)
+		Expect(resolved).To(Equal("s3://images/ubuntu/24.04/root.qcow2"))
+
+		artifactURL, err := probeURL(SourceProbeRequest{SourceType: "s3", URL: resolved})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(artifactURL.String()).To(Equal("https://s3.amazonaws.com/images/ubuntu/24.04/root.qcow2"))
+	})
+})
+
+var _ = Describe("createDataVolume", func() {
+	DescribeTable("passes the CA bundle on to CDI",
+		func(sourceType string, certConfigMap func(*cdiv1beta1.DataVolumeSource) string) {
+			vmdi := &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+				Spec: crdv1.VMDiskImageSpec{
+					VMDiskSpec: crdv1.VMDiskSpec{
+						SourceType:    sourceType,
+						URL:           "https://example.com/ubuntu.img",
+						DiskSize:      "10Gi",
+						CertConfigMap: ptr.To("private-ca"),
+					},
+				},
+			}
+			if sourceType == "registry" {
+				vmdi.Spec.URL = "docker://registry.example.com/ubuntu:24.04"
+			}
+
+			dataVolume, err := (&Generator{}).createDataVolume(vmdi, vmdi.Spec.GetDisks()[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(certConfigMap(dataVolume.Spec.Source)).To(Equal("private-ca"))
+		},
+		Entry("for s3", "s3", func(source *cdiv1beta1.DataVolumeSource) string { return source.S3.CertConfigMap }),
+		Entry("for http", "http", func(source *cdiv1beta1.DataVolumeSource) string { return source.HTTP.CertConfigMap }),
+		Entry("for registry", "registry", func(source *cdiv1beta1.DataVolumeSource) string {
+			return ptr.Deref(source.Registry.CertConfigMap, "")
+		}),
+	)
+
+	DescribeTable("describes the volume with spec.storage or spec.pvc",
+		func(defaultStorageAPI bool, storageAPI *bool, accessModes []corev1.PersistentVolumeAccessMode, expected cdiv1beta1.DataVolumeSpec) {
+			vmdi := &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+				Spec: crdv1.VMDiskImageSpec{
+					VMDiskSpec: crdv1.VMDiskSpec{
+						SourceType:   "blank",
+						DiskSize:     "10Gi",
+						StorageClass: ptr.To("fast"),
+						VolumeMode:   ptr.To(corev1.PersistentVolumeBlock),
+						AccessModes:  accessModes,
+						StorageAPI:   storageAPI,
+					},
+				},
+			}
+
+			dataVolume, err := (&Generator{StorageAPI: defaultStorageAPI}).createDataVolume(vmdi, vmdi.Spec.GetDisks()[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataVolume.Spec.Storage).To(Equal(expected.Storage))
+			Expect(dataVolume.Spec.PVC).To(Equal(expected.PVC))
+		},
+		Entry("pvc defaulting the access modes to ReadWriteOnce", false, nil, nil, cdiv1beta1.DataVolumeSpec{
+			PVC: &corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+				Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+				StorageClassName: ptr.To("fast"),
+			},
+		}),
+		Entry("pvc with the access modes of the disk", false, nil, []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}, cdiv1beta1.DataVolumeSpec{
+			PVC: &corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+				VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+				Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+				StorageClassName: ptr.To("fast"),
+			},
+		}),
+		Entry("storage leaving the access modes to the StorageProfile", true, nil, nil, cdiv1beta1.DataVolumeSpec{
+			Storage: &cdiv1beta1.StorageSpec{
+				VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+				Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+				StorageClassName: ptr.To("fast"),
+			},
+		}),
+		Entry("storage with the access modes of the disk", true, nil, []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}, cdiv1beta1.DataVolumeSpec{
+			Storage: &cdiv1beta1.StorageSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+				VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+				Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+				StorageClassName: ptr.To("fast"),
+			},
+		}),
+		Entry("storage when the disk chooses it over the default", false, ptr.To(true), nil, cdiv1beta1.DataVolumeSpec{
+			Storage: &cdiv1beta1.StorageSpec{
+				VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+				Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+				StorageClassName: ptr.To("fast"),
+			},
+		}),
+		Entry("pvc when the disk chooses it over the default", true, ptr.To(false), nil, cdiv1beta1.DataVolumeSpec{
+			PVC: &corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				VolumeMode:       ptr.To(corev1.PersistentVolumeBlock),
+				Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+				StorageClassName: ptr.To("fast"),
+			},
+		}),
+	)
+
+	It("imports http sources with their credentials and headers", func() {
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{
+					SourceType:         "http",
+					URL:                "https://images.example.com/ubuntu.qcow2",
+					DiskSize:           "10Gi",
+					SecretRef:          "images-credentials",
+					CertConfigMap:      ptr.To("private-ca"),
+					ExtraHeaders:       []string{"X-Team: platform"},
+					SecretExtraHeaders: []string{"images-token"},
+				},
+			},
+		}
+
+		dataVolume, err := (&Generator{}).createDataVolume(vmdi, vmdi.Spec.GetDisks()[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataVolume.Spec.Source).To(Equal(&cdiv1beta1.DataVolumeSource{
+			HTTP: &cdiv1beta1.DataVolumeSourceHTTP{
+				URL:                "https://images.example.com/ubuntu.qcow2",
+				SecretRef:          "images-credentials",
+				CertConfigMap:      "private-ca",
+				ExtraHeaders:       []string{"X-Team: platform"},
+				SecretExtraHeaders: []string{"images-token"},
+			},
+		}))
+	})
+
+	It("leaves the credentials of http sources out when there are none", func() {
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{
+					SourceType: "http",
+					URL:        "https://images.example.com/ubuntu.qcow2",
+					DiskSize:   "10Gi",
+				},
+			},
+		}
+
+		dataVolume, err := (&Generator{}).createDataVolume(vmdi, vmdi.Spec.GetDisks()[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataVolume.Spec.Source).To(Equal(&cdiv1beta1.DataVolumeSource{
+			HTTP: &cdiv1beta1.DataVolumeSourceHTTP{URL: "https://images.example.com/ubuntu.qcow2"},
+		}))
+	})
+
+	It("leaves bandwidth limited http sources to be uploaded by their import job", func() {
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{
+					SourceType:    "http",
+					URL:           "https://images.example.com/ubuntu.qcow2",
+					DiskSize:      "10Gi",
+					CertConfigMap: ptr.To("private-ca"),
+				},
+			},
+			Status: crdv1.VMDiskImageStatus{BandwidthLimit: "100M"},
+		}
+		generator := &Generator{DiskImporterImage: "operator:v1", UploadProxyURL: "https://cdi-uploadproxy.cdi.svc"}
+
+		dataVolume, err := generator.createDataVolume(vmdi, vmdi.Spec.GetDisks()[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataVolume.Spec.Source).To(Equal(&cdiv1beta1.DataVolumeSource{Upload: &cdiv1beta1.DataVolumeSourceUpload{}}))
+
+		job := generator.CreateImportJobManifest(vmdi, vmdi.Spec.GetDisks()[0])
+		Expect(job.Name).To(Equal("ubuntu-import"))
+		container := job.Spec.Template.Spec.Containers[0]
+		Expect(container.Command).To(Equal([]string{DiskImporterBinary}))
+		Expect(container.Env).To(ContainElements(
+			corev1.EnvVar{Name: ChecksumSourceURLEnv, Value: "https://images.example.com/ubuntu.qcow2"},
+			corev1.EnvVar{Name: ImportBandwidthLimitEnv, Value: "100M"},
+			corev1.EnvVar{Name: ImportUploadProxyURLEnv, Value: "https://cdi-uploadproxy.cdi.svc"},
+		))
+		Expect(container.VolumeMounts).To(ContainElements(
+			HaveField("MountPath", ImportUploadDir),
+			HaveField("MountPath", ChecksumCertsDir),
+		))
+		Expect(job.Spec.Template.Spec.Volumes).To(ContainElement(HaveField("Secret.SecretName", "ubuntu-import")))
+	})
+
+	Context("with an importer placement", func() {
+		placement := &crdv1.VMDiskImagePlacement{
+			NodeSelector: map[string]string{"topology.kubernetes.io/zone": "eu-west-1a"},
+			Tolerations:  []corev1.Toleration{{Key: "imports", Operator: corev1.TolerationOpExists}},
+		}
+		vmdiWith := func(sourceType string, placement *crdv1.VMDiskImagePlacement) *crdv1.VMDiskImage {
+			return &crdv1.VMDiskImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+				Spec: crdv1.VMDiskImageSpec{
+					VMDiskSpec: crdv1.VMDiskSpec{
+						SourceType: sourceType,
+						URL:        "https://images.example.com/ubuntu.qcow2",
+						DiskSize:   "10Gi",
+						Checksum:   &crdv1.VMDiskImageChecksum{Algorithm: "sha256", Digest: "abc"},
+					},
+					ImporterPlacement: placement,
+				},
+			}
+		}
+
+		It("places the import and checksum jobs of http sources", func() {
+			vmdi := vmdiWith("http", placement)
+			generator := &Generator{}
+
+			dataVolume, err := generator.createDataVolume(vmdi, vmdi.Spec.GetDisks()[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataVolume.Spec.Source).To(Equal(&cdiv1beta1.DataVolumeSource{Upload: &cdiv1beta1.DataVolumeSourceUpload{}}))
+
+			importJob := generator.CreateImportJobManifest(vmdi, vmdi.Spec.GetDisks()[0])
+			Expect(importJob.Spec.Template.Annotations).NotTo(HaveKey(ingressBandwidthAnnotation))
+			for _, job := range []*batchv1.Job{importJob, generator.CreateChecksumJobManifest(vmdi, vmdi.Spec.GetDisks()[0])} {
+				Expect(job.Spec.Template.Spec.NodeSelector).To(Equal(placement.NodeSelector))
+				Expect(job.Spec.Template.Spec.Tolerations).To(Equal(placement.Tolerations))
+			}
+		})
+
+		It("falls back to the default placement", func() {
+			vmdi := vmdiWith("s3", nil)
+			generator := &Generator{DefaultImporterPlacement: placement}
+
+			Expect(generator.UsesImportJob(vmdi, vmdi.Spec.GetDisks()[0])).To(BeTrue())
+			job := generator.CreateChecksumJobManifest(vmdi, vmdi.Spec.GetDisks()[0])
+			Expect(job.Spec.Template.Spec.NodeSelector).To(Equal(placement.NodeSelector))
+		})
+
+		It("leaves registry sources to CDI", func() {
+			vmdi := vmdiWith("registry", placement)
+
+			Expect((&Generator{}).UsesImportJob(vmdi, vmdi.Spec.GetDisks()[0])).To(BeFalse())
+		})
+
+		It("leaves http sources to CDI without a placement or limit", func() {
+			vmdi := vmdiWith("http", nil)
+
+			Expect((&Generator{}).UsesImportJob(vmdi, vmdi.Spec.GetDisks()[0])).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crutils "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// A kind of child resource the operator creates for a VMDiskImage.
+type childKind struct {
+	name    string
+	newList func() client.ObjectList
+}
+
+func childKinds(includeGroupSnapshots bool) []childKind {
+	kinds := []childKind{
+		{name: "DataVolume", newList: func() client.ObjectList { return &cdiv1beta1.DataVolumeList{} }},
+		{name: "PersistentVolumeClaim", newList: func() client.ObjectList { return &corev1.PersistentVolumeClaimList{} }},
+		{name: "VolumeSnapshot", newList: func() client.ObjectList { return &snapshotv1.VolumeSnapshotList{} }},
+		{name: "VolumeSnapshotContent", newList: func() client.ObjectList { return &snapshotv1.VolumeSnapshotContentList{} }},
+		{name: "DataSource", newList: func() client.ObjectList { return &cdiv1beta1.DataSourceList{} }},
+		{name: "Job", newList: func() client.ObjectList { return &batchv1.JobList{} }},
+	}
+	if includeGroupSnapshots {
+		kinds = append(kinds, childKind{
+			name:    "VolumeGroupSnapshot",
+			newList: func() client.ObjectList { return &groupsnapshotv1beta2.VolumeGroupSnapshotList{} },
+		})
+	}
+
+	return kinds
+}
+
+// List the child resources of a VMDiskImage that still exist, including the
+// ones that are terminating.
+func (p K8sVMDIProvisioner) RemainingResources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) ([]client.Object, error) {
+	var remaining []client.Object
+	for _, kind := range childKinds(p.ResourceGenerator.UsesGroupSnapshot(vmdi)) {
+		objs, err := p.listChildren(ctx, kind, client.InNamespace(vmdi.Namespace), getLabelsToMatch(vmdi))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the remaining %s resources of the VMDiskImage %s: %w", kind.name, vmdi.Name, err)
+		}
+		remaining = append(remaining, objs...)
+	}
+
+	// The snapshot copies live outside of our namespace
+	for _, kind := range childKinds(false) {
+		if kind.name != "VolumeSnapshot" && kind.name != "VolumeSnapshotContent" {
+			continue
+		}
+		objs, err := p.listChildren(ctx, kind, getCopyLabelsToMatch(vmdi))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the remaining %s copies of the VMDiskImage %s: %w", kind.name, vmdi.Name, err)
+		}
+		remaining = append(remaining, objs...)
+	}
+
+	legacy, err := p.legacyChildren(ctx, vmdi)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range legacy {
+		listed := slices.ContainsFunc(remaining, func(other client.Object) bool {
+			return other.GetUID() == obj.GetUID()
+		})
+		if !listed {
+			remaining = append(remaining, obj)
+		}
+	}
+
+	return remaining, nil
+}
+
+func (p K8sVMDIProvisioner) listChildren(ctx context.Context, kind childKind, opts ...client.ListOption) ([]client.Object, error) {
+	list := kind.newList()
+	if err := p.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+
+	return extractObjects(list)
+}
+
+func extractObjects(list client.ObjectList) ([]client.Object, error) {
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make([]client.Object, 0, len(items))
+	for _, item := range items {
+		if obj, ok := item.(client.Object); ok {
+			objs = append(objs, obj)
+		}
+	}
+
+	return objs, nil
+}
+
+// Strip the finalizers of child resources that are stuck terminating so the
+// API server can let go of them.
+func (p K8sVMDIProvisioner) ForceRemoveResources(ctx context.Context, resources []client.Object) error {
+	for _, obj := range resources {
+		if obj.GetDeletionTimestamp().IsZero() {
+			if err := client.IgnoreNotFound(p.Delete(ctx, obj)); err != nil {
+				return fmt.Errorf("failed to delete %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+			}
+			continue
+		}
+		if len(obj.GetFinalizers()) == 0 {
+			continue
+		}
+
+		patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+		obj.SetFinalizers(nil)
+		if err := client.IgnoreNotFound(p.Patch(ctx, obj, patch)); err != nil {
+			return fmt.Errorf("failed to remove the finalizers of %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// Release the child resources the deletion policy keeps so they are neither
+// torn down with the VMDiskImage nor garbage collected after it. Returns how
+// many resources were released.
+func (p K8sVMDIProvisioner) ReleaseResources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	deletionPolicy string,
+) (int, error) {
+	if deletionPolicy != crdv1.DeletionPolicyRetain && deletionPolicy != crdv1.DeletionPolicyOrphan {
+		return 0, nil
+	}
+
+	remaining, err := p.RemainingResources(ctx, vmdi)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, obj := range remaining {
+		if !obj.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		if deletionPolicy == crdv1.DeletionPolicyRetain && !isSnapshotResource(obj) {
+			continue
+		}
+
+		patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+		obj.SetOwnerReferences(slices.DeleteFunc(obj.GetOwnerReferences(), func(ref metav1.OwnerReference) bool {
+			return ref.UID == vmdi.UID
+		}))
+		obj.SetLabels(withoutOperatorLabels(obj.GetLabels()))
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[crdv1.VMDiskImageRetainedFromAnnotation] = vmdi.Namespace + "/" + vmdi.Name
+		obj.SetAnnotations(annotations)
+
+		if err := client.IgnoreNotFound(p.Patch(ctx, obj, patch)); err != nil {
+			return released, fmt.Errorf("failed to release %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+		}
+		released++
+	}
+
+	return released, nil
+}
+
+// The labels of a released resource, without the ones the operator finds
+// the resources of a VMDiskImage by.
+func withoutOperatorLabels(labels map[string]string) map[string]string {
+	released := maps.Clone(labels)
+	if released == nil {
+		released = map[string]string{}
+	}
+	delete(released, crdv1.VMDiskImageNameLabel)
+	delete(released, crdv1.VMDiskImageUIDLabel)
+	delete(released, crdv1.VMDiskImageSourceNamespaceLabel)
+	delete(released, crdv1.VMDiskImageLegacySourceNamespaceLabel)
+	delete(released, crdv1.VMDiskImageLegacyOwnerLabel)
+
+	return released
+}
+
+// The snapshots, their copies and the group snapshot taking them are what
+// the Retain policy keeps around.
+func isSnapshotResource(obj client.Object) bool {
+	switch obj.(type) {
+	case *snapshotv1.VolumeSnapshot, *snapshotv1.VolumeSnapshotContent, *groupsnapshotv1beta2.VolumeGroupSnapshot:
+		return true
+	default:
+		return false
+	}
+}
+
+// Let go of a VMDiskImage once all of its child resources are gone.
+func (p K8sVMDIProvisioner) RemoveFinalizer(ctx context.Context, vmdi *crdv1.VMDiskImage) error {
+	if !crutils.ContainsFinalizer(vmdi, crdv1.VMDiskImageFinalizer) {
+		return nil
+	}
+
+	crutils.RemoveFinalizer(vmdi, crdv1.VMDiskImageFinalizer)
+	return p.Update(ctx, vmdi)
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"slices"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("ReleaseResources", func() {
+	var (
+		k8sClient   client.Client
+		provisioner K8sVMDIProvisioner
+	)
+
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ubuntu",
+			Namespace: "images",
+			UID:       "vmdi-uid",
+			Labels:    map[string]string{"team": "platform"},
+		},
+		Spec: crdv1.VMDiskImageSpec{
+			VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"},
+		},
+	}
+
+	// The child resources of the VMDiskImage, keyed by kind, including a copy
+	// of its snapshot in another namespace.
+	children := func() map[string]client.Object {
+		generator := &Generator{}
+		childMeta := func(namespace string, name string) metav1.ObjectMeta {
+			return metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       namespace,
+				Labels:          generator.childLabels(vmdi),
+				OwnerReferences: createOwnerReferences(vmdi),
+			}
+		}
+		copyContent, copySnapshot := generator.CreateSnapshotCopyManifests(vmdi, vmdi.Spec.GetDisks()[0], "vms", SnapshotSource{
+			Driver:         "csi.example.com",
+			SnapshotHandle: "handle-ubuntu",
+		})
+		copySnapshot.TypeMeta = metav1.TypeMeta{}
+		copyContent.TypeMeta = metav1.TypeMeta{}
+
+		return map[string]client.Object{
+			"DataVolume":            &cdiv1beta1.DataVolume{ObjectMeta: childMeta("images", "ubuntu")},
+			"PersistentVolumeClaim": &corev1.PersistentVolumeClaim{ObjectMeta: childMeta("images", "ubuntu")},
+			"DataSource":            &cdiv1beta1.DataSource{ObjectMeta: childMeta("images", "ubuntu")},
+			"VolumeSnapshot": &snapshotv1.VolumeSnapshot{
+				ObjectMeta: childMeta("images", "ubuntu"),
+				Spec: snapshotv1.VolumeSnapshotSpec{
+					Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: ptr.To("ubuntu")},
+				},
+			},
+			"VolumeSnapshot copy":        copySnapshot,
+			"VolumeSnapshotContent copy": copyContent,
+		}
+	}
+
+	newProvisioner := func(objects map[string]client.Object) {
+		var list []client.Object
+		for _, obj := range objects {
+			list = append(list, obj)
+		}
+		k8sClient = newFakeClient(list...)
+		provisioner = K8sVMDIProvisioner{Client: k8sClient, ResourceGenerator: &Generator{}}
+	}
+
+	// Whether the object was released: it no longer belongs to the
+	// VMDiskImage but remembers where it came from.
+	isReleased := func(ctx SpecContext, obj client.Object) bool {
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(obj), obj)).To(Succeed())
+		if obj.GetAnnotations()[crdv1.VMDiskImageRetainedFromAnnotation] != "images/ubuntu" {
+			return false
+		}
+
+		Expect(obj.GetOwnerReferences()).To(BeEmpty())
+		Expect(obj.GetLabels()).NotTo(HaveKey(crdv1.VMDiskImageNameLabel))
+		Expect(obj.GetLabels()).NotTo(HaveKey(crdv1.VMDiskImageUIDLabel))
+		Expect(obj.GetLabels()).NotTo(HaveKey(crdv1.VMDiskImageSourceNamespaceLabel))
+		Expect(obj.GetLabels()).To(HaveKeyWithValue("team", "platform"))
+		return true
+	}
+
+	isDeleted := func(ctx SpecContext, obj client.Object) bool {
+		err := k8sClient.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		if apierrors.IsNotFound(err) {
+			return true
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return false
+	}
+
+	It("releases nothing under the Delete policy", func(ctx SpecContext) {
+		objects := children()
+		newProvisioner(objects)
+
+		released, err := provisioner.ReleaseResources(ctx, vmdi, crdv1.DeletionPolicyDelete)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeZero())
+		for kind, obj := range objects {
+			Expect(isReleased(ctx, obj)).To(BeFalse(), kind)
+		}
+	})
+
+	It("releases only the snapshots and their copies under the Retain policy", func(ctx SpecContext) {
+		objects := children()
+		newProvisioner(objects)
+
+		released, err := provisioner.ReleaseResources(ctx, vmdi, crdv1.DeletionPolicyRetain)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(3))
+
+		snapshotKinds := []string{"VolumeSnapshot", "VolumeSnapshot copy", "VolumeSnapshotContent copy"}
+		for kind, obj := range objects {
+			Expect(isReleased(ctx, obj)).To(Equal(slices.Contains(snapshotKinds, kind)), kind)
+		}
+
+		Expect(provisioner.TearDownAllResources(ctx, vmdi)).To(Succeed())
+		for kind, obj := range objects {
+			Expect(isDeleted(ctx, obj)).To(Equal(!slices.Contains(snapshotKinds, kind)), kind)
+		}
+
+		remaining, err := provisioner.RemainingResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remaining).To(BeEmpty())
+	})
+
+	It("releases everything under the Orphan policy", func(ctx SpecContext) {
+		objects := children()
+		newProvisioner(objects)
+
+		released, err := provisioner.ReleaseResources(ctx, vmdi, crdv1.DeletionPolicyOrphan)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(len(objects)))
+
+		Expect(provisioner.TearDownAllResources(ctx, vmdi)).To(Succeed())
+		for kind, obj := range objects {
+			Expect(isReleased(ctx, obj)).To(BeTrue(), kind)
+		}
+
+		remaining, err := provisioner.RemainingResources(ctx, vmdi)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remaining).To(BeEmpty())
+	})
+
+	It("leaves terminating resources to the teardown", func(ctx SpecContext) {
+		objects := children()
+		objects["VolumeSnapshot"].SetFinalizers([]string{"snapshot.storage.kubernetes.io/volumesnapshot-as-source-protection"})
+		objects["VolumeSnapshot"].SetDeletionTimestamp(ptr.To(metav1.Now()))
+		newProvisioner(objects)
+
+		released, err := provisioner.ReleaseResources(ctx, vmdi, crdv1.DeletionPolicyRetain)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(2))
+		Expect(isReleased(ctx, objects["VolumeSnapshot"])).To(BeFalse())
+	})
+})
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Whether the VMDiskImage has, or had, snapshot copies to manage.
+func HasSnapshotDistribution(vmdi *crdv1.VMDiskImage) bool {
+	return len(vmdi.Spec.TargetNamespaces) > 0 ||
+		vmdi.Spec.TargetNamespaceSelector != nil ||
+		len(vmdi.Status.Copies) > 0
+}
+
+// Copy the snapshots of a Ready VMDiskImage into each of its target
+// namespaces and remove the copies from namespaces that are no longer
+// targeted. The state of every copy is recorded on the status of our
+// VMDiskImage. The caller is responsible for persisting the status.
+func (p K8sVMDIProvisioner) DistributeSnapshots(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	logger := logf.FromContext(ctx)
+
+	targetNamespaces, refusedNamespaces, err := p.getTargetNamespaces(ctx, vmdi)
+	if err != nil {
+		return err
+	}
+
+	if err := p.removeUntargetedCopies(ctx, vmdi, targetNamespaces); err != nil {
+		return err
+	}
+
+	sources, err := p.getSnapshotSources(ctx, vmdi)
+	if err != nil {
+		return err
+	}
+
+	disks := vmdi.Spec.GetDisks()
+	copies := make([]crdv1.VMDiskImageCopyStatus, 0, (len(targetNamespaces)+len(refusedNamespaces))*len(disks))
+	for namespace, reason := range refusedNamespaces {
+		for _, disk := range disks {
+			copies = append(copies, crdv1.VMDiskImageCopyStatus{
+				Namespace: namespace,
+				Disk:      disk.Name,
+				Message:   reason,
+			})
+		}
+	}
+
+	for _, namespace := range targetNamespaces {
+		for _, disk := range disks {
+			status := crdv1.VMDiskImageCopyStatus{
+				Namespace: namespace,
+				Disk:      disk.Name,
+			}
+
+			source, found := sources[disk.Name]
+			if !found {
+				status.Message = "Waiting for the snapshot of the disk to be ready."
+				copies = append(copies, status)
+				continue
+			}
+
+			snapshot, err := p.applySnapshotCopy(ctx, vmdi, disk, namespace, source)
+			if err != nil {
+				logger.Error(err, "Failed to copy the snapshot to the target namespace", "namespace", namespace, "disk", disk.Name)
+				status.Message = err.Error()
+				copies = append(copies, status)
+				continue
+			}
+
+			status.SnapshotName = snapshot.Name
+			status.ReadyToUse = volumeSnapshotIsReady(*snapshot)
+			if snapshot.Status != nil && snapshot.Status.Error != nil {
+				status.Message = ptr.Deref(snapshot.Status.Error.Message, "")
+			}
+			copies = append(copies, status)
+		}
+	}
+
+	slices.SortFunc(copies, func(a, b crdv1.VMDiskImageCopyStatus) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Disk, b.Disk))
+	})
+	vmdi.Status.Copies = copies
+
+	return nil
+}
+
+func (p K8sVMDIProvisioner) applySnapshotCopy(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	namespace string,
+	source SnapshotSource,
+) (*snapshotv1.VolumeSnapshot, error) {
+	content, snapshot := p.ResourceGenerator.CreateSnapshotCopyManifests(vmdi, disk, namespace, source)
+
+	// Never take over a snapshot that someone else created in the namespace
+	current := &snapshotv1.VolumeSnapshot{}
+	err := p.Get(ctx, client.ObjectKeyFromObject(snapshot), current)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	if err == nil && !isSnapshotCopyOf(current, vmdi) {
+		return nil, fmt.Errorf("a VolumeSnapshot named %s that is not managed by this VMDiskImage already exists", snapshot.Name)
+	}
+
+	err = p.Patch(ctx, content, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the volumesnapshotcontent %s: %w", content.Name, err)
+	}
+
+	err = p.Patch(ctx, snapshot, client.Apply, client.FieldOwner(crdv1.VMDiskImageControllerName), client.ForceOwnership)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the volumesnapshot %s/%s: %w", namespace, snapshot.Name, err)
+	}
+
+	return snapshot, nil
+}
+
+// Resolve the namespaces our VMDiskImage should be copied to. Copies write
+// into namespaces the author of the VMDiskImage may have no access to, so a
+// namespace has to opt in by listing the namespace of the VMDiskImage in its
+// copy sources annotation. Targeted namespaces that do not exist or did not
+// opt in are returned separately, with the reason, so they can be reported.
+func (p K8sVMDIProvisioner) getTargetNamespaces(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) ([]string, map[string]string, error) {
+	namespaceList := &corev1.NamespaceList{}
+	if err := p.List(ctx, namespaceList); err != nil {
+		return nil, nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+
+	var selector labels.Selector
+	if vmdi.Spec.TargetNamespaceSelector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(vmdi.Spec.TargetNamespaceSelector)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid targetNamespaceSelector: %w", err)
+		}
+	}
+
+	existing := make(map[string]bool, len(namespaceList.Items))
+	refused := map[string]string{}
+	var targets []string
+	for _, namespace := range namespaceList.Items {
+		existing[namespace.Name] = true
+
+		isSource := namespace.Name == vmdi.Namespace
+		isTerminating := namespace.Status.Phase == corev1.NamespaceTerminating
+		if isSource || isTerminating {
+			continue
+		}
+
+		isListed := slices.Contains(vmdi.Spec.TargetNamespaces, namespace.Name)
+		isSelected := selector != nil && selector.Matches(labels.Set(namespace.Labels))
+		if !isListed && !isSelected {
+			continue
+		}
+
+		if !namespaceListAllows(namespace.Annotations[crdv1.VMDiskImageCopySourcesAnnotation], vmdi.Namespace) {
+			refused[namespace.Name] = fmt.Sprintf("The target namespace does not list %s in its %s annotation.", vmdi.Namespace, crdv1.VMDiskImageCopySourcesAnnotation)
+			continue
+		}
+		targets = append(targets, namespace.Name)
+	}
+
+	for _, namespace := range vmdi.Spec.TargetNamespaces {
+		if !existing[namespace] {
+			refused[namespace] = "The target namespace does not exist."
+		}
+	}
+
+	return targets, refused, nil
+}
+
+// Delete the snapshot copies living outside of the given namespaces along
+// with the VolumeSnapshotContents backing them.
+func (p K8sVMDIProvisioner) removeUntargetedCopies(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	targetNamespaces []string,
+) error {
+	copyLabels := getCopyLabelsToMatch(vmdi)
+
+	snapshotList := &snapshotv1.VolumeSnapshotList{}
+	if err := p.List(ctx, snapshotList, copyLabels); err != nil {
+		return fmt.Errorf("failed to list the snapshot copies of the VMDiskImage %s: %w", vmdi.Name, err)
+	}
+
+	for _, snapshot := range snapshotList.Items {
+		if slices.Contains(targetNamespaces, snapshot.Namespace) {
+			continue
+		}
+
+		if err := client.IgnoreNotFound(p.Delete(ctx, &snapshot)); err != nil {
+			return fmt.Errorf("failed to delete the snapshot copy %s/%s: %w", snapshot.Namespace, snapshot.Name, err)
+		}
+
+		if snapshot.Spec.Source.VolumeSnapshotContentName == nil {
+			continue
+		}
+		content := &snapshotv1.VolumeSnapshotContent{
+			ObjectMeta: metav1.ObjectMeta{Name: *snapshot.Spec.Source.VolumeSnapshotContentName},
+		}
+		if err := client.IgnoreNotFound(p.Delete(ctx, content)); err != nil {
+			return fmt.Errorf("failed to delete the volumesnapshotcontent %s: %w", content.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Find the storage snapshot backing each disk that is ready to be copied.
+// Disks without a ready snapshot are left out.
+func (p K8sVMDIProvisioner) getSnapshotSources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (map[string]SnapshotSource, error) {
+	if p.ResourceGenerator.UsesGroupSnapshot(vmdi) {
+		return p.getGroupSnapshotSources(ctx, vmdi)
+	}
+
+	snapshots, err := p.getVolumeSnapshotsByName(ctx, vmdi)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]SnapshotSource{}
+	for _, disk := range vmdi.Spec.GetDisks() {
+		snapshot, found := snapshots[diskSnapshotName(vmdi, disk)]
+		if !found || !volumeSnapshotIsReady(snapshot) || snapshot.Status.BoundVolumeSnapshotContentName == nil {
+			continue
+		}
+
+		content := &snapshotv1.VolumeSnapshotContent{}
+		err := p.Get(ctx, client.ObjectKey{Name: *snapshot.Status.BoundVolumeSnapshotContentName}, content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the volumesnapshotcontent of the snapshot %s: %w", snapshot.Name, err)
+		}
+		if content.Status == nil || content.Status.SnapshotHandle == nil {
+			continue
+		}
+
+		sources[disk.Name] = SnapshotSource{
+			Driver:            content.Spec.Driver,
+			SnapshotHandle:    *content.Status.SnapshotHandle,
+			SnapshotClassName: content.Spec.VolumeSnapshotClassName,
+		}
+	}
+
+	return sources, nil
+}
+
+func (p K8sVMDIProvisioner) getGroupSnapshotSources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (map[string]SnapshotSource, error) {
+	content, members, err := p.getGroupSnapshotMembers(ctx, vmdi)
+	if err != nil || content == nil {
+		return map[string]SnapshotSource{}, err
+	}
+
+	sources := make(map[string]SnapshotSource, len(members))
+	for diskName, member := range members {
+		sources[diskName] = SnapshotSource{
+			Driver:            content.Spec.Driver,
+			SnapshotHandle:    member.SnapshotHandle,
+			SnapshotClassName: member.SnapshotClassName,
+		}
+	}
+
+	return sources, nil
+}
+
+// The snapshot a group snapshot took of a disk.
+type groupSnapshotMember struct {
+	SnapshotHandle string
+	// The VolumeSnapshot the snapshot controller created for it. Empty until
+	// it is bound.
+	SnapshotName string
+	// The class of the VolumeSnapshotContent of that VolumeSnapshot, falling
+	// back to the snapshot class of the disk.
+	SnapshotClassName *string
+}
+
+// Find the snapshot the ready group snapshot of a VMDiskImage took of each
+// disk, keyed by disk name. The snapshots of a group snapshot are only
+// reported by volume handle so each disk is matched through the volume bound
+// to its PVC, and each VolumeSnapshot the snapshot controller created through
+// the snapshot handle of its content. Returns a nil content while the group
+// snapshot is not ready.
+func (p K8sVMDIProvisioner) getGroupSnapshotMembers(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) (*groupsnapshotv1beta2.VolumeGroupSnapshotContent, map[string]groupSnapshotMember, error) {
+	vgs := &groupsnapshotv1beta2.VolumeGroupSnapshot{}
+	err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: vmdi.Name}, vgs)
+	if err != nil {
+		return nil, nil, client.IgnoreNotFound(err)
+	}
+	groupIsReady := vgs.Status != nil && ptr.Deref(vgs.Status.ReadyToUse, false)
+	if !groupIsReady || vgs.Status.BoundVolumeGroupSnapshotContentName == nil {
+		return nil, nil, nil
+	}
+
+	content := &groupsnapshotv1beta2.VolumeGroupSnapshotContent{}
+	err = p.Get(ctx, client.ObjectKey{Name: *vgs.Status.BoundVolumeGroupSnapshotContentName}, content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the volumegroupsnapshotcontent of %s: %w", vgs.Name, err)
+	}
+	if content.Status == nil {
+		return nil, nil, nil
+	}
+
+	snapshots, err := p.getGroupVolumeSnapshots(ctx, vgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members := map[string]groupSnapshotMember{}
+	for _, disk := range vmdi.Spec.GetDisks() {
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: diskResourceName(vmdi, disk)}, pvc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get the pvc of the disk %s: %w", disk.Name, err)
+		}
+
+		pv := &corev1.PersistentVolume{}
+		if err := p.Get(ctx, client.ObjectKey{Name: pvc.Spec.VolumeName}, pv); err != nil {
+			return nil, nil, fmt.Errorf("failed to get the volume of the disk %s: %w", disk.Name, err)
+		}
+		if pv.Spec.CSI == nil {
+			continue
+		}
+
+		for _, info := range content.Status.VolumeSnapshotInfoList {
+			if info.VolumeHandle == pv.Spec.CSI.VolumeHandle {
+				member := snapshots[info.SnapshotHandle]
+				member.SnapshotHandle = info.SnapshotHandle
+				member.SnapshotClassName = cmp.Or(member.SnapshotClassName, disk.SnapshotClass)
+				members[disk.Name] = member
+			}
+		}
+	}
+
+	return content, members, nil
+}
+
+// The VolumeSnapshots the snapshot controller created for a group snapshot,
+// keyed by their snapshot handle.
+func (p K8sVMDIProvisioner) getGroupVolumeSnapshots(
+	ctx context.Context,
+	vgs *groupsnapshotv1beta2.VolumeGroupSnapshot,
+) (map[string]groupSnapshotMember, error) {
+	snapshotList := &snapshotv1.VolumeSnapshotList{}
+	if err := p.List(ctx, snapshotList, client.InNamespace(vgs.Namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list the volume snapshots of the group snapshot %s: %w", vgs.Name, err)
+	}
+
+	snapshots := map[string]groupSnapshotMember{}
+	for _, snapshot := range snapshotList.Items {
+		status := snapshot.Status
+		if status == nil || ptr.Deref(status.VolumeGroupSnapshotName, "") != vgs.Name || status.BoundVolumeSnapshotContentName == nil {
+			continue
+		}
+
+		content := &snapshotv1.VolumeSnapshotContent{}
+		if err := p.Get(ctx, client.ObjectKey{Name: *status.BoundVolumeSnapshotContentName}, content); err != nil {
+			return nil, fmt.Errorf("failed to get the volumesnapshotcontent of the snapshot %s: %w", snapshot.Name, err)
+		}
+		if content.Status != nil && content.Status.SnapshotHandle != nil {
+			snapshots[*content.Status.SnapshotHandle] = groupSnapshotMember{
+				SnapshotName:      snapshot.Name,
+				SnapshotClassName: content.Spec.VolumeSnapshotClassName,
+			}
+		}
+	}
+
+	return snapshots, nil
+}
+
+func isSnapshotCopyOf(snapshot *snapshotv1.VolumeSnapshot, vmdi *crdv1.VMDiskImage) bool {
+	for key, value := range getCopyLabelsToMatch(vmdi) {
+		if snapshot.Labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getCopyLabelsToMatch(vmdi *crdv1.VMDiskImage) client.MatchingLabels {
+	return client.MatchingLabels(withCopyLabels(getLabelsToMatch(vmdi), vmdi))
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("DistributeSnapshots", func() {
+	var (
+		vmdi        *crdv1.VMDiskImage
+		k8sClient   client.Client
+		provisioner K8sVMDIProvisioner
+	)
+
+	newProvisioner := func(objects ...client.Object) {
+		k8sClient = newFakeClient(objects...)
+		provisioner = K8sVMDIProvisioner{
+			Client:            k8sClient,
+			ResourceGenerator: &Generator{VolumeGroupSnapshotsAvailable: true},
+		}
+	}
+
+	// A namespace that accepts the copies of the given source namespaces.
+	namespace := func(name string, copySources string, labels map[string]string) *corev1.Namespace {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+		if copySources != "" {
+			ns.Annotations = map[string]string{crdv1.VMDiskImageCopySourcesAnnotation: copySources}
+		}
+		return ns
+	}
+
+	// The ready snapshot of a single disk VMDiskImage and its content.
+	snapshotObjects := func() []client.Object {
+		return []client.Object{
+			&snapshotv1.VolumeSnapshot{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "ubuntu",
+					Namespace: "images",
+					Labels:    getLabelsToMatch(vmdi),
+				},
+				Status: &snapshotv1.VolumeSnapshotStatus{
+					ReadyToUse:                     ptr.To(true),
+					BoundVolumeSnapshotContentName: ptr.To("snapcontent-ubuntu"),
+				},
+			},
+			&snapshotv1.VolumeSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{Name: "snapcontent-ubuntu"},
+				Spec: snapshotv1.VolumeSnapshotContentSpec{
+					Driver:                  "csi.example.com",
+					VolumeSnapshotClassName: ptr.To("csi-snapclass"),
+				},
+				Status: &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: ptr.To("handle-ubuntu")},
+			},
+		}
+	}
+
+	copyStatus := func(namespace string) crdv1.VMDiskImageCopyStatus {
+		for _, status := range vmdi.Status.Copies {
+			if status.Namespace == namespace {
+				return status
+			}
+		}
+		Fail("no copy status for the namespace " + namespace)
+		return crdv1.VMDiskImageCopyStatus{}
+	}
+
+	BeforeEach(func() {
+		vmdi = &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "vmdi-uid"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"},
+			},
+			Status: crdv1.VMDiskImageStatus{Phase: crdv1.PhaseReady},
+		}
+	})
+
+	Context("when selecting the target namespaces", func() {
+		BeforeEach(func() {
+			vmdi.Spec.TargetNamespaces = []string{"listed", "missing", "images"}
+			vmdi.Spec.TargetNamespaceSelector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{"images": "copy"},
+			}
+			terminating := namespace("terminating", "*", map[string]string{"images": "copy"})
+			terminating.Status.Phase = corev1.NamespaceTerminating
+
+			newProvisioner(append(snapshotObjects(),
+				namespace("images", "*", map[string]string{"images": "copy"}),
+				namespace("listed", "images", nil),
+				namespace("selected", "other, images", map[string]string{"images": "copy"}),
+				namespace("unselected", "*", nil),
+				namespace("closed", "", map[string]string{"images": "copy"}),
+				namespace("elsewhere", "other", map[string]string{"images": "copy"}),
+				terminating,
+			)...)
+		})
+
+		It("copies to the listed and selected namespaces that accept copies", func(ctx SpecContext) {
+			Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+
+			Expect(vmdi.Status.Copies).To(HaveEach(HaveField("Namespace", BeElementOf("listed", "selected", "missing", "closed", "elsewhere"))))
+			Expect(vmdi.Status.Copies).To(HaveLen(5))
+
+			for _, target := range []string{"listed", "selected"} {
+				Expect(copyStatus(target)).To(And(
+					HaveField("SnapshotName", "ubuntu"),
+					HaveField("Message", BeEmpty()),
+				))
+
+				snapshot := &snapshotv1.VolumeSnapshot{}
+				Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: target, Name: "ubuntu"}, snapshot)).To(Succeed())
+				Expect(snapshot.Labels).To(HaveKeyWithValue(crdv1.VMDiskImageSourceNamespaceLabel, "images"))
+				Expect(snapshot.Spec.VolumeSnapshotClassName).To(HaveValue(Equal("csi-snapclass")))
+
+				content := &snapshotv1.VolumeSnapshotContent{}
+				Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "images-ubuntu-to-" + target}, content)).To(Succeed())
+				Expect(content.Spec.Source.SnapshotHandle).To(HaveValue(Equal("handle-ubuntu")))
+				Expect(content.Spec.VolumeSnapshotRef.Namespace).To(Equal(target))
+			}
+		})
+
+		It("reports the namespaces that do not exist or did not opt in without copying to them", func(ctx SpecContext) {
+			Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+
+			Expect(copyStatus("missing").Message).To(Equal("The target namespace does not exist."))
+			for _, refused := range []string{"closed", "elsewhere"} {
+				Expect(copyStatus(refused)).To(And(
+					HaveField("SnapshotName", BeEmpty()),
+					HaveField("Message", ContainSubstring(crdv1.VMDiskImageCopySourcesAnnotation)),
+				))
+
+				err := k8sClient.Get(ctx, client.ObjectKey{Namespace: refused, Name: "ubuntu"}, &snapshotv1.VolumeSnapshot{})
+				Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			}
+		})
+	})
+
+	It("waits for the snapshot of the disk to be ready", func(ctx SpecContext) {
+		vmdi.Spec.TargetNamespaces = []string{"listed"}
+		objects := snapshotObjects()
+		objects[0].(*snapshotv1.VolumeSnapshot).Status.ReadyToUse = ptr.To(false)
+		newProvisioner(append(objects, namespace("listed", "images", nil))...)
+
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+		Expect(copyStatus("listed").Message).To(Equal("Waiting for the snapshot of the disk to be ready."))
+	})
+
+	It("refuses to take over a snapshot it does not manage", func(ctx SpecContext) {
+		vmdi.Spec.TargetNamespaces = []string{"listed"}
+		unmanaged := &snapshotv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "listed", Labels: map[string]string{"owner": "someone"}},
+			Spec: snapshotv1.VolumeSnapshotSpec{
+				Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: ptr.To("data")},
+			},
+		}
+		newProvisioner(append(snapshotObjects(), namespace("listed", "images", nil), unmanaged)...)
+
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+		Expect(copyStatus("listed")).To(And(
+			HaveField("SnapshotName", BeEmpty()),
+			HaveField("Message", ContainSubstring("not managed by this VMDiskImage")),
+		))
+
+		current := &snapshotv1.VolumeSnapshot{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(unmanaged), current)).To(Succeed())
+		Expect(current.Labels).To(Equal(map[string]string{"owner": "someone"}))
+		Expect(current.Spec.Source.PersistentVolumeClaimName).To(HaveValue(Equal("data")))
+
+		err := k8sClient.Get(ctx, client.ObjectKey{Name: "images-ubuntu-to-listed"}, &snapshotv1.VolumeSnapshotContent{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("removes the copies of namespaces that are no longer targeted", func(ctx SpecContext) {
+		vmdi.Spec.TargetNamespaces = []string{"kept", "dropped"}
+		newProvisioner(append(snapshotObjects(),
+			namespace("kept", "images", nil),
+			namespace("dropped", "images", nil),
+		)...)
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+		Expect(vmdi.Status.Copies).To(HaveLen(2))
+
+		vmdi.Spec.TargetNamespaces = []string{"kept"}
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+		Expect(vmdi.Status.Copies).To(ConsistOf(HaveField("Namespace", "kept")))
+
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "dropped", Name: "ubuntu"}, &snapshotv1.VolumeSnapshot{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = k8sClient.Get(ctx, client.ObjectKey{Name: "images-ubuntu-to-dropped"}, &snapshotv1.VolumeSnapshotContent{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "kept", Name: "ubuntu"}, &snapshotv1.VolumeSnapshot{})).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "images-ubuntu-to-kept"}, &snapshotv1.VolumeSnapshotContent{})).To(Succeed())
+	})
+
+	It("removes the copies of namespaces that stop accepting them", func(ctx SpecContext) {
+		vmdi.Spec.TargetNamespaces = []string{"listed"}
+		listed := namespace("listed", "images", nil)
+		newProvisioner(append(snapshotObjects(), listed)...)
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(listed), listed)).To(Succeed())
+		listed.Annotations = nil
+		Expect(k8sClient.Update(ctx, listed)).To(Succeed())
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "listed", Name: "ubuntu"}, &snapshotv1.VolumeSnapshot{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = k8sClient.Get(ctx, client.ObjectKey{Name: "images-ubuntu-to-listed"}, &snapshotv1.VolumeSnapshotContent{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("gives the copies of group snapshots the class of their snapshot", func(ctx SpecContext) {
+		vmdi.Spec = crdv1.VMDiskImageSpec{
+			Disks: []crdv1.VMDiskImageDisk{
+				{Name: "root", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"}},
+				{Name: "data", VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi", SnapshotClass: ptr.To("disk-snapclass")}},
+			},
+			TargetNamespaces: []string{"listed"},
+		}
+		objects := []client.Object{
+			namespace("listed", "images", nil),
+			&groupsnapshotv1beta2.VolumeGroupSnapshot{
+				ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images"},
+				Status: &groupsnapshotv1beta2.VolumeGroupSnapshotStatus{
+					ReadyToUse:                          ptr.To(true),
+					BoundVolumeGroupSnapshotContentName: ptr.To("group-content"),
+				},
+			},
+			&groupsnapshotv1beta2.VolumeGroupSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{Name: "group-content"},
+				Spec:       groupsnapshotv1beta2.VolumeGroupSnapshotContentSpec{Driver: "csi.example.com"},
+				Status: &groupsnapshotv1beta2.VolumeGroupSnapshotContentStatus{
+					VolumeSnapshotInfoList: []groupsnapshotv1beta2.VolumeSnapshotInfo{
+						{VolumeHandle: "volume-root", SnapshotHandle: "snapshot-root"},
+						{VolumeHandle: "volume-data", SnapshotHandle: "snapshot-data"},
+					},
+				},
+			},
+		}
+		for _, disk := range []string{"root", "data"} {
+			content := &snapshotv1.VolumeSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{Name: "content-" + disk},
+				Status:     &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: ptr.To("snapshot-" + disk)},
+			}
+			// The data disk falls back to its own snapshot class.
+			if disk == "root" {
+				content.Spec.VolumeSnapshotClassName = ptr.To("csi-snapclass")
+			}
+			objects = append(objects,
+				&corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: "ubuntu-" + disk, Namespace: "images"},
+					Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-" + disk},
+				},
+				&corev1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{Name: "pv-" + disk},
+					Spec: corev1.PersistentVolumeSpec{
+						PersistentVolumeSource: corev1.PersistentVolumeSource{
+							CSI: &corev1.CSIPersistentVolumeSource{Driver: "csi.example.com", VolumeHandle: "volume-" + disk},
+						},
+					},
+				},
+				&snapshotv1.VolumeSnapshot{
+					ObjectMeta: metav1.ObjectMeta{Name: "snapshot-abc-" + disk, Namespace: "images"},
+					Status: &snapshotv1.VolumeSnapshotStatus{
+						VolumeGroupSnapshotName:        ptr.To("ubuntu"),
+						BoundVolumeSnapshotContentName: ptr.To("content-" + disk),
+					},
+				},
+				content,
+			)
+		}
+		newProvisioner(objects...)
+
+		Expect(provisioner.DistributeSnapshots(ctx, vmdi)).To(Succeed())
+		Expect(vmdi.Status.Copies).To(HaveLen(2))
+
+		for disk, class := range map[string]string{"root": "csi-snapclass", "data": "disk-snapclass"} {
+			content := &snapshotv1.VolumeSnapshotContent{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "images-ubuntu-" + disk + "-to-listed"}, content)).To(Succeed())
+			Expect(content.Spec.Driver).To(Equal("csi.example.com"))
+			Expect(content.Spec.Source.SnapshotHandle).To(HaveValue(Equal("snapshot-" + disk)))
+			Expect(content.Spec.VolumeSnapshotClassName).To(HaveValue(Equal(class)))
+
+			snapshot := &snapshotv1.VolumeSnapshot{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "listed", Name: "ubuntu-" + disk}, snapshot)).To(Succeed())
+			Expect(snapshot.Spec.VolumeSnapshotClassName).To(HaveValue(Equal(class)))
+		}
+	})
+})
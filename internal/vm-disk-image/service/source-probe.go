@@ -0,0 +1,407 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How much of an artifact is read to tell its format.
+const sniffLength = 512
+
+// SourceProbeRequest describes the artifact a disk is imported from.
+type SourceProbeRequest struct {
+	SourceType string
+	URL        string
+	// The accessKeyId and secretKey of the disk's secretRef, if it has one.
+	Credentials *RegistryCredentials
+	CABundle    []byte
+	Headers     http.Header
+	// Read the start of the artifact to tell its format and compression.
+	Sniff bool
+	// The ETag the artifact had when it was probed, if the server sent one.
+	ETag string
+}
+
+// SourceProbeResult is what a probe learned about an artifact. Fields are left
+// empty when the server does not tell.
+type SourceProbeResult struct {
+	ContentLength int64
+	ETag          string
+	Format        string
+	Compression   string
+	// The size of the disk a qcow2 image holds.
+	VirtualSize int64
+}
+
+// SourceProbe checks that the artifact of an S3 or HTTP source exists before
+// anything is created to import it.
+type SourceProbe interface {
+	// Probe returns an error wrapping ErrMissingSourceArtifact when the
+	// artifact does not exist.
+	Probe(ctx context.Context, request SourceProbeRequest) (SourceProbeResult, error)
+}
+
+// HTTPSourceProbe probes artifacts over HTTP, signing requests to S3 with the
+// source's credentials.
+type HTTPSourceProbe struct {
+	// How long a request may take. Defaults to 30s, a negative timeout
+	// lets downloads of large artifacts take as long as they need.
+	Timeout time.Duration
+}
+
+func (p HTTPSourceProbe) Probe(ctx context.Context, probeRequest SourceProbeRequest) (SourceProbeResult, error) {
+	// A ranged GET tells us as much as a HEAD and lets us look at the first bytes
+	method := http.MethodHead
+	if probeRequest.Sniff {
+		method = http.MethodGet
+	}
+	response, artifactURL, err := p.do(ctx, method, probeRequest, func(request *http.Request) {
+		if probeRequest.Sniff {
+			request.Header.Set("Range", fmt.Sprintf("bytes=0-%d", sniffLength-1))
+		}
+	})
+	if err != nil {
+		return SourceProbeResult{}, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode >= 300 {
+		return SourceProbeResult{}, fmt.Errorf("failed to probe %s: %s", artifactURL.Redacted(), response.Status)
+	}
+
+	result := SourceProbeResult{
+		ContentLength: response.ContentLength,
+		ETag:          strings.Trim(response.Header.Get("ETag"), `"`),
+	}
+	if response.StatusCode == http.StatusPartialContent {
+		result.ContentLength = contentRangeLength(response.Header.Get("Content-Range"))
+	}
+	if result.ContentLength < 0 {
+		result.ContentLength = 0
+	}
+
+	if probeRequest.Sniff {
+		header, err := io.ReadAll(io.LimitReader(response.Body, sniffLength))
+		if err != nil {
+			return SourceProbeResult{}, fmt.Errorf("failed to read the start of %s: %w", artifactURL.Redacted(), err)
+		}
+		result.Format, result.Compression = sniffFormat(header)
+		if result.Format == "qcow2" {
+			result.VirtualSize = qcow2VirtualSize(header)
+		}
+	}
+
+	return result, nil
+}
+
+// Hash downloads the whole artifact and returns its hex encoded digest with
+// the given algorithm. When the request has an ETag the artifact must still
+// be the one that was probed.
+func (p HTTPSourceProbe) Hash(ctx context.Context, hashRequest SourceProbeRequest, algorithm string) (string, error) {
+	hasher, err := newChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := p.Open(ctx, hashRequest)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = body.Close() }()
+
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Open starts downloading the whole artifact. When the request has an ETag
+// the artifact must still be the one that was probed. Reading the body fails
+// when the download ends before the length the server announced.
+func (p HTTPSourceProbe) Open(ctx context.Context, openRequest SourceProbeRequest) (*ArtifactBody, error) {
+	response, artifactURL, err := p.do(ctx, http.MethodGet, openRequest, func(request *http.Request) {
+		if openRequest.ETag != "" {
+			request.Header.Set("If-Match", `"`+openRequest.ETag+`"`)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("%s changed since it was probed", artifactURL.Redacted())
+	case response.StatusCode != http.StatusOK:
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", artifactURL.Redacted(), response.Status)
+	}
+
+	return &ArtifactBody{
+		body:          response.Body,
+		url:           artifactURL,
+		ContentLength: response.ContentLength,
+	}, nil
+}
+
+// ArtifactBody is the content of an artifact being downloaded.
+type ArtifactBody struct {
+	body io.ReadCloser
+	url  *url.URL
+	read int64
+	// -1 when the server does not tell.
+	ContentLength int64
+}
+
+func (b *ArtifactBody) Read(buffer []byte) (int, error) {
+	n, err := b.body.Read(buffer)
+	b.read += int64(n)
+	if err == io.EOF && b.ContentLength >= 0 && b.read != b.ContentLength {
+		return n, fmt.Errorf("read %d of the %d bytes of %s", b.read, b.ContentLength, b.url.Redacted())
+	}
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("failed to read %s: %w", b.url.Redacted(), err)
+	}
+
+	return n, err
+}
+
+func (b *ArtifactBody) Close() error {
+	return b.body.Close()
+}
+
+// Send a request for an artifact with the source's headers and credentials.
+// Artifacts that do not exist are reported as ErrMissingSourceArtifact, other
+// statuses are left to the caller.
+func (p HTTPSourceProbe) do(
+	ctx context.Context,
+	method string,
+	sourceRequest SourceProbeRequest,
+	customize func(*http.Request),
+) (*http.Response, *url.URL, error) {
+	httpClient, err := HTTPRegistryClient{Timeout: p.Timeout}.httpClient(sourceRequest.CABundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Timeout < 0 {
+		httpClient.Timeout = 0
+	}
+
+	artifactURL, err := probeURL(sourceRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, artifactURL.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range sourceRequest.Headers {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
+	customize(request)
+	if sourceRequest.Credentials != nil {
+		if sourceRequest.SourceType == "s3" {
+			signS3Request(request, *sourceRequest.Credentials, time.Now())
+		} else {
+			request.SetBasicAuth(sourceRequest.Credentials.Username, sourceRequest.Credentials.Password)
+		}
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach %s: %w", artifactURL.Redacted(), err)
+	}
+
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		_ = response.Body.Close()
+		return nil, nil, fmt.Errorf("%w: %s returned %s", ErrMissingSourceArtifact, artifactURL.Redacted(), response.Status)
+	}
+
+	return response, artifactURL, nil
+}
+
+// The url to probe. s3://bucket/key urls are served from AWS' default endpoint.
+func probeURL(request SourceProbeRequest) (*url.URL, error) {
+	artifactURL, err := url.Parse(request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source url: %w", err)
+	}
+
+	switch artifactURL.Scheme {
+	case "http", "https":
+		return artifactURL, nil
+	case "s3":
+		return &url.URL{
+			Scheme: "https",
+			Host:   "s3.amazonaws.com",
+			Path:   "/" + artifactURL.Host + artifactURL.Path,
+		}, nil
+	default:
+		return nil, fmt.Errorf("cannot probe %s urls", artifactURL.Scheme)
+	}
+}
+
+// The total length from a "bytes 0-511/1234" Content-Range header.
+func contentRangeLength(contentRange string) int64 {
+	_, total, found := strings.Cut(contentRange, "/")
+	if !found {
+		return 0
+	}
+	length, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return length
+}
+
+// Tell the format and compression of an artifact from its first bytes.
+// Compressed artifacts report the format of their compressed stream as
+// unknown since only the start of it is read.
+func sniffFormat(header []byte) (format string, compression string) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return "", "gzip"
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return "", "xz"
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "", "zstd"
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return "", "bzip2"
+	case bytes.HasPrefix(header, []byte{'Q', 'F', 'I', 0xfb}):
+		return "qcow2", ""
+	case bytes.HasPrefix(header, []byte("conectix")):
+		return "vhd", ""
+	case bytes.HasPrefix(header, []byte("vhdxfile")):
+		return "vhdx", ""
+	case bytes.HasPrefix(header, []byte("KDMV")):
+		return "vmdk", ""
+	case len(header) == 0:
+		return "", ""
+	default:
+		return "raw", ""
+	}
+}
+
+// Sign a request with AWS signature version 4. The payload is left unsigned
+// unless the request already carries its hash, since probes do not send one.
+func signS3Request(request *http.Request, credentials RegistryCredentials, now time.Time) {
+	payloadHash := request.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	region := s3Region(request.URL.Host)
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + request.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	query := request.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	var canonicalQuery []string
+	for _, key := range queryKeys {
+		values := slices.Sorted(slices.Values(query[key]))
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+
+	canonicalPath := request.URL.Path
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		awsURIEncode(canonicalPath, false),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + credentials.Password)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.Username, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// Percent-encode everything but the unreserved characters the way SigV4
+// expects. Unlike url.QueryEscape spaces become %20 rather than +.
+func awsURIEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// The region of an AWS S3 endpoint. Other S3 compatible stores accept the
+// default region.
+func s3Region(host string) string {
+	host = strings.Split(host, ":")[0]
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if i+1 >= len(labels) || !strings.HasSuffix(host, ".amazonaws.com") {
+			break
+		}
+		if region, found := strings.CutPrefix(label, "s3-"); found {
+			return region
+		}
+		if label == "s3" && labels[i+1] != "amazonaws" && !strings.HasPrefix(labels[i+1], "dualstack") {
+			return labels[i+1]
+		}
+	}
+
+	return "us-east-1"
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Record the url each disk is imported from, pin registry images to the
+// digests their tags point at right now so a Ready image is known to contain
+// exactly those bits, and probe the artifacts of S3 and HTTP sources. Sources
+// that cannot be reached are imported as they are, but an artifact that does
+// not exist fails with ErrMissingSourceArtifact before anything is created for
+// it. Disks are then sized from what was learned about their sources. The
+// caller is responsible for persisting the status.
+func (p K8sVMDIProvisioner) ProbeSources(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) error {
+	for _, disk := range vmdi.Spec.GetDisks() {
+		disk.URL = p.ResourceGenerator.ResolveSourceURL(vmdi, disk)
+		if disk.URL != urlNotProvided {
+			setSourceStatus(vmdi, disk, func(status *crdv1.VMDiskImageSourceStatus) {
+				status.URL = disk.URL
+			})
+		}
+
+		switch {
+		case isRegistrySource(disk):
+			if err := p.pinRegistryImage(ctx, vmdi, disk); err != nil {
+				return err
+			}
+		case disk.SourceType == "s3" || disk.SourceType == "http":
+			if err := p.probeSource(ctx, vmdi, disk); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.sizeDisks(ctx, vmdi)
+}
+
+func (p K8sVMDIProvisioner) pinRegistryImage(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) error {
+	logger := logf.FromContext(ctx)
+
+	if disk.Registry != nil && disk.Registry.ImageStream != nil {
+		return nil
+	}
+
+	image, err := ParseRegistryImage(disk.URL)
+	if err != nil {
+		logger.Error(err, "Cannot pin the registry image", "disk", disk.Name)
+		return nil
+	}
+
+	digest := image.Digest
+	if disk.Registry != nil && disk.Registry.Digest != "" {
+		digest = disk.Registry.Digest
+	}
+	if digest == "" && p.RegistryClient != nil {
+		digest, err = p.resolveDigest(ctx, vmdi, disk, image)
+		if errors.Is(err, ErrMissingSourceArtifact) {
+			return err
+		}
+		if err != nil {
+			logger.Error(err, "Failed to resolve the registry image to a digest. Importing by tag.", "disk", disk.Name, "url", disk.URL)
+		}
+	}
+
+	setSourceStatus(vmdi, disk, func(status *crdv1.VMDiskImageSourceStatus) {
+		status.Digest = digest
+	})
+
+	return nil
+}
+
+func (p K8sVMDIProvisioner) probeSource(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) error {
+	logger := logf.FromContext(ctx)
+
+	if p.SourceProbe == nil || disk.URL == urlNotProvided {
+		return nil
+	}
+
+	credentials, caBundle, err := p.sourceCredentials(ctx, vmdi, disk)
+	if err != nil {
+		logger.Error(err, "Cannot probe the source", "disk", disk.Name)
+		return nil
+	}
+	headers, err := p.sourceHeaders(ctx, vmdi, disk)
+	if err != nil {
+		logger.Error(err, "Cannot probe the source", "disk", disk.Name)
+		return nil
+	}
+
+	result, err := p.SourceProbe.Probe(ctx, SourceProbeRequest{
+		SourceType:  disk.SourceType,
+		URL:         disk.URL,
+		Credentials: credentials,
+		CABundle:    caBundle,
+		Headers:     headers,
+		Sniff:       p.SniffSourceFormat,
+	})
+	if errors.Is(err, ErrMissingSourceArtifact) {
+		return err
+	}
+	if err != nil {
+		logger.Error(err, "Failed to probe the source. Importing it anyway.", "disk", disk.Name)
+		return nil
+	}
+
+	setSourceStatus(vmdi, disk, func(status *crdv1.VMDiskImageSourceStatus) {
+		status.ContentLength = result.ContentLength
+		status.ETag = result.ETag
+		status.Format = result.Format
+		status.Compression = result.Compression
+		status.VirtualSize = result.VirtualSize
+	})
+
+	return nil
+}
+
+func (p K8sVMDIProvisioner) resolveDigest(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+	image RegistryImage,
+) (string, error) {
+	credentials, caBundle, err := p.sourceCredentials(ctx, vmdi, disk)
+	if err != nil {
+		return "", err
+	}
+
+	return p.RegistryClient.ResolveDigest(ctx, image, credentials, caBundle)
+}
+
+// The credentials from the secretRef of a disk and the CA bundle from its cert
+// config map, when it has them.
+func (p K8sVMDIProvisioner) sourceCredentials(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) (*RegistryCredentials, []byte, error) {
+	var credentials *RegistryCredentials
+	if disk.SecretRef != "" {
+		secret := &corev1.Secret{}
+		if err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: disk.SecretRef}, secret); err != nil {
+			return nil, nil, fmt.Errorf("failed to get the source secret %s: %w", disk.SecretRef, err)
+		}
+		credentials = &RegistryCredentials{
+			Username: string(secret.Data["accessKeyId"]),
+			Password: string(secret.Data["secretKey"]),
+		}
+	}
+
+	var caBundle []byte
+	if disk.CertConfigMap != nil {
+		configMap := &corev1.ConfigMap{}
+		if err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: *disk.CertConfigMap}, configMap); err != nil {
+			return nil, nil, fmt.Errorf("failed to get the cert config map %s: %w", *disk.CertConfigMap, err)
+		}
+		for _, key := range slices.Sorted(maps.Keys(configMap.Data)) {
+			caBundle = append(caBundle, []byte(configMap.Data[key]+"\n")...)
+		}
+	}
+
+	return credentials, caBundle, nil
+}
+
+// The extra headers CDI sends when importing a disk, including those held in
+// Secrets.
+func (p K8sVMDIProvisioner) sourceHeaders(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+	disk crdv1.VMDiskImageDisk,
+) (http.Header, error) {
+	lines := slices.Clone(disk.ExtraHeaders)
+	for _, secretName := range disk.SecretExtraHeaders {
+		secret := &corev1.Secret{}
+		if err := p.Get(ctx, client.ObjectKey{Namespace: vmdi.Namespace, Name: secretName}, secret); err != nil {
+			return nil, fmt.Errorf("failed to get the header secret %s: %w", secretName, err)
+		}
+		for _, key := range slices.Sorted(maps.Keys(secret.Data)) {
+			lines = append(lines, string(secret.Data[key]))
+		}
+	}
+
+	return ParseHeaderLines(lines), nil
+}
+
+// ParseHeaderLines parses "Name: value" header lines the way CDI does,
+// skipping lines without a colon.
+func ParseHeaderLines(lines []string) http.Header {
+	headers := http.Header{}
+	for _, line := range lines {
+		name, value, found := strings.Cut(line, ":")
+		if found {
+			headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	return headers
+}
+
+// Anything that is not another known source type is pulled from a registry.
+func isRegistrySource(disk crdv1.VMDiskImageDisk) bool {
+	switch disk.SourceType {
+	case "s3", "http", "pvc", "snapshot", "blank":
+		return false
+	default:
+		return disk.Adopt == nil
+	}
+}
+
+// The registry url a disk is imported from, pinned to the recorded digest
+// when there is one.
+func registryImageURL(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) string {
+	status := sourceStatusOf(vmdi, disk)
+	if status == nil || status.Digest == "" {
+		return disk.URL
+	}
+
+	image, err := ParseRegistryImage(disk.URL)
+	if err != nil || strings.HasSuffix(disk.URL, "@"+status.Digest) {
+		return disk.URL
+	}
+
+	return image.PinnedURL(status.Digest)
+}
+
+func sourceStatusOf(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk) *crdv1.VMDiskImageSourceStatus {
+	for i := range vmdi.Status.Sources {
+		if vmdi.Status.Sources[i].Disk == disk.Name {
+			return &vmdi.Status.Sources[i]
+		}
+	}
+
+	return nil
+}
+
+// Update the source status of a disk, adding it if it is not there yet.
+func setSourceStatus(vmdi *crdv1.VMDiskImage, disk crdv1.VMDiskImageDisk, update func(*crdv1.VMDiskImageSourceStatus)) {
+	status := sourceStatusOf(vmdi, disk)
+	if status == nil {
+		vmdi.Status.Sources = append(vmdi.Status.Sources, crdv1.VMDiskImageSourceStatus{Disk: disk.Name})
+		status = &vmdi.Status.Sources[len(vmdi.Status.Sources)-1]
+	}
+
+	update(status)
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	groupsnapshotv1beta2 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumegroupsnapshot/v1beta2"
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestService(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "VMDiskImage Service Suite")
+}
+
+// The types the operator works with, like the scheme of cmd/main.go.
+var testScheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(testScheme))
+	utilruntime.Must(crdv1.AddToScheme(testScheme))
+	utilruntime.Must(cdiv1beta1.AddToScheme(testScheme))
+	utilruntime.Must(snapshotv1.AddToScheme(testScheme))
+	utilruntime.Must(groupsnapshotv1beta2.AddToScheme(testScheme))
+}
+
+func newFakeClient(objects ...client.Object) client.Client {
+	return fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&crdv1.VMDiskImage{}).
+		WithIndex(&crdv1.VMDiskImage{}, ".status.phase", Orchestrator{}.IndexVMDiskImageByPhase).
+		Build()
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Only this many consumers are listed on the status. All of them are counted.
+const maxListedConsumers = 50
+
+// CDI sets this annotation on the PVCs of host-assisted clones to the
+// namespace/name of the PVC they clone.
+const cloneRequestAnnotation = "k8s.io/CloneRequest"
+
+var VirtualMachineGVK = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "VirtualMachine"}
+
+// A volume a consumer can be restored or cloned from, e.g.
+// "VolumeSnapshot/default/ubuntu".
+type consumableSource string
+
+func newConsumableSource(kind string, namespace string, name string) consumableSource {
+	return consumableSource(kind + "/" + namespace + "/" + name)
+}
+
+// Find the PVCs, DataVolumes and VirtualMachines restored or cloned from the
+// snapshots, PVCs and DataSources of a VMDiskImage, in any namespace. PVCs
+// created for a DataVolume and DataVolumes created for a VirtualMachine are
+// reported through their owner.
+func (p K8sVMDIProvisioner) FindConsumers(
+	ctx context.Context,
+	vmdi *crdv1.VMDiskImage,
+) ([]crdv1.VMDiskImageConsumer, error) {
+	sources := consumableSourcesOf(vmdi)
+	var consumers []crdv1.VMDiskImageConsumer
+
+	claims := &corev1.PersistentVolumeClaimList{}
+	if err := p.List(ctx, claims); err != nil {
+		return nil, fmt.Errorf("failed to list persistentvolumeclaims: %w", err)
+	}
+	for _, claim := range claims.Items {
+		if isChildOf(&claim, vmdi) || isOwnedByKind(&claim, "DataVolume") {
+			continue
+		}
+		if slices.ContainsFunc(claimSources(claim), sources.has) {
+			consumers = append(consumers, consumerOf("PersistentVolumeClaim", &claim))
+		}
+	}
+
+	dataVolumes := &cdiv1beta1.DataVolumeList{}
+	if err := p.List(ctx, dataVolumes); err != nil {
+		return nil, fmt.Errorf("failed to list datavolumes: %w", err)
+	}
+	for _, dataVolume := range dataVolumes.Items {
+		if isChildOf(&dataVolume, vmdi) || isOwnedByKind(&dataVolume, VirtualMachineGVK.Kind) {
+			continue
+		}
+		if slices.ContainsFunc(dataVolumeSources(dataVolume.Namespace, dataVolume.Spec), sources.has) {
+			consumers = append(consumers, consumerOf("DataVolume", &dataVolume))
+		}
+	}
+
+	if p.VirtualMachinesAvailable {
+		virtualMachines := &unstructured.UnstructuredList{}
+		virtualMachines.SetGroupVersionKind(VirtualMachineGVK.GroupVersion().WithKind(VirtualMachineGVK.Kind + "List"))
+		if err := p.List(ctx, virtualMachines); err != nil {
+			return nil, fmt.Errorf("failed to list virtualmachines: %w", err)
+		}
+		for _, virtualMachine := range virtualMachines.Items {
+			if slices.ContainsFunc(virtualMachineSources(virtualMachine), sources.has) {
+				consumers = append(consumers, consumerOf(VirtualMachineGVK.Kind, &virtualMachine))
+			}
+		}
+	}
+
+	slices.SortFunc(consumers, func(a, b crdv1.VMDiskImageConsumer) int {
+		return cmp.Or(
+			cmp.Compare(a.Kind, b.Kind),
+			cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.Name, b.Name),
+		)
+	})
+
+	return consumers, nil
+}
+
+type consumableSources map[consumableSource]bool
+
+func (s consumableSources) has(source consumableSource) bool {
+	return s[source]
+}
+
+// Everything a consumer of the VMDiskImage could be restored or cloned from.
+func consumableSourcesOf(vmdi *crdv1.VMDiskImage) consumableSources {
+	sources := consumableSources{}
+
+	for _, disk := range vmdi.Spec.GetDisks() {
+		sources[newConsumableSource("PersistentVolumeClaim", vmdi.Namespace, diskResourceName(vmdi, disk))] = true
+	}
+	for _, diskStatus := range vmdi.Status.Disks {
+		if diskStatus.SnapshotName != "" {
+			sources[newConsumableSource("VolumeSnapshot", vmdi.Namespace, diskStatus.SnapshotName)] = true
+		}
+	}
+	for _, snapshotCopy := range vmdi.Status.Copies {
+		if snapshotCopy.SnapshotName != "" {
+			sources[newConsumableSource("VolumeSnapshot", snapshotCopy.Namespace, snapshotCopy.SnapshotName)] = true
+		}
+	}
+	for _, dataSource := range vmdi.Status.DataSources {
+		sources[newConsumableSource("DataSource", vmdi.Namespace, dataSource)] = true
+	}
+
+	return sources
+}
+
+// What a PVC was restored or cloned from, through its dataSource, its
+// dataSourceRef or the clone annotation of CDI.
+func claimSources(claim corev1.PersistentVolumeClaim) []consumableSource {
+	var sources []consumableSource
+
+	if dataSource := claim.Spec.DataSource; dataSource != nil {
+		sources = append(sources, newConsumableSource(dataSource.Kind, claim.Namespace, dataSource.Name))
+	}
+	if dataSourceRef := claim.Spec.DataSourceRef; dataSourceRef != nil {
+		namespace := claim.Namespace
+		if dataSourceRef.Namespace != nil {
+			namespace = *dataSourceRef.Namespace
+		}
+		sources = append(sources, newConsumableSource(dataSourceRef.Kind, namespace, dataSourceRef.Name))
+	}
+	if cloneRequest, found := claim.Annotations[cloneRequestAnnotation]; found {
+		if namespace, name, found := strings.Cut(cloneRequest, "/"); found {
+			sources = append(sources, newConsumableSource("PersistentVolumeClaim", namespace, name))
+		}
+	}
+
+	return sources
+}
+
+// What a DataVolume is cloned from. Sources without a namespace are in the
+// namespace of the DataVolume.
+func dataVolumeSources(namespace string, spec cdiv1beta1.DataVolumeSpec) []consumableSource {
+	var sources []consumableSource
+
+	if spec.Source != nil && spec.Source.Snapshot != nil {
+		snapshot := spec.Source.Snapshot
+		sources = append(sources, newConsumableSource("VolumeSnapshot", cmp.Or(snapshot.Namespace, namespace), snapshot.Name))
+	}
+	if spec.Source != nil && spec.Source.PVC != nil {
+		pvc := spec.Source.PVC
+		sources = append(sources, newConsumableSource("PersistentVolumeClaim", cmp.Or(pvc.Namespace, namespace), pvc.Name))
+	}
+	if spec.SourceRef != nil {
+		sourceRef := spec.SourceRef
+		sourceNamespace := namespace
+		if sourceRef.Namespace != nil {
+			sourceNamespace = *sourceRef.Namespace
+		}
+		sources = append(sources, newConsumableSource(sourceRef.Kind, sourceNamespace, sourceRef.Name))
+	}
+
+	return sources
+}
+
+// What the DataVolume templates of a KubeVirt VirtualMachine are cloned from.
+// The KubeVirt API is read without its types so the operator does not depend
+// on it.
+func virtualMachineSources(virtualMachine unstructured.Unstructured) []consumableSource {
+	templates, _, _ := unstructured.NestedSlice(virtualMachine.Object, "spec", "dataVolumeTemplates")
+
+	var sources []consumableSource
+	for _, template := range templates {
+		templateObject, ok := template.(map[string]any)
+		if !ok {
+			continue
+		}
+		templateSpec, _, _ := unstructured.NestedMap(templateObject, "spec")
+		spec := cdiv1beta1.DataVolumeSpec{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(templateSpec, &spec); err != nil {
+			continue
+		}
+		sources = append(sources, dataVolumeSources(virtualMachine.GetNamespace(), spec)...)
+	}
+
+	return sources
+}
+
+func isChildOf(obj metav1.Object, vmdi *crdv1.VMDiskImage) bool {
+	return obj.GetLabels()[crdv1.VMDiskImageUIDLabel] == string(vmdi.UID)
+}
+
+func isOwnedByKind(obj metav1.Object, kind string) bool {
+	return slices.ContainsFunc(obj.GetOwnerReferences(), func(owner metav1.OwnerReference) bool {
+		return owner.Kind == kind
+	})
+}
+
+func consumerOf(kind string, obj client.Object) crdv1.VMDiskImageConsumer {
+	return crdv1.VMDiskImageConsumer{
+		Kind:      kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+}
+
+// Record the consumers of a VMDiskImage on its status and the InUse
+// condition. Returns whether the VMDiskImage is in use. The caller is
+// responsible for persisting the status.
+func setConsumerStatus(vmdi *crdv1.VMDiskImage, consumers []crdv1.VMDiskImageConsumer) bool {
+	vmdi.Status.ConsumerCount = len(consumers)
+	vmdi.Status.Consumers = consumers[:min(len(consumers), maxListedConsumers)]
+
+	condition := metav1.Condition{
+		Type:    crdv1.ConditionTypeInUse,
+		Status:  metav1.ConditionFalse,
+		Reason:  crdv1.ReasonNoConsumers,
+		Message: "Nothing was restored or cloned from the VMDiskImage.",
+	}
+	if len(consumers) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = crdv1.ReasonConsumersFound
+		condition.Message = fmt.Sprintf("%d resources were restored or cloned from the VMDiskImage.", len(consumers))
+	}
+	meta.SetStatusCondition(&vmdi.Status.Conditions, condition)
+
+	return len(consumers) > 0
+}
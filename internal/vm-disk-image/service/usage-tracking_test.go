@@ -0,0 +1,161 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+var _ = Describe("claimSources", func() {
+	It("reads the dataSource, dataSourceRef and clone annotation of a PVC", func() {
+		claim := corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "vms",
+				Annotations: map[string]string{cloneRequestAnnotation: "images/ubuntu-disk"},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				DataSource: &corev1.TypedLocalObjectReference{Kind: "VolumeSnapshot", Name: "ubuntu"},
+				DataSourceRef: &corev1.TypedObjectReference{
+					Kind:      "DataSource",
+					Name:      "ubuntu",
+					Namespace: ptr.To("images"),
+				},
+			},
+		}
+
+		Expect(claimSources(claim)).To(Equal([]consumableSource{
+			"VolumeSnapshot/vms/ubuntu",
+			"DataSource/images/ubuntu",
+			"PersistentVolumeClaim/images/ubuntu-disk",
+		}))
+	})
+
+	It("defaults the namespace of a dataSourceRef to the PVC's", func() {
+		claim := corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "vms"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				DataSourceRef: &corev1.TypedObjectReference{Kind: "VolumeSnapshot", Name: "ubuntu"},
+			},
+		}
+
+		Expect(claimSources(claim)).To(Equal([]consumableSource{"VolumeSnapshot/vms/ubuntu"}))
+	})
+
+	It("ignores malformed clone annotations", func() {
+		claim := corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "vms",
+			Annotations: map[string]string{cloneRequestAnnotation: "ubuntu-disk"},
+		}}
+
+		Expect(claimSources(claim)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("dataVolumeSources", func() {
+	DescribeTable("reads what a DataVolume is cloned from",
+		func(spec cdiv1beta1.DataVolumeSpec, expected []consumableSource) {
+			Expect(dataVolumeSources("vms", spec)).To(Equal(expected))
+		},
+		Entry("snapshots in other namespaces",
+			cdiv1beta1.DataVolumeSpec{Source: &cdiv1beta1.DataVolumeSource{
+				Snapshot: &cdiv1beta1.DataVolumeSourceSnapshot{Namespace: "images", Name: "ubuntu"},
+			}},
+			[]consumableSource{"VolumeSnapshot/images/ubuntu"}),
+		Entry("PVCs in their own namespace",
+			cdiv1beta1.DataVolumeSpec{Source: &cdiv1beta1.DataVolumeSource{
+				PVC: &cdiv1beta1.DataVolumeSourcePVC{Name: "ubuntu-disk"},
+			}},
+			[]consumableSource{"PersistentVolumeClaim/vms/ubuntu-disk"}),
+		Entry("DataSources",
+			cdiv1beta1.DataVolumeSpec{SourceRef: &cdiv1beta1.DataVolumeSourceRef{
+				Kind: "DataSource", Namespace: ptr.To("images"), Name: "ubuntu",
+			}},
+			[]consumableSource{"DataSource/images/ubuntu"}),
+		Entry("imports", cdiv1beta1.DataVolumeSpec{Source: &cdiv1beta1.DataVolumeSource{
+			HTTP: &cdiv1beta1.DataVolumeSourceHTTP{URL: "https://example.com/disk.img"},
+		}}, nil),
+	)
+})
+
+var _ = Describe("FindConsumers", func() {
+	vmdi := &crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{Name: "ubuntu", Namespace: "images", UID: "uid-1"},
+		Spec: crdv1.VMDiskImageSpec{
+			VMDiskSpec: crdv1.VMDiskSpec{SourceType: "http", URL: "https://example.com/disk.img"},
+		},
+		Status: crdv1.VMDiskImageStatus{DataSources: []string{"ubuntu"}},
+	}
+	diskName := diskResourceName(vmdi, vmdi.Spec.GetDisks()[0])
+
+	It("finds the PVCs and DataVolumes made from a VMDiskImage", func(ctx SpecContext) {
+		c := newFakeClient(
+			// The VMDiskImage's own PVC is not a consumer
+			&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+				Name: diskName, Namespace: "images", Labels: withOperatorLabels(nil, vmdi),
+			}},
+			&corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "restored", Namespace: "images"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					DataSourceRef: &corev1.TypedObjectReference{Kind: "DataSource", Name: "ubuntu"},
+				},
+			},
+			// PVCs of DataVolumes are reported through their DataVolume
+			&corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "clone", Namespace: "vms",
+					OwnerReferences: []metav1.OwnerReference{{Kind: "DataVolume", Name: "clone", UID: "uid-dv"}},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					DataSource: &corev1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "anything"},
+				},
+			},
+			&cdiv1beta1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "clone", Namespace: "vms"},
+				Spec: cdiv1beta1.DataVolumeSpec{Source: &cdiv1beta1.DataVolumeSource{
+					PVC: &cdiv1beta1.DataVolumeSourcePVC{Namespace: "images", Name: diskName},
+				}},
+			},
+			&cdiv1beta1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "vms"},
+				Spec: cdiv1beta1.DataVolumeSpec{Source: &cdiv1beta1.DataVolumeSource{
+					PVC: &cdiv1beta1.DataVolumeSourcePVC{Namespace: "images", Name: "debian-disk"},
+				}},
+			},
+		)
+		provisioner := K8sVMDIProvisioner{Client: c}
+
+		consumers, err := provisioner.FindConsumers(ctx, vmdi)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consumers).To(Equal([]crdv1.VMDiskImageConsumer{
+			{Kind: "DataVolume", Namespace: "vms", Name: "clone"},
+			{Kind: "PersistentVolumeClaim", Namespace: "images", Name: "restored"},
+		}))
+	})
+})
+
+var _ = Describe("setConsumerStatus", func() {
+	It("lists a bounded number of consumers and counts all of them", func() {
+		vmdi := &crdv1.VMDiskImage{}
+		consumers := make([]crdv1.VMDiskImageConsumer, maxListedConsumers+5)
+
+		Expect(setConsumerStatus(vmdi, consumers)).To(BeTrue())
+		Expect(vmdi.Status.Consumers).To(HaveLen(maxListedConsumers))
+		Expect(vmdi.Status.ConsumerCount).To(Equal(maxListedConsumers + 5))
+		Expect(meta.IsStatusConditionTrue(vmdi.Status.Conditions, crdv1.ConditionTypeInUse)).To(BeTrue())
+	})
+
+	It("marks a VMDiskImage nothing was made from as not in use", func() {
+		vmdi := &crdv1.VMDiskImage{}
+
+		Expect(setConsumerStatus(vmdi, nil)).To(BeFalse())
+		Expect(vmdi.Status.ConsumerCount).To(BeZero())
+		Expect(meta.IsStatusConditionFalse(vmdi.Status.Conditions, crdv1.ConditionTypeInUse)).To(BeTrue())
+	})
+})
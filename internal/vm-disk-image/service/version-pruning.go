@@ -0,0 +1,196 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// VersionPruner periodically deletes the VMDiskImages of old image versions,
+// keeping the latest versions of each image name in a namespace. Deleting
+// them goes through the usual teardown. It only runs on the leader.
+type VersionPruner struct {
+	client.Client
+	Recorder record.EventRecorder
+	Interval time.Duration
+	// How many of the latest versions of each image are kept.
+	RetainedVersions int
+	DryRun           bool
+}
+
+func (p *VersionPruner) NeedLeaderElection() bool {
+	return true
+}
+
+func (p *VersionPruner) Start(ctx context.Context) error {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			p.Prune(ctx)
+		}
+	}
+}
+
+// An image name within a namespace.
+type imageKey struct {
+	namespace string
+	name      string
+}
+
+// The VMDiskImages holding one version of an image.
+type imageVersion struct {
+	version string
+	vmdis   []crdv1.VMDiskImage
+	// When the newest VMDiskImage of the version was created.
+	created time.Time
+	ready   bool
+}
+
+// Prune runs a single pass over the VMDiskImages with an image identity.
+func (p *VersionPruner) Prune(ctx context.Context) {
+	logger := logf.FromContext(ctx).WithName("version-pruner")
+
+	vmdiList := &crdv1.VMDiskImageList{}
+	if err := p.List(ctx, vmdiList); err != nil {
+		logger.Error(err, "Failed to list VMDiskImages")
+		return
+	}
+
+	images := map[imageKey][]crdv1.VMDiskImage{}
+	for _, vmdi := range vmdiList.Items {
+		if vmdi.Spec.Image == nil {
+			continue
+		}
+		key := imageKey{namespace: vmdi.Namespace, name: vmdi.Spec.Image.Name}
+		images[key] = append(images[key], vmdi)
+	}
+
+	for key, vmdis := range images {
+		versions := groupImageVersions(vmdis)
+		prunable := p.prunableVersions(versions)
+		if len(prunable) == 0 {
+			continue
+		}
+		// Events about the image go to the newest VMDiskImage since the pruned ones go away
+		latest := &versions[0].vmdis[0]
+
+		var pruned []string
+		for _, version := range prunable {
+			for _, vmdi := range version.vmdis {
+				if reason := keepReason(&vmdi); reason != "" {
+					logger.V(1).Info("Keeping an old image version", "namespace", vmdi.Namespace, "name", vmdi.Name, "version", version.version, "reason", reason)
+					continue
+				}
+
+				if p.DryRun {
+					logger.Info("Would prune an old image version", "namespace", vmdi.Namespace, "name", vmdi.Name, "image", key.name, "version", version.version)
+					pruned = append(pruned, vmdi.Name)
+					continue
+				}
+
+				if err := p.Delete(ctx, &vmdi); err != nil && !errors.IsNotFound(err) {
+					logger.Error(err, "Failed to prune an old image version", "namespace", vmdi.Namespace, "name", vmdi.Name)
+					continue
+				}
+				logger.Info("Pruned an old image version", "namespace", vmdi.Namespace, "name", vmdi.Name, "image", key.name, "version", version.version)
+				p.Recorder.Eventf(&vmdi, "Normal", "Pruned", "Deleted since version %s of %s is older than the %d retained versions", version.version, key.name, p.RetainedVersions)
+				versionsPruned.Inc()
+				pruned = append(pruned, vmdi.Name)
+			}
+		}
+		if len(pruned) == 0 {
+			continue
+		}
+
+		if p.DryRun {
+			p.Recorder.Eventf(latest, "Normal", "WouldPrune", "Would prune old versions of %s: %s", key.name, strings.Join(pruned, ", "))
+		} else {
+			p.Recorder.Eventf(latest, "Normal", "PrunedVersions", "Pruned old versions of %s: %s", key.name, strings.Join(pruned, ", "))
+		}
+	}
+}
+
+// Group the VMDiskImages of an image by version, newest version first.
+func groupImageVersions(vmdis []crdv1.VMDiskImage) []imageVersion {
+	byVersion := map[string]*imageVersion{}
+	for _, vmdi := range vmdis {
+		version, found := byVersion[vmdi.Spec.Image.Version]
+		if !found {
+			version = &imageVersion{version: vmdi.Spec.Image.Version}
+			byVersion[vmdi.Spec.Image.Version] = version
+		}
+		version.vmdis = append(version.vmdis, vmdi)
+		if vmdi.CreationTimestamp.After(version.created) {
+			version.created = vmdi.CreationTimestamp.Time
+		}
+		version.ready = version.ready || vmdi.Status.Phase == crdv1.PhaseReady
+	}
+
+	versions := make([]imageVersion, 0, len(byVersion))
+	for _, version := range byVersion {
+		slices.SortFunc(version.vmdis, func(a, b crdv1.VMDiskImage) int {
+			return cmp.Or(
+				b.CreationTimestamp.Compare(a.CreationTimestamp.Time),
+				cmp.Compare(a.Name, b.Name),
+			)
+		})
+		versions = append(versions, *version)
+	}
+	slices.SortFunc(versions, func(a, b imageVersion) int {
+		return cmp.Or(
+			b.created.Compare(a.created),
+			cmp.Compare(b.version, a.version),
+		)
+	})
+
+	return versions
+}
+
+// The versions older than the retained ones. Only Ready versions count
+// towards the retained ones so a version that is still syncing, or failed,
+// never pushes out the last usable one.
+func (p *VersionPruner) prunableVersions(versions []imageVersion) []imageVersion {
+	retained := 0
+	for i, version := range versions {
+		if retained >= p.RetainedVersions {
+			return versions[i:]
+		}
+		if version.ready {
+			retained++
+		}
+	}
+
+	return nil
+}
+
+// Why a VMDiskImage of an old version is kept, or empty when it can be pruned.
+func keepReason(vmdi *crdv1.VMDiskImage) string {
+	switch {
+	case !vmdi.DeletionTimestamp.IsZero():
+		return "already being deleted"
+	case vmdi.Annotations[crdv1.VMDiskImagePinAnnotation] == "true":
+		return "pinned"
+	case meta.IsStatusConditionTrue(vmdi.Status.Conditions, crdv1.ConditionTypeInUse):
+		return "in use"
+	case metav1.GetControllerOf(vmdi) != nil:
+		return "managed by " + metav1.GetControllerOf(vmdi).Kind
+	}
+
+	return ""
+}
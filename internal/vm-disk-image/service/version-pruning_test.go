@@ -0,0 +1,132 @@
+package service
+
+import (
+	"time"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func imageVersionVMDiskImage(name string, version string, age time.Duration, phase string) crdv1.VMDiskImage {
+	return crdv1.VMDiskImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "images",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age).Truncate(time.Second)),
+		},
+		Spec: crdv1.VMDiskImageSpec{
+			Image: &crdv1.VMDiskImageIdentity{Name: "ubuntu", Version: version},
+		},
+		Status: crdv1.VMDiskImageStatus{Phase: phase},
+	}
+}
+
+func versionNames(versions []imageVersion) []string {
+	names := make([]string, 0, len(versions))
+	for _, version := range versions {
+		names = append(names, version.version)
+	}
+	return names
+}
+
+var _ = Describe("groupImageVersions", func() {
+	It("groups VMDiskImages by version, newest first", func() {
+		versions := groupImageVersions([]crdv1.VMDiskImage{
+			imageVersionVMDiskImage("ubuntu-1", "1", 3*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-3", "3", time.Hour, crdv1.PhaseSyncing),
+			imageVersionVMDiskImage("ubuntu-2", "2", 2*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-1-copy", "1", 4*time.Hour, crdv1.PhaseFailed),
+		})
+
+		Expect(versionNames(versions)).To(Equal([]string{"3", "2", "1"}))
+		Expect(versions[0].ready).To(BeFalse())
+		Expect(versions[2].ready).To(BeTrue())
+		Expect(versions[2].vmdis).To(HaveLen(2))
+		Expect(versions[2].vmdis[0].Name).To(Equal("ubuntu-1"))
+	})
+
+	It("dates a version by its newest VMDiskImage", func() {
+		versions := groupImageVersions([]crdv1.VMDiskImage{
+			imageVersionVMDiskImage("ubuntu-1", "1", 5*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-2", "2", 2*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-1-again", "1", time.Hour, crdv1.PhaseReady),
+		})
+
+		Expect(versionNames(versions)).To(Equal([]string{"1", "2"}))
+	})
+})
+
+var _ = Describe("prunableVersions", func() {
+	versions := func(readiness ...bool) []imageVersion {
+		var versions []imageVersion
+		for i, ready := range readiness {
+			versions = append(versions, imageVersion{version: string(rune('a' + i)), ready: ready})
+		}
+		return versions
+	}
+
+	DescribeTable("keeps the latest Ready versions and what is newer than them",
+		func(retained int, all []imageVersion, expected []string) {
+			pruner := &VersionPruner{RetainedVersions: retained}
+			Expect(versionNames(pruner.prunableVersions(all))).To(Equal(expected))
+		},
+		Entry("nothing when there are few versions", 2, versions(true, true), []string{}),
+		Entry("the versions past the retained ones", 2, versions(true, true, true, true), []string{"c", "d"}),
+		Entry("not counting versions that are not Ready", 1, versions(false, false, true, true), []string{"d"}),
+		Entry("nothing when no version is Ready", 1, versions(false, false, false), []string{}),
+	)
+})
+
+var _ = Describe("VersionPruner", func() {
+	It("deletes old versions unless they are pinned, in use or managed", func(ctx SpecContext) {
+		vmdis := []crdv1.VMDiskImage{
+			imageVersionVMDiskImage("ubuntu-4", "4", time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-3", "3", 2*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-2", "2", 3*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-1", "1", 4*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-0", "0", 5*time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-old", "old", 6*time.Hour, crdv1.PhaseReady),
+		}
+		vmdis[2].Annotations = map[string]string{crdv1.VMDiskImagePinAnnotation: "true"}
+		vmdis[3].Status.Conditions = []metav1.Condition{{Type: crdv1.ConditionTypeInUse, Status: metav1.ConditionTrue}}
+		vmdis[4].OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: crdv1.GroupVersion.String(), Kind: "WorkspaceImageSet", Name: "workspace", UID: "uid-set", Controller: ptr.To(true),
+		}}
+		c := newFakeClient(&vmdis[0], &vmdis[1], &vmdis[2], &vmdis[3], &vmdis[4], &vmdis[5])
+		recorder := record.NewFakeRecorder(10)
+		pruner := &VersionPruner{Client: c, Recorder: recorder, RetainedVersions: 2}
+
+		pruner.Prune(ctx)
+
+		remaining := &crdv1.VMDiskImageList{}
+		Expect(c.List(ctx, remaining)).To(Succeed())
+		var names []string
+		for _, vmdi := range remaining.Items {
+			names = append(names, vmdi.Name)
+		}
+		Expect(names).To(ConsistOf("ubuntu-4", "ubuntu-3", "ubuntu-2", "ubuntu-1", "ubuntu-0"))
+		Expect(recorder.Events).To(Receive(ContainSubstring("Pruned")))
+	})
+
+	It("only reports old versions in dry run mode", func(ctx SpecContext) {
+		vmdis := []crdv1.VMDiskImage{
+			imageVersionVMDiskImage("ubuntu-2", "2", time.Hour, crdv1.PhaseReady),
+			imageVersionVMDiskImage("ubuntu-1", "1", 2*time.Hour, crdv1.PhaseReady),
+		}
+		c := newFakeClient(&vmdis[0], &vmdis[1])
+		recorder := record.NewFakeRecorder(10)
+		pruner := &VersionPruner{Client: c, Recorder: recorder, RetainedVersions: 1, DryRun: true}
+
+		pruner.Prune(ctx)
+
+		remaining := &crdv1.VMDiskImageList{}
+		Expect(c.List(ctx, remaining)).To(Succeed())
+		Expect(remaining.Items).To(HaveLen(2))
+		Expect(recorder.Events).To(Receive(ContainSubstring("WouldPrune")))
+	})
+})
@@ -0,0 +1,118 @@
+package workspaceimagesetctrl
+
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	wis "pelotech/data-sync-operator/internal/workspace-image-set/service"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// WorkspaceImageSetReconciler reconciles a WorkspaceImageSet object
+type WorkspaceImageSetReconciler struct {
+	Scheme *runtime.Scheme
+	wis.WorkspaceImageSetOrchestrator
+}
+
+// +kubebuilder:rbac:groups=crd.pelotech.ot,resources=workspaceimagesets,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=crd.pelotech.ot,resources=workspaceimagesets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=crd.pelotech.ot,resources=workspaceimagesets/finalizers,verbs=update
+
+// Reconcile brings the member VMDiskImages of a WorkspaceImageSet in line
+// with its spec and aggregates their phases into its status.
+func (r *WorkspaceImageSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := logf.FromContext(ctx)
+
+	var set crdv1.WorkspaceImageSet
+
+	err := r.GetWorkspaceImageSet(ctx, req.NamespacedName, &set)
+	if err != nil && errors.IsNotFound(err) {
+		logger.Info("Resource has been deleted.")
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get WorkspaceImageSet")
+		return ctrl.Result{}, err
+	}
+
+	// The owned VMDiskImages are garbage collected with the set
+	if !set.GetDeletionTimestamp().IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	return r.ReconcileMembers(ctx, &set)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WorkspaceImageSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	logger := mgr.GetLogger()
+
+	orchestrator := wis.Orchestrator{
+		Client:   mgr.GetClient(),
+		Recorder: mgr.GetEventRecorderFor(crdv1.WorkspaceImageSetControllerName),
+	}
+	r.WorkspaceImageSetOrchestrator = orchestrator
+
+	// Index sets by the VMDiskImages they reference to find them when one changes
+	err := mgr.GetFieldIndexer().
+		IndexField(
+			context.TODO(),
+			&crdv1.WorkspaceImageSet{},
+			wis.MemberRefIndex,
+			orchestrator.IndexWorkspaceImageSetByMemberRef,
+		)
+	if err != nil {
+		logger.Error(err, "Failed to created indexer")
+		return err
+	}
+
+	// Referenced VMDiskImages are not owned so their sets are looked up
+	enqueueReferencingSets := func(ctx context.Context, vmdi crclient.Object) []reconcile.Request {
+		sets, err := orchestrator.ListWorkspaceImageSetsReferencing(ctx, vmdi)
+		if err != nil {
+			logger.Error(err, "Failed to list WorkspaceImageSets for a VMDiskImage change")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for _, set := range sets.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+				Namespace: set.Namespace,
+				Name:      set.Name,
+			}})
+		}
+
+		return requests
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&crdv1.WorkspaceImageSet{}).
+		Owns(&crdv1.VMDiskImage{}).
+		Watches(&crdv1.VMDiskImage{}, handler.EnqueueRequestsFromMapFunc(enqueueReferencingSets)).
+		Named("workspaceimageset").
+		Complete(r)
+}
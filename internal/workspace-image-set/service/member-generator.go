@@ -0,0 +1,59 @@
+package service
+
+import (
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// The name of the VMDiskImage of a member.
+func memberVMDiskImageName(set *crdv1.WorkspaceImageSet, member crdv1.WorkspaceImageSetMember) string {
+	if member.VMDiskImageRef != nil {
+		return member.VMDiskImageRef.Name
+	}
+
+	return set.Name + "-" + member.Name
+}
+
+// Build the VMDiskImage a set owns for a member described by a template. The
+// settings of the set fill in what the template leaves unset.
+func generateMemberVMDiskImage(set *crdv1.WorkspaceImageSet, member crdv1.WorkspaceImageSetMember) *crdv1.VMDiskImage {
+	spec := member.Template.DeepCopy()
+
+	if set.Spec.PriorityClassName != "" {
+		if spec.DataVolumeTemplate == nil {
+			spec.DataVolumeTemplate = &crdv1.VMDiskImageDataVolumeTemplate{}
+		}
+		if spec.DataVolumeTemplate.PriorityClassName == "" {
+			spec.DataVolumeTemplate.PriorityClassName = set.Spec.PriorityClassName
+		}
+	}
+	if spec.DeletionPolicy == "" {
+		spec.DeletionPolicy = set.Spec.DeletionPolicy
+	}
+
+	return &crdv1.VMDiskImage{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: crdv1.GroupVersion.String(),
+			Kind:       "VMDiskImage",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      memberVMDiskImageName(set, member),
+			Namespace: set.Namespace,
+			Labels: map[string]string{
+				crdv1.WorkspaceImageSetNameLabel:   set.Name,
+				crdv1.WorkspaceImageSetMemberLabel: member.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion:         crdv1.GroupVersion.String(),
+				BlockOwnerDeletion: ptr.To(true),
+				Kind:               "WorkspaceImageSet",
+				Name:               set.Name,
+				UID:                set.UID,
+				Controller:         ptr.To(true),
+			}},
+		},
+		Spec: *spec,
+	}
+}
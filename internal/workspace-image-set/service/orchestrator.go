@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The field WorkspaceImageSets are indexed by to find the sets referencing a
+// VMDiskImage they do not own.
+const MemberRefIndex = ".spec.members.vmDiskImageRef.name"
+
+type WorkspaceImageSetOrchestrator interface {
+	GetWorkspaceImageSet(ctx context.Context, namespace types.NamespacedName, set *crdv1.WorkspaceImageSet) error
+	IndexWorkspaceImageSetByMemberRef(rawObj client.Object) []string
+	ListWorkspaceImageSetsReferencing(ctx context.Context, vmdi client.Object) (*crdv1.WorkspaceImageSetList, error)
+	ReconcileMembers(ctx context.Context, set *crdv1.WorkspaceImageSet) (ctrl.Result, error)
+}
+
+type Orchestrator struct {
+	client.Client
+	Recorder record.EventRecorder
+}
+
+func (o Orchestrator) GetWorkspaceImageSet(ctx context.Context, namespace types.NamespacedName, set *crdv1.WorkspaceImageSet) error {
+	return o.Get(ctx, namespace, set)
+}
+
+func (o Orchestrator) IndexWorkspaceImageSetByMemberRef(rawObj client.Object) []string {
+	set, ok := rawObj.(*crdv1.WorkspaceImageSet)
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	for _, member := range set.Spec.Members {
+		if member.VMDiskImageRef != nil {
+			names = append(names, member.VMDiskImageRef.Name)
+		}
+	}
+
+	return names
+}
+
+func (o Orchestrator) ListWorkspaceImageSetsReferencing(ctx context.Context, vmdi client.Object) (*crdv1.WorkspaceImageSetList, error) {
+	list := &crdv1.WorkspaceImageSetList{}
+
+	listOpts := []client.ListOption{
+		client.InNamespace(vmdi.GetNamespace()),
+		client.MatchingFields{MemberRefIndex: vmdi.GetName()},
+	}
+	if err := o.List(ctx, list, listOpts...); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Create or update the VMDiskImages of the set's templates, delete the ones
+// of members that were removed and report the phase of every member.
+func (o Orchestrator) ReconcileMembers(ctx context.Context, set *crdv1.WorkspaceImageSet) (ctrl.Result, error) {
+	logger := logf.FromContext(ctx)
+
+	memberStatuses := make([]crdv1.WorkspaceImageSetMemberStatus, 0, len(set.Spec.Members))
+	for _, member := range set.Spec.Members {
+		memberStatus, err := o.reconcileMember(ctx, set, member)
+		if err != nil {
+			logger.Error(err, "Failed to reconcile a member", "member", member.Name)
+			o.Recorder.Eventf(set, "Warning", "MemberUpdateFailed", "Failed to reconcile member %s: %s", member.Name, err.Error())
+			return ctrl.Result{}, err
+		}
+		memberStatuses = append(memberStatuses, memberStatus)
+	}
+
+	if err := o.deleteRemovedMembers(ctx, set); err != nil {
+		logger.Error(err, "Failed to delete the VMDiskImages of removed members")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, o.updateStatus(ctx, set, memberStatuses)
+}
+
+func (o Orchestrator) reconcileMember(
+	ctx context.Context,
+	set *crdv1.WorkspaceImageSet,
+	member crdv1.WorkspaceImageSetMember,
+) (crdv1.WorkspaceImageSetMemberStatus, error) {
+	memberStatus := crdv1.WorkspaceImageSetMemberStatus{
+		Name:        member.Name,
+		VMDiskImage: memberVMDiskImageName(set, member),
+	}
+
+	existing := &crdv1.VMDiskImage{}
+	err := o.Get(ctx, client.ObjectKey{Namespace: set.Namespace, Name: memberStatus.VMDiskImage}, existing)
+	switch {
+	case apierrors.IsNotFound(err):
+		existing = nil
+	case err != nil:
+		return memberStatus, fmt.Errorf("failed to get VMDiskImage %s: %w", memberStatus.VMDiskImage, err)
+	}
+
+	if member.Template == nil {
+		if existing == nil {
+			memberStatus.Message = "The referenced VMDiskImage does not exist."
+			return memberStatus, nil
+		}
+		return withVMDiskImagePhase(memberStatus, existing), nil
+	}
+
+	// Never take over a VMDiskImage someone else created under the same name
+	if existing != nil && !metav1.IsControlledBy(existing, set) {
+		memberStatus.Message = "A VMDiskImage the set does not own already has this name."
+		return memberStatus, nil
+	}
+
+	desired := generateMemberVMDiskImage(set, member)
+	err = o.Patch(ctx, desired, client.Apply, client.FieldOwner(crdv1.WorkspaceImageSetControllerName), client.ForceOwnership)
+	if err != nil {
+		return memberStatus, fmt.Errorf("failed to apply VMDiskImage %s: %w", desired.Name, err)
+	}
+
+	return withVMDiskImagePhase(memberStatus, desired), nil
+}
+
+func withVMDiskImagePhase(memberStatus crdv1.WorkspaceImageSetMemberStatus, vmdi *crdv1.VMDiskImage) crdv1.WorkspaceImageSetMemberStatus {
+	memberStatus.Phase = vmdi.Status.Phase
+	memberStatus.Message = vmdi.Status.Message
+
+	return memberStatus
+}
+
+// Delete the VMDiskImages the set owns that no member describes anymore.
+func (o Orchestrator) deleteRemovedMembers(ctx context.Context, set *crdv1.WorkspaceImageSet) error {
+	owned := &crdv1.VMDiskImageList{}
+	err := o.List(ctx, owned,
+		client.InNamespace(set.Namespace),
+		client.MatchingLabels{crdv1.WorkspaceImageSetNameLabel: set.Name},
+	)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, member := range set.Spec.Members {
+		if member.Template != nil {
+			wanted[memberVMDiskImageName(set, member)] = true
+		}
+	}
+
+	for _, vmdi := range owned.Items {
+		if wanted[vmdi.Name] || !metav1.IsControlledBy(&vmdi, set) || !vmdi.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if err := o.Delete(ctx, &vmdi); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete VMDiskImage %s: %w", vmdi.Name, err)
+		}
+		o.Recorder.Eventf(set, "Normal", "MemberRemoved", "Deleted VMDiskImage %s of a removed member", vmdi.Name)
+	}
+
+	return nil
+}
+
+// Aggregate the phases of the members into the phase and Ready condition of
+// the set. The set is Ready once every member is and Failed as soon as one
+// member is.
+func (o Orchestrator) updateStatus(
+	ctx context.Context,
+	set *crdv1.WorkspaceImageSet,
+	memberStatuses []crdv1.WorkspaceImageSetMemberStatus,
+) error {
+	status := set.Status.DeepCopy()
+	status.Members = memberStatuses
+	status.ObservedGeneration = set.Generation
+
+	ready := 0
+	var failed, missing []string
+	for _, memberStatus := range memberStatuses {
+		switch {
+		case memberStatus.Phase == crdv1.PhaseReady:
+			ready++
+		case memberStatus.Phase == crdv1.PhaseFailed:
+			failed = append(failed, memberStatus.Name)
+		case memberStatus.Phase == "" && memberStatus.Message != "":
+			missing = append(missing, memberStatus.Name)
+		}
+	}
+	status.ReadyMembers = fmt.Sprintf("%d/%d", ready, len(memberStatuses))
+
+	condition := metav1.Condition{
+		Type:               crdv1.ConditionTypeReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: set.Generation,
+	}
+	switch {
+	case len(failed) > 0:
+		status.Phase = crdv1.PhaseFailed
+		condition.Reason = crdv1.ReasonMemberFailed
+		condition.Message = fmt.Sprintf("Members failed: %v", failed)
+	case len(missing) > 0:
+		status.Phase = crdv1.PhaseSyncing
+		condition.Reason = crdv1.ReasonMemberMissing
+		condition.Message = fmt.Sprintf("Members have no VMDiskImage of their own: %v", missing)
+	case ready < len(memberStatuses):
+		status.Phase = crdv1.PhaseSyncing
+		condition.Reason = crdv1.ReasonMembersNotReady
+		condition.Message = fmt.Sprintf("%s members are Ready.", status.ReadyMembers)
+	default:
+		status.Phase = crdv1.PhaseReady
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = crdv1.ReasonAllMembersReady
+		condition.Message = "All members are Ready."
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+
+	if equality.Semantic.DeepEqual(status, &set.Status) {
+		return nil
+	}
+
+	previousPhase := set.Status.Phase
+	set.Status = *status
+	if err := o.Status().Update(ctx, set); err != nil {
+		return err
+	}
+
+	if status.Phase != previousPhase {
+		switch status.Phase {
+		case crdv1.PhaseReady:
+			o.Recorder.Eventf(set, "Normal", crdv1.ReasonAllMembersReady, "All %d members are Ready", len(memberStatuses))
+		case crdv1.PhaseFailed:
+			o.Recorder.Eventf(set, "Warning", crdv1.ReasonMemberFailed, "%s", condition.Message)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"strings"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Orchestrator", func() {
+	var (
+		set          *crdv1.WorkspaceImageSet
+		k8sClient    client.Client
+		recorder     *record.FakeRecorder
+		orchestrator Orchestrator
+	)
+
+	newOrchestrator := func(objects ...client.Object) {
+		k8sClient = newFakeClient(append(objects, set)...)
+		recorder = record.NewFakeRecorder(100)
+		orchestrator = Orchestrator{Client: k8sClient, Recorder: recorder}
+	}
+
+	getSet := func(ctx SpecContext) *crdv1.WorkspaceImageSet {
+		current := &crdv1.WorkspaceImageSet{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(set), current)).To(Succeed())
+		return current
+	}
+
+	getVMDiskImage := func(ctx SpecContext, name string) *crdv1.VMDiskImage {
+		current := &crdv1.VMDiskImage{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: "workspaces", Name: name}, current)).To(Succeed())
+		return current
+	}
+
+	// A VMDiskImage of the given phase, owned by the set when owned is true.
+	vmDiskImage := func(name string, phase string, owned bool) *crdv1.VMDiskImage {
+		vmdi := &crdv1.VMDiskImage{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "workspaces"},
+			Spec: crdv1.VMDiskImageSpec{
+				VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "2Gi"},
+			},
+			Status: crdv1.VMDiskImageStatus{Phase: phase},
+		}
+		if owned {
+			member := crdv1.WorkspaceImageSetMember{Name: strings.TrimPrefix(name, set.Name+"-"), Template: &vmdi.Spec}
+			owner := generateMemberVMDiskImage(set, member)
+			vmdi.Labels = owner.Labels
+			vmdi.OwnerReferences = owner.OwnerReferences
+		}
+		return vmdi
+	}
+
+	readyCondition := func(ctx SpecContext) *metav1.Condition {
+		return meta.FindStatusCondition(getSet(ctx).Status.Conditions, crdv1.ConditionTypeReady)
+	}
+
+	BeforeEach(func() {
+		set = &crdv1.WorkspaceImageSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "dev", Namespace: "workspaces", UID: "set-uid", Generation: 2},
+			Spec: crdv1.WorkspaceImageSetSpec{
+				Members: []crdv1.WorkspaceImageSetMember{
+					{
+						Name: "root",
+						Template: &crdv1.VMDiskImageSpec{
+							VMDiskSpec: crdv1.VMDiskSpec{SourceType: "blank", DiskSize: "1Gi"},
+						},
+					},
+					{
+						Name:           "tools",
+						VMDiskImageRef: &crdv1.WorkspaceImageSetMemberRef{Name: "shared-tools"},
+					},
+				},
+				PriorityClassName: "workspaces",
+				DeletionPolicy:    crdv1.DeletionPolicyRetain,
+			},
+		}
+	})
+
+	Context("when reconciling the members", func() {
+		It("applies the VMDiskImages of template members with the settings of the set", func(ctx SpecContext) {
+			newOrchestrator(vmDiskImage("shared-tools", crdv1.PhaseReady, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			member := getVMDiskImage(ctx, "dev-root")
+			Expect(metav1.IsControlledBy(member, set)).To(BeTrue())
+			Expect(member.Labels).To(Equal(map[string]string{
+				crdv1.WorkspaceImageSetNameLabel:   "dev",
+				crdv1.WorkspaceImageSetMemberLabel: "root",
+			}))
+			Expect(member.Spec.DiskSize).To(Equal("1Gi"))
+			Expect(member.Spec.DataVolumeTemplate).NotTo(BeNil())
+			Expect(member.Spec.DataVolumeTemplate.PriorityClassName).To(Equal("workspaces"))
+			Expect(member.Spec.DeletionPolicy).To(Equal(crdv1.DeletionPolicyRetain))
+		})
+
+		It("updates the VMDiskImages of template members to their template", func(ctx SpecContext) {
+			newOrchestrator(vmDiskImage("dev-root", crdv1.PhaseReady, true), vmDiskImage("shared-tools", crdv1.PhaseReady, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			member := getVMDiskImage(ctx, "dev-root")
+			Expect(metav1.IsControlledBy(member, set)).To(BeTrue())
+			Expect(member.Spec.DiskSize).To(Equal("1Gi"))
+		})
+
+		It("leaves referenced members alone", func(ctx SpecContext) {
+			shared := vmDiskImage("shared-tools", crdv1.PhaseSyncing, false)
+			newOrchestrator(shared)
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getVMDiskImage(ctx, "shared-tools")
+			Expect(current.Labels).To(BeEmpty())
+			Expect(current.OwnerReferences).To(BeEmpty())
+			Expect(current.Spec).To(Equal(shared.Spec))
+			Expect(current.ManagedFields).To(BeEmpty())
+
+			Expect(getSet(ctx).Status.Members).To(ContainElement(crdv1.WorkspaceImageSetMemberStatus{
+				Name:        "tools",
+				VMDiskImage: "shared-tools",
+				Phase:       crdv1.PhaseSyncing,
+			}))
+		})
+
+		It("never takes over a VMDiskImage the set does not own", func(ctx SpecContext) {
+			unowned := vmDiskImage("dev-root", crdv1.PhaseReady, false)
+			newOrchestrator(unowned, vmDiskImage("shared-tools", crdv1.PhaseReady, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getVMDiskImage(ctx, "dev-root")
+			Expect(current.OwnerReferences).To(BeEmpty())
+			Expect(current.Spec.DiskSize).To(Equal("2Gi"))
+			Expect(getSet(ctx).Status.Members).To(ContainElement(And(
+				HaveField("Name", "root"),
+				HaveField("Message", "A VMDiskImage the set does not own already has this name."),
+			)))
+		})
+
+		It("deletes the VMDiskImages of removed template members only", func(ctx SpecContext) {
+			newOrchestrator(
+				vmDiskImage("dev-old", crdv1.PhaseReady, true),
+				vmDiskImage("shared-tools", crdv1.PhaseReady, false),
+			)
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = k8sClient.Get(ctx, client.ObjectKey{Namespace: "workspaces", Name: "dev-old"}, &crdv1.VMDiskImage{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			getVMDiskImage(ctx, "shared-tools")
+			Expect(recorder.Events).To(Receive(ContainSubstring("MemberRemoved")))
+		})
+	})
+
+	Context("when aggregating the status of the members", func() {
+		BeforeEach(func() {
+			set.Spec.Members[0].Template = nil
+			set.Spec.Members[0].VMDiskImageRef = &crdv1.WorkspaceImageSetMemberRef{Name: "shared-root"}
+		})
+
+		It("is Ready once every member is", func(ctx SpecContext) {
+			newOrchestrator(vmDiskImage("shared-root", crdv1.PhaseReady, false), vmDiskImage("shared-tools", crdv1.PhaseReady, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getSet(ctx)
+			Expect(current.Status.Phase).To(Equal(crdv1.PhaseReady))
+			Expect(current.Status.ReadyMembers).To(Equal("2/2"))
+			Expect(current.Status.ObservedGeneration).To(Equal(int64(2)))
+			Expect(readyCondition(ctx)).To(And(
+				HaveField("Status", metav1.ConditionTrue),
+				HaveField("Reason", crdv1.ReasonAllMembersReady),
+			))
+			Expect(recorder.Events).To(Receive(ContainSubstring(crdv1.ReasonAllMembersReady)))
+		})
+
+		It("is Syncing while some members are not Ready", func(ctx SpecContext) {
+			newOrchestrator(vmDiskImage("shared-root", crdv1.PhaseReady, false), vmDiskImage("shared-tools", crdv1.PhaseSyncing, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getSet(ctx)
+			Expect(current.Status.Phase).To(Equal(crdv1.PhaseSyncing))
+			Expect(current.Status.ReadyMembers).To(Equal("1/2"))
+			Expect(readyCondition(ctx)).To(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", crdv1.ReasonMembersNotReady),
+			))
+		})
+
+		It("is Failed as soon as one member is", func(ctx SpecContext) {
+			newOrchestrator(vmDiskImage("shared-root", crdv1.PhaseFailed, false), vmDiskImage("shared-tools", crdv1.PhaseReady, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getSet(ctx)
+			Expect(current.Status.Phase).To(Equal(crdv1.PhaseFailed))
+			Expect(current.Status.ReadyMembers).To(Equal("1/2"))
+			Expect(readyCondition(ctx)).To(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", crdv1.ReasonMemberFailed),
+				HaveField("Message", ContainSubstring("root")),
+			))
+			Expect(recorder.Events).To(Receive(ContainSubstring(crdv1.ReasonMemberFailed)))
+		})
+
+		It("reports members whose VMDiskImage is missing", func(ctx SpecContext) {
+			newOrchestrator(vmDiskImage("shared-tools", crdv1.PhaseReady, false))
+
+			_, err := orchestrator.ReconcileMembers(ctx, set)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getSet(ctx)
+			Expect(current.Status.Phase).To(Equal(crdv1.PhaseSyncing))
+			Expect(current.Status.Members).To(ContainElement(crdv1.WorkspaceImageSetMemberStatus{
+				Name:        "root",
+				VMDiskImage: "shared-root",
+				Message:     "The referenced VMDiskImage does not exist.",
+			}))
+			Expect(readyCondition(ctx)).To(And(
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", crdv1.ReasonMemberMissing),
+				HaveField("Message", ContainSubstring("root")),
+			))
+		})
+	})
+})
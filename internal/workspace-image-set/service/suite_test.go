@@ -0,0 +1,38 @@
+package service
+
+import (
+	"testing"
+
+	crdv1 "pelotech/data-sync-operator/api/v1alpha1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestService(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "WorkspaceImageSet Service Suite")
+}
+
+// The types the operator works with, like the scheme of cmd/main.go.
+var testScheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(testScheme))
+	utilruntime.Must(crdv1.AddToScheme(testScheme))
+}
+
+func newFakeClient(objects ...client.Object) client.Client {
+	return fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&crdv1.WorkspaceImageSet{}, &crdv1.VMDiskImage{}).
+		WithIndex(&crdv1.WorkspaceImageSet{}, MemberRefIndex, Orchestrator{}.IndexWorkspaceImageSetByMemberRef).
+		Build()
+}